@@ -0,0 +1,293 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The kinds of image an OS can be exploded from.
+const (
+	imageIso = "iso"
+	imageTar = "tar" // Possibly gzipped or xzed.
+	imageZip = "zip"
+)
+
+var (
+	zipMagic = []byte{'P', 'K', 0x03, 0x04}
+	// tarMagic is at tarMagicOffset in an uncompressed tarball.
+	tarMagic       = []byte("ustar")
+	tarMagicOffset = 257
+)
+
+// imageKind works out whether the image at imagePath is an ISO, a
+// tarball, or a zip archive from its first bytes, falling back to its
+// extension.  Compressed images are assumed to be tarballs.
+func imageKind(imagePath string) (string, error) {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, tarMagicOffset+len(tarMagic))
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, zipMagic):
+		return imageZip, nil
+	case bytes.HasPrefix(head, gzipMagic), bytes.HasPrefix(head, xzMagic):
+		return imageTar, nil
+	case len(head) == tarMagicOffset+len(tarMagic) && bytes.Equal(head[tarMagicOffset:], tarMagic):
+		return imageTar, nil
+	}
+	name := strings.ToLower(imagePath)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return imageZip, nil
+	case strings.HasSuffix(name, ".tar"),
+		strings.HasSuffix(name, ".tgz"),
+		strings.HasSuffix(name, ".tar.gz"),
+		strings.HasSuffix(name, ".tar.xz"):
+		return imageTar, nil
+	}
+	return imageIso, nil
+}
+
+// extractedSize returns how much space exploding the image at
+// imagePath, which is imageSize bytes, is expected to take.  Archives
+// list how big each of their entries is, which is added up, since a
+// compressed tarball can be many times bigger once it is extracted.
+// Compressed tarballs have to be decompressed to read the sizes.
+// ISOs are assumed to take explodeSpaceFactor times their size.
+func extractedSize(ctx context.Context, imagePath string, imageSize int64) (int64, error) {
+	kind, err := imageKind(imagePath)
+	if err != nil {
+		return 0, err
+	}
+	switch kind {
+	case imageTar:
+		return tarSize(ctx, imagePath)
+	case imageZip:
+		zr, err := zip.OpenReader(imagePath)
+		if err != nil {
+			return 0, fmt.Errorf("archive: Failed to read %s: %v", imagePath, err)
+		}
+		defer zr.Close()
+		var size int64
+		for _, zf := range zr.File {
+			size += int64(zf.UncompressedSize64)
+		}
+		return size, nil
+	}
+	return int64(float64(imageSize) * explodeSpaceFactor), nil
+}
+
+// tarSize adds up the sizes of the files in the possibly compressed
+// tarball at tarPath.
+func tarSize(ctx context.Context, tarPath string) (int64, error) {
+	src, err := openDecompressed(ctx, tarPath)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	var size int64
+	tr := tar.NewReader(src)
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("archive: Failed to read %s: %v", tarPath, err)
+		}
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			size += hdr.Size
+		}
+	}
+}
+
+// archivePath turns the name of an entry in an archive into where it
+// is extracted to under dest.  Leading slashes and ./ are dropped, so
+// that the tree looks like a mounted ISO, and names that would end up
+// outside of dest are refused.
+func archivePath(dest, name string) (string, error) {
+	clean := path.Clean(strings.TrimLeft(name, "/"))
+	if clean == "." {
+		return dest, nil
+	}
+	res := filepath.Join(dest, filepath.FromSlash(clean))
+	if clean == ".." || strings.HasPrefix(clean, "../") || !pathUnder(dest, res) {
+		return "", fmt.Errorf("archive: %s is outside of the archive", name)
+	}
+	return res, nil
+}
+
+// archiveLinks collects the links in an archive, which are made once
+// everything else has been extracted so that nothing is written
+// through them.
+type archiveLinks struct {
+	hard []*isoLink // Targets are paths under dest.
+	soft []*isoLink // Targets are used as they are, relative to the link.
+}
+
+// make makes the links under dest.  Symlinks that are absolute or lead
+// outside of dest are refused.
+func (l *archiveLinks) make(dest string) error {
+	for _, link := range l.soft {
+		if err := checkLinkTarget("archive", dest, link.path, link.target); err != nil {
+			return err
+		}
+	}
+	for _, link := range l.hard {
+		if err := os.RemoveAll(link.path); err != nil {
+			return err
+		}
+		if err := os.Link(link.target, link.path); err != nil {
+			return err
+		}
+	}
+	for _, link := range l.soft {
+		if err := os.RemoveAll(link.path); err != nil {
+			return err
+		}
+		if err := os.Symlink(link.target, link.path); err != nil {
+			return err
+		}
+	}
+	return checkMadeLinks("archive", dest, l.soft)
+}
+
+// writeArchiveFile writes src to dest, making its directory if the
+// archive did not list it.
+func writeArchiveFile(dest string, mode os.FileMode, src io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if mode == 0 {
+		mode = 0644
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		return fmt.Errorf("archive: Failed to extract %s: %v", dest, err)
+	}
+	return out.Close()
+}
+
+// extractTar extracts the possibly compressed tarball at tarPath into
+// dest.
+func extractTar(ctx context.Context, tarPath, dest string) error {
+	src, err := openDecompressed(ctx, tarPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	links := &archiveLinks{}
+	tr := tar.NewReader(src)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("archive: Failed to read %s: %v", tarPath, err)
+		}
+		entryPath, err := archivePath(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(entryPath, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := writeArchiveFile(entryPath, mode, tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			links.soft = append(links.soft, &isoLink{path: entryPath, target: hdr.Linkname})
+		case tar.TypeLink:
+			target, err := archivePath(dest, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			links.hard = append(links.hard, &isoLink{path: entryPath, target: target})
+		default:
+			// Devices, fifos, and the like have no place in an
+			// install tree.
+			logger.Printf("archive: Skipping %s in %s, it is not a file, directory, or link\n", hdr.Name, tarPath)
+		}
+	}
+	return links.make(dest)
+}
+
+// extractZip extracts the zip archive at zipPath into dest.
+func extractZip(ctx context.Context, zipPath, dest string) error {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return fmt.Errorf("archive: Failed to read %s: %v", zipPath, err)
+	}
+	defer zr.Close()
+	links := &archiveLinks{}
+	for _, zf := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entryPath, err := archivePath(dest, zf.Name)
+		if err != nil {
+			return err
+		}
+		info := zf.FileInfo()
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(entryPath, 0755); err != nil {
+				return err
+			}
+			continue
+		case info.Mode()&os.ModeSymlink != 0:
+			r, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			target := &bytes.Buffer{}
+			_, err = io.Copy(target, r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+			links.soft = append(links.soft, &isoLink{path: entryPath, target: target.String()})
+			continue
+		}
+		r, err := zf.Open()
+		if err != nil {
+			return fmt.Errorf("archive: Failed to read %s from %s: %v", zf.Name, zipPath, err)
+		}
+		err = writeArchiveFile(entryPath, info.Mode().Perm(), r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return links.make(dest)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testArchiveEntry is an entry of an archive built by writeTestTar or
+// writeTestZip.
+type testArchiveEntry struct {
+	name string
+	body string // The contents of a file.
+	link string // The target of a symlink, or of a hard link if hard is set.
+	hard bool
+}
+
+// testArchiveEntries are the entries every test archive starts with.
+var testArchiveEntries = []testArchiveEntry{
+	{name: "readme.txt", body: "hello"},
+	{name: "sub/"},
+}
+
+// writeTestTar writes a tarball with entries to dir, and returns its
+// path.
+func writeTestTar(t *testing.T, dir string, entries []testArchiveEntry) string {
+	tarPath := filepath.Join(dir, "test.tar")
+	f, err := os.Create(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, entry := range append(testArchiveEntries, entries...) {
+		hdr := &tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.body)), Typeflag: tar.TypeReg}
+		switch {
+		case strings.HasSuffix(entry.name, "/"):
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+		case entry.hard:
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = entry.link
+		case entry.link != "":
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = entry.link
+			hdr.Mode = 0777
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return tarPath
+}
+
+// writeTestZip writes a zip archive with entries to dir, and returns
+// its path.  Zip archives cannot hold hard links.
+func writeTestZip(t *testing.T, dir string, entries []testArchiveEntry) string {
+	zipPath := filepath.Join(dir, "test.zip")
+	f, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, entry := range append(testArchiveEntries, entries...) {
+		if entry.hard {
+			t.Fatalf("%s: zip archives cannot hold hard links", entry.name)
+		}
+		hdr := &zip.FileHeader{Name: entry.name}
+		body := entry.body
+		switch {
+		case strings.HasSuffix(entry.name, "/"):
+			hdr.SetMode(os.ModeDir | 0755)
+		case entry.link != "":
+			hdr.SetMode(os.ModeSymlink | 0777)
+			body = entry.link
+		default:
+			hdr.SetMode(0644)
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return zipPath
+}
+
+// testArchiveFormats are the ways archives can be written and
+// extracted.
+var testArchiveFormats = []struct {
+	name    string
+	write   func(*testing.T, string, []testArchiveEntry) string
+	extract func(context.Context, string, string) error
+}{
+	{name: "tar", write: writeTestTar, extract: extractTar},
+	{name: "zip", write: writeTestZip, extract: extractZip},
+}
+
+func TestExtractArchive(t *testing.T) {
+	for _, format := range testArchiveFormats {
+		t.Run(format.name, func(t *testing.T) {
+			dir := testIsoDir(t)
+			defer os.RemoveAll(dir)
+			archivePath := format.write(t, dir, []testArchiveEntry{
+				{name: "./sub/link", link: "../readme.txt"},
+			})
+			dest := filepath.Join(dir, "tree")
+			if err := format.extract(context.Background(), archivePath, dest); err != nil {
+				t.Fatal(err)
+			}
+			buf, err := ioutil.ReadFile(filepath.Join(dest, "sub", "link"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != "hello" {
+				t.Errorf("sub/link has %q, wanted %q", buf, "hello")
+			}
+		})
+	}
+}
+
+func TestExtractTarHardLink(t *testing.T) {
+	dir := testIsoDir(t)
+	defer os.RemoveAll(dir)
+	tarPath := writeTestTar(t, dir, []testArchiveEntry{
+		{name: "sub/hard", link: "readme.txt", hard: true},
+	})
+	dest := filepath.Join(dir, "tree")
+	if err := extractTar(context.Background(), tarPath, dest); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(dest, "sub", "hard"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("sub/hard has %q, wanted %q", buf, "hello")
+	}
+}
+
+func TestExtractArchiveEscaping(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		entries []testArchiveEntry
+		want    string // What the error must say.
+		tarOnly bool
+	}{
+		{
+			name:    "up in the name",
+			entries: []testArchiveEntry{{name: "../escape", body: "hello"}},
+			want:    "outside of the archive",
+		},
+		{
+			name:    "up after a leading slash",
+			entries: []testArchiveEntry{{name: "/sub/../../escape", body: "hello"}},
+			want:    "outside of the archive",
+		},
+		{
+			name:    "hard link up",
+			entries: []testArchiveEntry{{name: "link", link: "../escape", hard: true}},
+			want:    "outside of the archive",
+			tarOnly: true,
+		},
+		{
+			name:    "absolute symlink",
+			entries: []testArchiveEntry{{name: "sub/link", link: "/etc/passwd"}},
+			want:    " links to ",
+		},
+		{
+			name:    "symlink up",
+			entries: []testArchiveEntry{{name: "sub/link", link: "../../escape"}},
+			want:    " links to ",
+		},
+		{
+			// sub/up leads to the top of the tree, which is fine, but
+			// going up from there through it is not.
+			name: "symlink through another link",
+			entries: []testArchiveEntry{
+				{name: "link", link: "sub/up/.."},
+				{name: "sub/up", link: ".."},
+			},
+			want: " links to ",
+		},
+	} {
+		for _, format := range testArchiveFormats {
+			if tc.tarOnly && format.name != "tar" {
+				continue
+			}
+			t.Run(format.name+" "+tc.name, func(t *testing.T) {
+				dir := testIsoDir(t)
+				defer os.RemoveAll(dir)
+				// Something for links out of the tree to find.
+				if err := ioutil.WriteFile(filepath.Join(dir, "escape"), []byte("outside"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				archivePath := format.write(t, dir, tc.entries)
+				err := format.extract(context.Background(), archivePath, filepath.Join(dir, "tree"))
+				if err == nil || !strings.Contains(err.Error(), tc.want) {
+					t.Fatalf("extract returned %v, wanted an error saying %q", err, tc.want)
+				}
+				if buf, err := ioutil.ReadFile(filepath.Join(dir, "escape")); err != nil || string(buf) != "outside" {
+					t.Errorf("the file outside of the tree was changed: %q, %v", buf, err)
+				}
+			})
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	consul "github.com/hashicorp/consul/api"
 )
@@ -21,6 +22,82 @@ type keySaver interface {
 	RebuildRebarData() error
 }
 
+// compacted things are saved in a smaller form than the one they are
+// served in, and expanded back out when they are loaded.
+type compacted interface {
+	compact() interface{}
+	expand() error
+}
+
+// storedForm returns what should be saved for thing.
+func storedForm(thing keySaver) interface{} {
+	if c, ok := thing.(compacted); ok {
+		return c.compact()
+	}
+	return thing
+}
+
+// afterSaver things have work to do once they have been written to
+// the backend, which must not be done if writing them fails.
+type afterSaver interface {
+	afterSave(oldThing interface{}) error
+}
+
+// afterRemover things have work to do once they have been removed
+// from the backend.
+type afterRemover interface {
+	afterRemove() error
+}
+
+// saved runs the afterSave hook of thing, if it has one.
+func saved(thing keySaver, oldThing interface{}) error {
+	if a, ok := thing.(afterSaver); ok {
+		return a.afterSave(oldThing)
+	}
+	return nil
+}
+
+// removed runs the afterRemove hook of thing, if it has one.
+func removed(thing keySaver) error {
+	if a, ok := thing.(afterRemover); ok {
+		return a.afterRemove()
+	}
+	return nil
+}
+
+// retried things have each step of their save tried again if it fails
+// for a reason that may go away on its own.  Their onChange hook and
+// storing them are one step, and telling Rebar about them is another,
+// so that a thing that was stored is not changed and stored again
+// because Rebar could not be told about it.
+type retried interface {
+	keySaver
+	// saveRetries returns how many times to try saving, and how long
+	// to wait before the first retry.  The wait doubles each time.
+	saveRetries() (int, time.Duration)
+}
+
+// retrySave calls step until it succeeds, fails for a reason that is
+// not transient, or thing runs out of attempts.  what says what step
+// does to thing, for the log.  Things that are not retried only have
+// step called once.
+func retrySave(thing keySaver, what string, step func() error) error {
+	r, ok := thing.(retried)
+	if !ok {
+		return step()
+	}
+	attempts, delay := r.saveRetries()
+	for attempt := 1; ; attempt++ {
+		err := step()
+		if err == nil || attempt >= attempts || !isTransient(err) {
+			return err
+		}
+		logger.Printf("backend: Attempt %d to %s %s failed, retrying in %v: %v\n", attempt, what, thing.key(), delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
 type storageBackend interface {
 	list(keySaver) [][]byte
 	save(keySaver, interface{}) error
@@ -84,21 +161,31 @@ func (f fileBackend) load(thing keySaver) error {
 	if err != nil {
 		return fmt.Errorf("file: Failed to read %s: %v", fullName, err)
 	}
-	return json.Unmarshal(buf, &thing)
+	return decodeThing(buf, thing)
 }
 
 func (f fileBackend) save(newThing keySaver, oldThing interface{}) error {
+	if err := retrySave(newThing, "save", func() error {
+		return f.saveOnce(newThing, oldThing)
+	}); err != nil {
+		return err
+	}
+	return saved(newThing, oldThing)
+}
+
+func (f fileBackend) saveOnce(newThing keySaver, oldThing interface{}) error {
 	f.mkThingPath(newThing)
 	if err := newThing.onChange(oldThing); err != nil {
 		return err
 	}
+	stampSchemaVersion(newThing)
 	fullPath := f.mkThingName(newThing)
 	file, err := os.Create(fullPath)
 	if err != nil {
 		return fmt.Errorf("file: Failed to open thing %s: %v", fullPath, err)
 	}
 	enc := json.NewEncoder(file)
-	if err := enc.Encode(newThing); err != nil {
+	if err := enc.Encode(storedForm(newThing)); err != nil {
 		os.Remove(fullPath)
 		file.Close()
 		return fmt.Errorf("file: Failed to save %s: %v", fullPath, err)
@@ -115,7 +202,10 @@ func (f fileBackend) remove(thing keySaver) error {
 	if err := thing.onDelete(); err != nil {
 		return err
 	}
-	return os.Remove(f.mkThingName(thing))
+	if err := os.Remove(f.mkThingName(thing)); err != nil {
+		return err
+	}
+	return removed(thing)
 }
 
 type consulBackend struct {
@@ -156,30 +246,47 @@ func (cb *consulBackend) list(thing keySaver) [][]byte {
 }
 
 func (cb *consulBackend) save(newThing keySaver, oldThing interface{}) error {
+	if err := retrySave(newThing, "save", func() error {
+		return cb.saveOnce(newThing, oldThing)
+	}); err != nil {
+		return err
+	}
+	if err := saved(newThing, oldThing); err != nil {
+		return err
+	}
+	return retrySave(newThing, "tell Rebar about", func() error {
+		if err := newThing.RebuildRebarData(); err != nil {
+			return &RebarError{Key: newThing.key(), Message: err.Error()}
+		}
+		return nil
+	})
+}
+
+func (cb *consulBackend) saveOnce(newThing keySaver, oldThing interface{}) error {
 	if err := newThing.onChange(oldThing); err != nil {
 		return err
 	}
-	buf, err := json.Marshal(newThing)
+	stampSchemaVersion(newThing)
+	buf, err := json.Marshal(storedForm(newThing))
 	if err != nil {
 		return fmt.Errorf("consul: Failed to marshal %+v: %v", newThing, err)
 	}
 	kp := &consul.KVPair{Value: buf, Key: cb.makeKey(newThing)}
 	if _, err := cb.kv.Put(kp, nil); err != nil {
-		return fmt.Errorf("consul: Failed to save %s: %v", kp.Key, err)
+		return &BackendError{Key: kp.Key, Message: fmt.Sprintf("Failed to save: %v", err)}
 	}
-	err = newThing.RebuildRebarData()
-	return err
+	return nil
 }
 
 func (cb *consulBackend) load(s keySaver) error {
 	key := cb.makeKey(s)
 	kp, _, err := cb.kv.Get(key, nil)
 	if err != nil {
-		return fmt.Errorf("consul: Communication failure: %v", err)
+		return &BackendError{Key: key, Message: fmt.Sprintf("Communication failure: %v", err)}
 	} else if kp == nil {
 		return fmt.Errorf("consul: Failed to load %v", key)
 	}
-	if err := json.Unmarshal(kp.Value, &s); err != nil {
+	if err := decodeThing(kp.Value, s); err != nil {
 		return fmt.Errorf("consul: Failed to unmarshal %s: %v", kp.Key, err)
 	}
 	return nil
@@ -194,8 +301,13 @@ func (cb *consulBackend) remove(s keySaver) error {
 	}
 	key := cb.makeKey(s)
 	if _, err := cb.kv.Delete(key, nil); err != nil {
-		return fmt.Errorf("consul: Failed to delete %v: %v", key, err)
+		return &BackendError{Key: key, Message: fmt.Sprintf("Failed to delete: %v", err)}
+	}
+	if err := removed(s); err != nil {
+		return err
 	}
-	err := s.RebuildRebarData()
-	return err
+	if err := s.RebuildRebarData(); err != nil {
+		return &RebarError{Key: s.key(), Message: err.Error()}
+	}
+	return nil
 }
@@ -2,22 +2,23 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/digitalrebar/rebar-api/client"
+	"github.com/gin-gonic/gin"
 )
 
 // RenderData is the struct that is passed to templates as a source of
@@ -27,6 +28,24 @@ type RenderData struct {
 	Env            *BootEnv // The boot environment that provided the template.
 	ProvisionerURL string   // The URL to the provisioner that all files should be fetched from
 	CommandURL     string   // The URL of the API endpoint that this machine should talk to for command and control
+	FileURL        string   // The base URL files under the file root are served over HTTP from.
+	TftpServer     string   // The host files under the file root are served over TFTP from.
+	depth          int      // How deeply Render calls are nested.
+}
+
+// maxRenderDepth is how deeply Render calls can be nested, so that a
+// param that renders itself cannot expand forever.
+const maxRenderDepth = 8
+
+func newRenderData(machine *Machine, env *BootEnv) *RenderData {
+	return &RenderData{
+		Machine:        machine,
+		Env:            env,
+		ProvisionerURL: provisionerURLFor(machine),
+		CommandURL:     commandURLFor(machine),
+		FileURL:        fileServerURL(),
+		TftpServer:     tftpServer(),
+	}
 }
 
 // BootParams is a helper function that expands the BootParams
@@ -42,6 +61,27 @@ func (r *RenderData) BootParams() (string, error) {
 	return res.String(), nil
 }
 
+// Render is a helper function that expands tmplString as a template
+// against the same render data, so that params which are themselves
+// small templates, such as a hostname pattern, can be expanded with
+// the other params.
+func (r *RenderData) Render(tmplString string) (string, error) {
+	if r.depth >= maxRenderDepth {
+		return "", fmt.Errorf("template: Render calls nested more than %d deep", maxRenderDepth)
+	}
+	tmpl, err := newTemplate("Render", tmplString)
+	if err != nil {
+		return "", err
+	}
+	inner := *r
+	inner.depth++
+	res := &bytes.Buffer{}
+	if err := tmpl.Execute(&limitedWriter{dest: res, limit: renderMaxSize}, &inner); err != nil {
+		return "", err
+	}
+	return res.String(), nil
+}
+
 func (r *RenderData) ParseUrl(segment, rawUrl string) (string, error) {
 	parsedUrl, err := url.Parse(rawUrl)
 	if err != nil {
@@ -58,6 +98,117 @@ func (r *RenderData) ParseUrl(segment, rawUrl string) (string, error) {
 	return "", fmt.Errorf("No idea how to get URL part %s from %s", segment, rawUrl)
 }
 
+// KernelURL is a helper function that returns the full path to the
+// kernel of the boot environment for proto.
+func (r *RenderData) KernelURL(proto string) (string, error) {
+	return r.Env.PathFor(proto, r.Env.Kernel)
+}
+
+// InitrdURLs is a helper function that returns the full paths to the
+// initrds of the boot environment for proto, followed by the extra
+// initrds of the machine, in the order they should be loaded.
+func (r *RenderData) InitrdURLs(proto string) ([]string, error) {
+	res, err := r.Env.InitrdPaths(proto)
+	if err != nil || r.Machine == nil {
+		return res, err
+	}
+	extra, err := r.Machine.InitrdPaths(proto)
+	if err != nil {
+		return nil, err
+	}
+	return append(res, extra...), nil
+}
+
+// JoinInitrds is a helper function that joins InitrdURLs the same way
+// as .Env.JoinInitrds, but with the extra initrds of the machine.
+func (r *RenderData) JoinInitrds(proto string) (string, error) {
+	fullInitrds, err := r.InitrdURLs(proto)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(fullInitrds, " "), nil
+}
+
+// File is a helper function that returns the contents of a file in
+// the install tree of the boot environment.  relPath must stay inside
+// of the install tree.
+func (r *RenderData) File(relPath string) (string, error) {
+	installDir, err := r.Env.PathFor("disk", "")
+	if err != nil {
+		return "", err
+	}
+	filePath, err := r.Env.PathFor("disk", relPath)
+	if err != nil {
+		return "", err
+	}
+	if !pathUnder(installDir, filePath) || !pathUnder(fileRoot, filePath) {
+		return "", fmt.Errorf("File %s is outside of the install tree for %s", relPath, r.Env.Name)
+	}
+	realPath, err := filepath.EvalSymlinks(filePath)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("No such file %s in the install tree for %s", relPath, r.Env.Name)
+	} else if err != nil {
+		return "", err
+	}
+	realRoot, err := filepath.EvalSymlinks(fileRoot)
+	if err != nil {
+		return "", err
+	}
+	if !pathUnder(realRoot, realPath) {
+		return "", fmt.Errorf("File %s links outside of %s", relPath, fileRoot)
+	}
+	buf, err := ioutil.ReadFile(realPath)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// Arch is a helper function that returns the architecture of the
+// machine.
+func (r *RenderData) Arch() string {
+	return r.Machine.MachineArch()
+}
+
+// Firmware is a helper function that returns the firmware the machine
+// boots with.
+func (r *RenderData) Firmware() string {
+	return r.Machine.MachineFirmware()
+}
+
+// osInfo returns the OS of the boot environment, or an empty one if
+// it does not have one.
+func (r *RenderData) osInfo() *OsInfo {
+	if r.Env == nil || r.Env.OS == nil {
+		return &OsInfo{}
+	}
+	return r.Env.OS
+}
+
+// OSName is a helper function that returns the name of the OS of the
+// boot environment, or "" if it does not have one.
+func (r *RenderData) OSName() string {
+	return r.osInfo().Name
+}
+
+// OSVersion is a helper function that returns the version of the OS
+// of the boot environment, or "" if it does not have one.
+func (r *RenderData) OSVersion() string {
+	return r.osInfo().Version
+}
+
+// OSFamily is a helper function that returns the family of the OS of
+// the boot environment, or "" if it does not have one.
+func (r *RenderData) OSFamily() string {
+	return r.osInfo().Family
+}
+
+// OSCodename is a helper function that returns the codename of the OS
+// of the boot environment, or "" if it does not have one.
+func (r *RenderData) OSCodename() string {
+	return r.osInfo().Codename
+}
+
 // Param is a helper function for extracting a parameter from Machine.Params
 func (r *RenderData) Param(key string) (interface{}, error) {
 	res, ok := r.Machine.Params[key]
@@ -67,6 +218,34 @@ func (r *RenderData) Param(key string) (interface{}, error) {
 	return res, nil
 }
 
+// ParamPath is a helper function that returns a nested machine
+// parameter.  keyPath is a dot-separated list of keys, so
+// .ParamPath "disks.root" returns the root entry of the disks param.
+func (r *RenderData) ParamPath(keyPath string) (interface{}, error) {
+	res, ok := r.Machine.paramAt(keyPath)
+	if !ok {
+		return nil, fmt.Errorf("No such machine parameter %s", keyPath)
+	}
+	return res, nil
+}
+
+// ParamExists is a helper function that checks to see if the machine
+// has the parameter at keyPath.
+func (r *RenderData) ParamExists(keyPath string) bool {
+	_, err := r.ParamPath(keyPath)
+	return err == nil
+}
+
+// ParamDefault is a helper function that returns the machine
+// parameter at keyPath, or def if the machine does not have it.
+func (r *RenderData) ParamDefault(keyPath string, def interface{}) interface{} {
+	res, err := r.ParamPath(keyPath)
+	if err != nil {
+		return def
+	}
+	return res
+}
+
 // TemplateInfo holds information on the templates in the boot
 // environment that will be expanded into files.
 type TemplateInfo struct {
@@ -75,46 +254,348 @@ type TemplateInfo struct {
 	// the final path the template should be
 	// written to.
 	UUID      string // The UUID of the template that should be expanded.
+	Validator string // The optional validator the rendered template must pass.  Can be one of the keys of renderValidators.
+	// The UUID of a template holding a JSON schema that the rendered
+	// template must conform to, if any.
+	SchemaUUID string `json:",omitempty"`
+	// If set, the template is only rendered for machines with this
+	// Arch or Firmware.
+	Arch     string
+	Firmware string
+	// The mode to create missing directories in Path with, in octal.
+	// Defaults to --dir-mode.
+	DirMode string
+	// The name of a command in --render-hook-dir to run after the
+	// rendered template has been written, if any.
+	Hook      string
 	pathTmpl  *template.Template
 	finalPath string
 	contents  *Template
+	schema    *jsonSchema
+}
+
+// appliesTo checks to see if the template should be rendered for machine.
+func (t *TemplateInfo) appliesTo(machine *Machine) bool {
+	if t.Arch != "" && t.Arch != machine.MachineArch() {
+		return false
+	}
+	if t.Firmware != "" && t.Firmware != machine.MachineFirmware() {
+		return false
+	}
+	return true
+}
+
+// check makes sure that the Validator, Arch, Firmware, DirMode, and
+// Hook of the template are ones we know what to do with.  kind is the
+// kind of thing the template belongs to, for the error message.
+func (t *TemplateInfo) check(kind string) error {
+	if _, ok := renderValidators[t.Validator]; t.Validator != "" && !ok {
+		return fmt.Errorf("%s: Unknown validator %s for template %s", kind, t.Validator, t.Name)
+	}
+	if t.Arch != "" && t.Arch != archX86_64 && t.Arch != archArm64 {
+		return fmt.Errorf("%s: Unknown arch %s for template %s", kind, t.Arch, t.Name)
+	}
+	if t.Firmware != "" && t.Firmware != firmwareBios && t.Firmware != firmwareUefi {
+		return fmt.Errorf("%s: Unknown firmware %s for template %s", kind, t.Firmware, t.Name)
+	}
+	if _, err := dirModeFor(t.DirMode); err != nil {
+		return fmt.Errorf("%s: Invalid DirMode for template %s: %v", kind, t.Name, err)
+	}
+	if t.Hook != "" {
+		if _, err := renderHookPath(t.Hook); err != nil {
+			return fmt.Errorf("%s: Invalid Hook for template %s: %v", kind, t.Name, err)
+		}
+	}
+	return nil
 }
 
 type FileData struct {
-	URL              string // The URL to get the file
-	Name             string // Name of file in the install directory
-	ValidationURL    string // The URL to get a checksum or signature file
-	ValidationMethod string // The method to validate the file.
+	URL              string   // The URL to get the file
+	Mirrors          []string `json:",omitempty"` // Other URLs to get the file from, tried in order if URL fails.
+	Name             string   // Name of file in the install directory
+	ValidationURL    string   // The URL to get a checksum or signature file
+	ValidationMethod string   // The method to validate the file: sha256, the default, or gpg for a detached signature.
+	Keyring          string   // The name of the keyring in --keyring-dir to check a gpg signature with.  Required for gpg.
+	DirMode          string   // The mode to create missing directories for the file with, in octal.  Defaults to --dir-mode.
+	Attempts         int      // How many times to try downloading the file before giving up.  Defaults to --file-download-attempts.
+	RetryDelay       string   // How long to wait before retrying a failed download, like "30s".  Defaults to --file-retry-delay.
+	// If set, the downloaded file is a template that is rendered for
+	// each machine using the boot environment, and written to
+	// RenderPath.  Name can then be a template too, expanded for each
+	// machine like a template Path.
+	Template bool
+	// A template that specifies the path the rendered file should be
+	// written to.  Defaults to Name in the install tree if Name is a
+	// template, and is required otherwise if Template is set.
+	RenderPath string
+}
+
+// nameIsTemplate returns whether the Name of the file is a template
+// expanded for each machine, rather than a fixed name.
+func (f *FileData) nameIsTemplate() bool {
+	return f.Template && strings.Contains(f.Name, "{{")
+}
+
+// diskName returns the name the file is downloaded to in the install
+// tree.  Files whose Name is a template are still downloaded once
+// for the whole boot environment, under .templated-files.
+func (f *FileData) diskName() string {
+	if f.nameIsTemplate() {
+		return path.Join(".templated-files", contentSha256(f.Name))
+	}
+	return f.Name
+}
+
+// retryPolicy returns how many times the file should be tried and
+// how long to wait before the first retry.
+func (f *FileData) retryPolicy() (int, time.Duration, error) {
+	attempts := f.Attempts
+	if attempts == 0 {
+		attempts = fileDownloadAttempts
+	}
+	if attempts < 1 {
+		return 0, 0, fmt.Errorf("Attempts must be at least 1, not %d", attempts)
+	}
+	if f.RetryDelay == "" {
+		return attempts, fileRetryDelay, nil
+	}
+	delay, err := time.ParseDuration(f.RetryDelay)
+	if err != nil {
+		return 0, 0, err
+	}
+	if delay < 0 {
+		return 0, 0, fmt.Errorf("RetryDelay cannot be negative")
+	}
+	return attempts, delay, nil
+}
+
+// The outcomes of fetching a file.
+const (
+	fileDownloaded = "downloaded"
+	fileSkipped    = "skipped"
+	fileFailed     = "failed"
+)
+
+// FileResult reports what happened when fetching one of the files of
+// a boot environment.
+type FileResult struct {
+	Name     string // The name of the file in the install directory.
+	URL      string // Where the file was downloaded from.
+	Status   string // One of downloaded, skipped (it was already valid), or failed.
+	Attempts int    `json:",omitempty"` // How many times we tried to download it, if we did.
+	Error    string `json:",omitempty"` // What went wrong, if it failed.
+}
+
+// ParamInfo describes a machine parameter that a boot environment uses.
+type ParamInfo struct {
+	Type        string      // The JSON type of the param: string, number, boolean, array, or object.
+	Default     interface{} // The value that should be suggested for the param, if any.
+	Description string      // What the param is for and what it should look like, if described.
+	Example     interface{} // An example value for the param, if any.
+}
+
+// paramTypes maps the allowed ParamInfo types to a check for whether
+// a decoded JSON value is of that type.
+var paramTypes = map[string]func(interface{}) bool{
+	"string": func(v interface{}) bool {
+		_, ok := v.(string)
+		return ok
+	},
+	"number": func(v interface{}) bool {
+		_, ok := v.(float64)
+		return ok
+	},
+	"boolean": func(v interface{}) bool {
+		_, ok := v.(bool)
+		return ok
+	},
+	"array": func(v interface{}) bool {
+		_, ok := v.([]interface{})
+		return ok
+	},
+	"object": func(v interface{}) bool {
+		_, ok := v.(map[string]interface{})
+		return ok
+	},
+}
+
+// ParamSchema describes a param that machines using a boot
+// environment should have.
+type ParamSchema struct {
+	Name     string      // The name of the param.
+	Required bool        // Whether the param is in RequiredParams.
+	Type     string      // The JSON type of the param, if declared.
+	Default  interface{} // The suggested value for the param, if declared.
+	// What the param is for, and an example of it, if described.
+	Description string      `json:",omitempty"`
+	Example     interface{} `json:",omitempty"`
 }
 
 // OsInfo holds information about the operating system this BootEnv maps to.
 // Most of this information is optional for now.
 type OsInfo struct {
-	Name      string      // The name of the OS this BootEnv has.  Required.
-	Family    string      // The family of operating system (linux distro lineage, etc)
-	Codename  string      // The codename of the OS, if any.
-	Version   string      // The version of the OS, if any.
-	IsoFile   string      // The name of the ISO that the OS should install from.
-	IsoSha256 string      // The SHA256 of the ISO file.  Used to check for corrupt downloads.
-	IsoUrl    string      // The URL that the ISO can be downloaded from, if any.
-	Files     []*FileData // A list of files to download along with an ISO.
+	Name      string // The name of the OS this BootEnv has.  Required.
+	Family    string // The family of operating system (linux distro lineage, etc)
+	Codename  string // The codename of the OS, if any.
+	Version   string // The version of the OS, if any.
+	IsoFile   string // The name of the ISO, tarball, or zip archive that the OS should install from.
+	IsoSha256 string // The SHA256 of the ISO file.  Used to check for corrupt downloads.
+	IsoUrl    string // The URL that the ISO can be downloaded from, if any.
+	// Whether to keep the ISO in the isos directory once it has been
+	// exploded.  Defaults to --keep-isos.
+	KeepIso *bool
+	Files   []*FileData // A list of files to download along with an ISO.
+	// The architecture the OS is for: x86_64 or arm64.  If set, the
+	// install tree lives in an arch subdirectory of the OS, and only
+	// machines with the same Arch can use the boot environment.
+	Arch string
+	// The URL of a checksums file that lists the ISO, like SHA256SUMS.
+	// If set, the ISO is checked against the checksum it lists.
+	IsoChecksumsUrl string
+	// The URL of a detached GPG signature of IsoChecksumsUrl, like
+	// SHA256SUMS.gpg.  If set, the checksums are only trusted if the
+	// signature was made by a key in IsoKeyring.
+	IsoSignatureUrl string
+	// The name of the keyring in --keyring-dir to check the signature
+	// with.  Required if IsoSignatureUrl is set.
+	IsoKeyring string
+	// The SHA256 of the ISO the install tree is pinned to.  If set and
+	// different from IsoSha256, the install tree exploded from the
+	// pinned ISO is left alone, so installs in progress do not see it
+	// change, and the new ISO is only downloaded.  Setting it to
+	// IsoSha256 promotes the new ISO.
+	PinnedIsoSha256 string
+}
+
+// treeName is the directory under the file root that holds
+// everything for the OS.
+func (o *OsInfo) treeName() string {
+	if o == nil {
+		return ""
+	}
+	return path.Join(o.Name, o.Arch)
 }
 
 func (o *OsInfo) InstallUrl() string {
-	return provisionerURL + "/" + path.Join(o.Name, "install")
+	return fileServerURL() + "/" + path.Join(o.treeName(), "install")
 }
 
+const (
+	// bootEnvInstall boot environments boot machines into a kernel
+	// and initrds.  This is the default.
+	bootEnvInstall = "install"
+	// bootEnvLocal boot environments just boot machines from their
+	// local disks, so they need no bootloader templates, kernel, or
+	// initrds.
+	bootEnvLocal = "local"
+)
+
+// The ways a boot environment can handle machines that are missing
+// some of its RequiredParams.
+const (
+	missingParamsError    = "error"
+	missingParamsSkip     = "skip"
+	missingParamsFallback = "fallback"
+)
+
 // BootEnv encapsulates the machine-agnostic information needed by the
 // provisioner to set up a boot environment.
 type BootEnv struct {
-	Name           string          // The name of the boot environment.
-	OS             *OsInfo         // The OS specific information for the boot environment.
-	Templates      []*TemplateInfo // The templates that should be expanded into files for the bot environment.
-	Kernel         string          // The partial path to the kernel in the boot environment.
-	Initrds        []string        // Partial paths to the initrds that should be loaded for the boot environment.
-	BootParams     string          // A template that will be expanded to create the full list of boot parameters for the environment.
-	RequiredParams []string        // The list of extra required parameters for this bootstate. They should be present as Machine.Params when the bootenv is applied to the machine.
+	Name           string                // The name of the boot environment.
+	Type           string                // The type of boot environment, either "install" (the default) or "local".
+	OS             *OsInfo               // The OS specific information for the boot environment.
+	Templates      []*TemplateInfo       // The templates that should be expanded into files for the bot environment.
+	Kernel         string                // The partial path to the kernel in the boot environment.
+	Initrds        []string              // Partial paths to the initrds that should be loaded for the boot environment.
+	BootParams     string                // A template that will be expanded to create the full list of boot parameters for the environment.
+	RequiredParams []string              // The list of extra required parameters for this bootstate. They should be present as Machine.Params when the bootenv is applied to the machine.
+	NextBootEnv    string                // The boot environment machines should switch to when they finish installing.  Defaults to --default-local-bootenv.
+	ParamInfo      map[string]*ParamInfo // Declared types and defaults for the machine params the boot environment uses.
+	SchemaVersion  int                   // The version of the schema the boot environment was saved with.
+	// How to combine Initrds into a single initrd for bootloaders
+	// that can only load one: "concat", "gzip", or "xz".  Leave empty
+	// to load them separately.
+	CombineInitrds string
+	// The SHA256s of some or all of Initrds, keyed by their entry in
+	// Initrds.  They are checked every time the boot environment is
+	// saved, so an initrd mangled by a bad explode is caught then
+	// rather than when a machine fails to boot.
+	InitrdSha256s map[string]string
+	// What to do when a machine is missing some of RequiredParams:
+	// "error" fails the render, "skip" renders everything except the
+	// templates that refer to the missing params, and "fallback"
+	// renders FallbackBootEnv for the machine instead.  Defaults to
+	// "error".
+	OnMissingParams string
+	// The boot environment to render for machines missing params when
+	// OnMissingParams is "fallback", and for machines that fail to
+	// render when OnRenderFailure is "fallback".  Defaults to
+	// --discovery-bootenv.
+	FallbackBootEnv string
+	// What to do when machines fail to render when the boot
+	// environment is saved: "error" fails the save, "record" records
+	// the failures and saves it anyway, and "fallback" also renders
+	// FallbackBootEnv for the machines that failed.  Defaults to
+	// "error".
+	OnRenderFailure string `json:",omitempty"`
+	// The name of the template holding the iPXE script that machines
+	// chain to when the boot environment has no Kernel for them to
+	// boot.  Defaults to "ipxe".
+	ChainTemplate  string `json:",omitempty"`
 	bootParamsTmpl *template.Template
+	renderFailures []*RenderFailure // The failures recorded the last time the machines were rendered.
+	templates      []*TemplateInfo // Templates plus the ones inherited from the OS family.
+	family         *OsFamily       // The OS family to inherit from, if already known.
+}
+
+// missingOS is the error returned when something needs the OS of a
+// boot environment that does not have one.
+func (b *BootEnv) missingOS() error {
+	return &ValidationError{Kind: "bootenv", Name: b.Name, Field: "OS", Message: "OS is required"}
+}
+
+// BootEnvURLs are the URLs that machines booting into a boot
+// environment will fetch their install media from.
+type BootEnvURLs struct {
+	InstallUrl string   // The URL of the install tree.
+	Kernel     string   // The URL of the kernel, if any.
+	Initrds    []string // The URLs of the initrds, if any.
+}
+
+// URLs computes the URLs that machines will fetch the install media
+// for the boot environment from.
+func (b *BootEnv) URLs() (*BootEnvURLs, error) {
+	if b.OS == nil {
+		return nil, b.missingOS()
+	}
+	res := &BootEnvURLs{InstallUrl: b.OS.InstallUrl()}
+	if b.Kernel != "" {
+		kernel, err := b.PathFor("http", b.Kernel)
+		if err != nil {
+			return nil, err
+		}
+		res.Kernel = kernel
+	}
+	initrds, err := b.InitrdPaths("http")
+	if err != nil {
+		return nil, err
+	}
+	res.Initrds = initrds
+	return res, nil
+}
+
+func bootEnvURLs(c *gin.Context) {
+	bootEnv := &BootEnv{Name: c.Param(`name`)}
+	if err := backend.load(bootEnv); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	urls, err := bootEnv.URLs()
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, urls)
 }
 
 // PathFor expands the partial paths for kernels and initrds into full
@@ -124,71 +605,256 @@ type BootEnv struct {
 //    http: Will expand to the URL the file can be accessed over.
 //    tftp: Will expand to the path the file can be accessed at via TFTP.
 //    disk: Will expand to the path of the file inside the provisioner container.
-func (b *BootEnv) PathFor(proto, f string) string {
-	res := b.OS.Name
-	if res != "discovery" {
+func (b *BootEnv) PathFor(proto, f string) (string, error) {
+	if b.OS == nil {
+		return "", b.missingOS()
+	}
+	res := b.OS.treeName()
+	if b.OS.Name != "discovery" {
 		res = path.Join(res, "install")
 	}
 	switch proto {
 	case "disk":
-		return path.Join(fileRoot, res, f)
+		return path.Join(fileRoot, res, f), nil
 	case "tftp":
-		return path.Join(res, f)
+		return path.Join(res, f), nil
 	case "http":
-		return provisionerURL + "/" + path.Join(res, f)
-	default:
-		logger.Fatalf("Unknown protocol %v", proto)
+		return fileServerURL() + "/" + path.Join(res, f), nil
 	}
-	return ""
+	return "", fmt.Errorf("bootenv: Unknown protocol %v", proto)
+}
+
+// pathUnder checks to see if target is root or is somewhere inside
+// of root.
+func pathUnder(root, target string) bool {
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// renderedPath turns the expanded Path of a template into where the
+// rendered file is written.  Paths are relative to the file root, and
+// must stay inside of it.  Absolute paths are only allowed, and used
+// as they are, if --allow-absolute-render-paths is set.
+func renderedPath(expanded string) (string, error) {
+	if filepath.IsAbs(expanded) {
+		if !allowAbsoluteRenderPaths {
+			return "", fmt.Errorf("%s is absolute, paths must be relative to %s", expanded, fileRoot)
+		}
+		return filepath.Clean(expanded), nil
+	}
+	res := filepath.Join(fileRoot, expanded)
+	if !pathUnder(fileRoot, res) || res == filepath.Clean(fileRoot) {
+		return "", fmt.Errorf("%q is not a file inside %s", expanded, fileRoot)
+	}
+	return res, nil
+}
+
+// mergeTemplates works out the full set of templates for the boot
+// environment: its own Templates, plus the templates of its OS family
+// that it does not override by name.
+func (b *BootEnv) mergeTemplates() {
+	b.templates = b.Templates
+	if b.OS == nil || b.OS.Family == "" {
+		return
+	}
+	family := b.family
+	if family == nil {
+		family = &OsFamily{Name: b.OS.Family}
+		if err := backend.load(family); err != nil {
+			// No default templates for this family.
+			return
+		}
+	}
+	overridden := map[string]bool{}
+	for _, tmpl := range b.Templates {
+		overridden[tmpl.Name] = true
+	}
+	merged := make([]*TemplateInfo, 0, len(b.Templates)+len(family.Templates))
+	for _, tmpl := range family.Templates {
+		if overridden[tmpl.Name] {
+			continue
+		}
+		inherited := &TemplateInfo{}
+		*inherited = *tmpl
+		merged = append(merged, inherited)
+	}
+	b.templates = append(merged, b.Templates...)
+}
+
+// fileTemplates returns the templates for the files of the boot
+// environment that are themselves templates.  Their contents come from
+// the downloaded files.
+func (b *BootEnv) fileTemplates() ([]*TemplateInfo, error) {
+	res := []*TemplateInfo{}
+	if b.OS == nil {
+		return res, nil
+	}
+	for _, f := range b.OS.Files {
+		if !f.Template {
+			continue
+		}
+		filePath, err := b.PathFor("disk", f.diskName())
+		if err != nil {
+			return nil, err
+		}
+		buf, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("bootenv: Cannot read templated file %s: %v", f.Name, err)
+		}
+		renderPath := f.RenderPath
+		if renderPath == "" {
+			if renderPath, err = b.PathFor("tftp", f.Name); err != nil {
+				return nil, err
+			}
+		}
+		res = append(res, &TemplateInfo{
+			Name:     f.Name,
+			Path:     renderPath,
+			DirMode:  f.DirMode,
+			contents: &Template{UUID: f.Name, Contents: string(buf)},
+		})
+	}
+	return res, nil
 }
 
 func (b *BootEnv) parseTemplates() error {
-	for _, templateParams := range b.Templates {
-		pathTmpl, err := template.New(templateParams.Name).Parse(templateParams.Path)
+	b.mergeTemplates()
+	fileTmpls, err := b.fileTemplates()
+	if err != nil {
+		return err
+	}
+	if len(fileTmpls) > 0 {
+		b.templates = append(append([]*TemplateInfo{}, b.templates...), fileTmpls...)
+	}
+	for _, templateParams := range b.templates {
+		pathTmpl, err := newTemplate(templateParams.Name, templateParams.Path)
 		if err != nil {
-			return fmt.Errorf("bootenv: Error compiling path template %s (%s): %v",
-				templateParams.Name,
-				templateParams.Path,
-				err)
+			return &TemplateParseError{
+				Template: templateParams.Name + " path",
+				Message:  err.Error(),
+				Contents: templateParams.Path,
+			}
 		}
-		templateParams.pathTmpl = pathTmpl.Option("missingkey=error")
+		templateParams.pathTmpl = pathTmpl
 		if templateParams.contents == nil {
-			tmpl := &Template{UUID: templateParams.UUID}
-			if err := backend.load(tmpl); err != nil {
+			tmpl, err := loadTemplate(templateParams.UUID)
+			if err != nil {
 				return fmt.Errorf("bootenv: Error loading template %s for %s: %v",
 					templateParams.UUID,
 					templateParams.Name,
 					err)
 			}
 			if err := tmpl.Parse(); err != nil {
-				return fmt.Errorf("bootenv: Error compiling template %s: %v\n---template---\n %s",
-					templateParams.Name,
-					err,
-					tmpl.Contents)
+				return &TemplateParseError{
+					Template: templateParams.Name,
+					Message:  err.Error(),
+					Contents: tmpl.Contents,
+				}
 			}
 			templateParams.contents = tmpl
+		} else if templateParams.contents.parsedTmpl == nil {
+			if err := templateParams.contents.Parse(); err != nil {
+				return &TemplateParseError{
+					Template: templateParams.Name,
+					Message:  err.Error(),
+				}
+			}
+		}
+		if templateParams.SchemaUUID != "" && templateParams.schema == nil {
+			tmpl, err := loadTemplate(templateParams.SchemaUUID)
+			if err != nil {
+				return fmt.Errorf("bootenv: Error loading schema %s for %s: %v",
+					templateParams.SchemaUUID,
+					templateParams.Name,
+					err)
+			}
+			schema, err := parseJSONSchema([]byte(tmpl.Contents))
+			if err != nil {
+				return &TemplateParseError{
+					Template: templateParams.Name + " schema",
+					Message:  err.Error(),
+					Contents: tmpl.Contents,
+				}
+			}
+			templateParams.schema = schema
 		}
 
 	}
 	if b.BootParams != "" {
-		tmpl, err := template.New("machine").Parse(b.BootParams)
+		tmpl, err := newTemplate("machine", b.BootParams)
 		if err != nil {
-			return fmt.Errorf("bootenv: Error compiling boot parameter template: %v\n----TEMPLATE---\n%s",
-				err,
-				b.BootParams)
+			return &TemplateParseError{
+				Template: "BootParams",
+				Message:  err.Error(),
+				Contents: b.BootParams,
+			}
 		}
-		b.bootParamsTmpl = tmpl.Option("missingkey=error")
+		b.bootParamsTmpl = tmpl
 	}
 	return nil
 }
 
-// JoinInitrds joins the fully expanded initrd paths into a comma-separated string.
-func (b *BootEnv) JoinInitrds(proto string) string {
+// InitrdPaths expands all of the initrds for the boot environment
+// into full paths appropriate for proto.
+func (b *BootEnv) InitrdPaths(proto string) ([]string, error) {
+	if b.CombineInitrds != "" && len(b.Initrds) > 0 {
+		combined, err := b.PathFor(proto, b.combinedInitrdName())
+		if err != nil {
+			return nil, err
+		}
+		return []string{combined}, nil
+	}
 	fullInitrds := make([]string, len(b.Initrds))
 	for i, initrd := range b.Initrds {
-		fullInitrds[i] = b.PathFor(proto, initrd)
+		fullInitrd, err := b.PathFor(proto, initrd)
+		if err != nil {
+			return nil, err
+		}
+		fullInitrds[i] = fullInitrd
+	}
+	return fullInitrds, nil
+}
+
+// ParamSchema returns a description of the params that machines
+// using this boot environment should have, sorted by name.
+func (b *BootEnv) ParamSchema() []*ParamSchema {
+	params := map[string]*ParamSchema{}
+	for _, name := range b.RequiredParams {
+		params[name] = &ParamSchema{Name: name, Required: true}
+	}
+	for name, info := range b.ParamInfo {
+		param, ok := params[name]
+		if !ok {
+			param = &ParamSchema{Name: name}
+			params[name] = param
+		}
+		param.Type = info.Type
+		param.Default = info.Default
+		param.Description = info.Description
+		param.Example = info.Example
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := make([]*ParamSchema, len(names))
+	for i, name := range names {
+		res[i] = params[name]
 	}
-	return strings.Join(fullInitrds, " ")
+	return res
+}
+
+// JoinInitrds joins the fully expanded initrd paths into a comma-separated string.
+func (b *BootEnv) JoinInitrds(proto string) (string, error) {
+	fullInitrds, err := b.InitrdPaths(proto)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(fullInitrds, " "), nil
 }
 
 func (b *BootEnv) prefix() string {
@@ -199,182 +865,1185 @@ func (b *BootEnv) key() string {
 	return path.Join(b.prefix(), b.Name)
 }
 
+func (b *BootEnv) schemaVersion() int {
+	return b.SchemaVersion
+}
+
+func (b *BootEnv) setSchemaVersion(version int) {
+	b.SchemaVersion = version
+}
+
 func (b *BootEnv) newIsh() keySaver {
 	res := &BootEnv{Name: b.Name}
 	return keySaver(res)
 }
 
-// RenderPaths renders the paths of the templates for this machine.
-func (b *BootEnv) RenderPaths(machine *Machine) error {
-	vars := &RenderData{
-		Machine:        machine,
-		Env:            b,
-		ProvisionerURL: provisionerURL,
-		CommandURL:     commandURL,
+// RenderPaths renders the paths of the templates for this machine.
+func (b *BootEnv) RenderPaths(machine *Machine) error {
+	vars := newRenderData(machine, b)
+	seenPaths := map[string]string{}
+	for _, templateParams := range b.templates {
+		if !templateParams.appliesTo(machine) || templateParams.pathTmpl == nil {
+			templateParams.finalPath = ""
+			continue
+		}
+		pathBuf := &bytes.Buffer{}
+		if err := templateParams.pathTmpl.Execute(pathBuf, vars); err != nil {
+			return fmt.Errorf("template: Error rendering path %s (%s): %v",
+				templateParams.Name,
+				templateParams.Path,
+				err)
+		}
+		finalPath, err := renderedPath(pathBuf.String())
+		if err != nil {
+			return fmt.Errorf("template: Bad path for %s (%s): %v",
+				templateParams.Name,
+				templateParams.Path,
+				err)
+		}
+		if other, ok := seenPaths[finalPath]; ok {
+			return fmt.Errorf("template: %s and %s both render to %s for %s",
+				other,
+				templateParams.Name,
+				finalPath,
+				machine.Name)
+		}
+		seenPaths[finalPath] = templateParams.Name
+		templateParams.finalPath = finalPath
+	}
+	return nil
+}
+
+// renderedFile is the rendered output of one template, waiting to be
+// written to its final path.
+type renderedFile struct {
+	name     string
+	path     string
+	dirMode  os.FileMode
+	contents []byte
+	hook     string
+}
+
+// renderFiles renders and validates all of the templates in the
+// bootenv for machine without touching anything on disk.
+func (b *BootEnv) renderFiles(machine *Machine) ([]*renderedFile, error) {
+	vars := newRenderData(machine, b)
+	if err := b.parseTemplates(); err != nil {
+		return nil, err
+	}
+	if err := b.RenderPaths(machine); err != nil {
+		return nil, err
+	}
+	if b.OS != nil && b.OS.Arch != "" && b.OS.Arch != machine.MachineArch() {
+		return nil, fmt.Errorf("bootenv: %s is for %s, but %s is %s",
+			b.Name,
+			b.OS.Arch,
+			machine.Name,
+			machine.MachineArch())
+	}
+	missingParams := b.missingParams(machine)
+	skip := map[string]bool{}
+	if len(missingParams) > 0 {
+		switch b.OnMissingParams {
+		case missingParamsSkip:
+			skip = b.templatesUsing(missingParams)
+			logger.Printf("bootenv: %s is missing params %s for %s, skipping the templates that use them\n",
+				machine.Name,
+				strings.Join(missingParams, ", "),
+				b.Name)
+		case missingParamsFallback:
+			return b.renderFallback(machine, missingParams)
+		default:
+			return nil, b.missingParamsError(machine, missingParams)
+		}
+	}
+	res := make([]*renderedFile, 0, len(b.templates))
+	for _, templateParams := range b.templates {
+		if templateParams.finalPath == "" || skip[templateParams.Name] {
+			continue
+		}
+		rendered := &bytes.Buffer{}
+		if err := templateParams.contents.Render(rendered, vars); err != nil {
+			if _, ok := err.(typedError); ok {
+				return nil, err
+			}
+			return nil, &TemplateRenderError{
+				Template: templateParams.Name,
+				Machine:  machine.Name,
+				Message:  err.Error(),
+			}
+		}
+		if templateParams.Validator != "" {
+			validator, ok := renderValidators[templateParams.Validator]
+			if !ok {
+				return nil, &TemplateRenderError{
+					Template:  templateParams.Name,
+					Machine:   machine.Name,
+					Validator: templateParams.Validator,
+					Message:   "unknown validator",
+				}
+			}
+			if err := validator(rendered.Bytes()); err != nil {
+				return nil, &TemplateRenderError{
+					Template:  templateParams.Name,
+					Machine:   machine.Name,
+					Validator: templateParams.Validator,
+					Message:   err.Error(),
+				}
+			}
+		}
+		if templateParams.schema != nil {
+			if err := templateParams.schema.validate(rendered.Bytes()); err != nil {
+				return nil, &TemplateRenderError{
+					Template:  templateParams.Name,
+					Machine:   machine.Name,
+					Validator: "schema",
+					Message:   err.Error(),
+				}
+			}
+		}
+		mode, err := dirModeFor(templateParams.DirMode)
+		if err != nil {
+			return nil, fmt.Errorf("template: Invalid DirMode for %s: %v", templateParams.Name, err)
+		}
+		res = append(res, &renderedFile{
+			name:     templateParams.Name,
+			path:     templateParams.finalPath,
+			dirMode:  mode,
+			contents: rendered.Bytes(),
+			hook:     templateParams.Hook,
+		})
+	}
+	return res, nil
+}
+
+// RenderTemplate renders the template called name for machine
+// without writing it anywhere, so it can be inspected.  It returns
+// false if the boot environment has no such template that applies to
+// the Arch and Firmware of the machine.
+func (b *BootEnv) RenderTemplate(machine *Machine, name string) ([]byte, bool, error) {
+	if err := b.parseTemplates(); err != nil {
+		return nil, true, err
+	}
+	for _, templateParams := range b.templates {
+		if templateParams.Name != name || !templateParams.appliesTo(machine) {
+			continue
+		}
+		vars := newRenderData(machine, b)
+		rendered := &bytes.Buffer{}
+		if err := templateParams.contents.Render(rendered, vars); err != nil {
+			if _, ok := err.(typedError); ok {
+				return nil, true, err
+			}
+			return nil, true, &TemplateRenderError{
+				Template: templateParams.Name,
+				Machine:  machine.Name,
+				Message:  err.Error(),
+			}
+		}
+		return rendered.Bytes(), true, nil
+	}
+	return nil, false, nil
+}
+
+// templatesUsing returns the names of the parsed templates that refer
+// to any of params, or to anything nested in them.
+func (b *BootEnv) templatesUsing(params []string) map[string]bool {
+	res := map[string]bool{}
+	uses := func(tmpl *template.Template) bool {
+		if tmpl == nil {
+			return false
+		}
+		for _, t := range tmpl.Templates() {
+			if t.Tree == nil {
+				continue
+			}
+			for key := range paramRefs(t.Tree) {
+				for _, param := range params {
+					if key == param || strings.HasPrefix(key, param+".") {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	for _, ti := range b.templates {
+		if uses(ti.pathTmpl) || (ti.contents != nil && uses(ti.contents.parsedTmpl)) {
+			res[ti.Name] = true
+		}
+	}
+	return res
+}
+
+// missingParamsError returns the error for machine missing params,
+// along with the descriptions of them from ParamInfo.
+func (b *BootEnv) missingParamsError(machine *Machine, params []string) *MissingParamsError {
+	res := &MissingParamsError{
+		BootEnv: b.Name,
+		Machine: machine.Name,
+		Params:  params,
+	}
+	for _, param := range params {
+		info, ok := b.ParamInfo[param]
+		if !ok || (info.Description == "" && info.Example == nil) {
+			continue
+		}
+		res.Descriptions = append(res.Descriptions, &MissingParam{
+			Name:        param,
+			Description: info.Description,
+			Example:     info.Example,
+		})
+	}
+	return res
+}
+
+// renderFallback renders the FallbackBootEnv of the boot environment
+// for machine, which is missing params.  The fallback always fails on
+// missing params itself, so fallbacks cannot chain.
+func (b *BootEnv) renderFallback(machine *Machine, missingParams []string) ([]*renderedFile, error) {
+	fallback, err := b.missingParamsFallback(machine, missingParams)
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("bootenv: %s is missing params %s for %s, rendering %s instead\n",
+		machine.Name,
+		strings.Join(missingParams, ", "),
+		b.Name,
+		fallback.Name)
+	return fallback.renderFiles(machine)
+}
+
+// missingParamsFallback loads the boot environment that machines
+// missing params fall back to.  The fallback does not fall back in
+// turn, so that machines missing its params too get an error.
+func (b *BootEnv) missingParamsFallback(machine *Machine, missingParams []string) (*BootEnv, error) {
+	name := b.FallbackBootEnv
+	if name == "" {
+		name = discoveryBootEnv
+	}
+	if name == b.Name {
+		return nil, b.missingParamsError(machine, missingParams)
+	}
+	fallback := &BootEnv{Name: name}
+	if err := backend.load(fallback); err != nil {
+		return nil, fmt.Errorf("bootenv: %s falls back to missing bootenv %s", b.Name, name)
+	}
+	fallback.OnMissingParams = missingParamsError
+	return fallback, nil
+}
+
+// missingParams returns the RequiredParams of the boot environment
+// that machine does not have.
+func (b *BootEnv) missingParams(machine *Machine) []string {
+	var res []string
+	for _, param := range b.RequiredParams {
+		if _, ok := machine.Params[param]; !ok {
+			res = append(res, param)
+		}
+	}
+	return res
+}
+
+// writeFile writes contents to filePath, creating any missing
+// directories along the way with dirMode.
+func writeFile(filePath string, contents []byte, dirMode os.FileMode) error {
+	if err := makeDirs(path.Dir(filePath), dirMode); err != nil {
+		return fmt.Errorf("template: Unable to create dir for %s: %v", filePath, err)
+	}
+	dest, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("template: Unable to create file %s: %v", filePath, err)
+	}
+	if _, err := dest.Write(contents); err != nil {
+		dest.Close()
+		os.Remove(filePath)
+		return fmt.Errorf("template: Unable to write file %s: %v", filePath, err)
+	}
+	dest.Sync()
+	return dest.Close()
+}
+
+// stagingDir returns the directory under --file-root that holds the
+// staged sets of rendered files for machine.
+func stagingDir(machine *Machine) (string, error) {
+	return filepath.Abs(filepath.Join(fileRoot, ".staging", machine.UUID()))
+}
+
+// stageFiles writes all of the rendered files for machine into a new
+// set in its staging directory, and then swaps the whole set in with a
+// single rename of the machine's "current" link.  The live files are
+// links through "current" into the set, so every one of them changes
+// at once.  Live files that are not such links yet, like ones written
+// before --render-staging was turned on, are replaced with them once
+// the new set is in place.  Renders of a machine are serialized, so
+// nothing else is swapping its set meanwhile.
+func stageFiles(machine *Machine, files []*renderedFile) error {
+	machineDir, err := stagingDir(machine)
+	if err != nil {
+		return err
+	}
+	if err := makeDirs(machineDir, os.FileMode(dirMode)); err != nil {
+		return fmt.Errorf("template: Unable to create staging dir %s: %v", machineDir, err)
+	}
+	setDir, err := ioutil.TempDir(machineDir, "set-")
+	if err != nil {
+		return fmt.Errorf("template: Unable to create staging dir for %s: %v", machine.Name, err)
+	}
+	for _, f := range files {
+		if err := writeFile(filepath.Join(setDir, f.path), f.contents, f.dirMode); err != nil {
+			os.RemoveAll(setDir)
+			return err
+		}
+	}
+	current := filepath.Join(machineDir, "current")
+	oldSet, _ := os.Readlink(current)
+	next := current + ".next"
+	os.Remove(next)
+	if err := os.Symlink(filepath.Base(setDir), next); err != nil {
+		os.RemoveAll(setDir)
+		return fmt.Errorf("template: Unable to stage files for %s: %v", machine.Name, err)
+	}
+	if err := os.Rename(next, current); err != nil {
+		os.Remove(next)
+		os.RemoveAll(setDir)
+		return fmt.Errorf("template: Unable to move files for %s into place: %v", machine.Name, err)
+	}
+	if oldSet != "" {
+		os.RemoveAll(filepath.Join(machineDir, oldSet))
+	}
+	for _, f := range files {
+		target := filepath.Join(current, f.path)
+		if link, err := os.Readlink(f.path); err == nil && link == target {
+			continue
+		}
+		if err := makeDirs(path.Dir(f.path), f.dirMode); err != nil {
+			return fmt.Errorf("template: Unable to create dir for %s: %v", f.path, err)
+		}
+		tmpLink := filepath.Join(filepath.Dir(f.path), "."+filepath.Base(f.path)+".staging")
+		os.Remove(tmpLink)
+		if err := os.Symlink(target, tmpLink); err != nil {
+			return fmt.Errorf("template: Unable to link %s into place: %v", f.path, err)
+		}
+		if err := os.Rename(tmpLink, f.path); err != nil {
+			os.Remove(tmpLink)
+			return fmt.Errorf("template: Unable to link %s into place: %v", f.path, err)
+		}
+	}
+	return nil
+}
+
+// RenderTemplates renders the templates in the bootenv with the data
+// from the machine.  Nothing is written unless every template renders
+// and validates.  With --render-staging, the rendered files are
+// written to a staging directory first, so that a failure partway
+// through writing them also leaves the live files untouched.
+func (b *BootEnv) RenderTemplates(machine *Machine) error {
+	files, err := b.renderFiles(machine)
+	if err != nil {
+		return err
+	}
+	if renderStaging {
+		if err := stageFiles(machine, files); err != nil {
+			return err
+		}
+	} else {
+		for _, f := range files {
+			if err := writeFile(f.path, f.contents, f.dirMode); err != nil {
+				return err
+			}
+		}
+	}
+	for _, f := range files {
+		if f.hook == "" {
+			continue
+		}
+		if err := runRenderHook(b, machine, f); err != nil {
+			return &TemplateRenderError{
+				Template: f.name,
+				Machine:  machine.Name,
+				Message:  err.Error(),
+			}
+		}
+	}
+	return nil
+}
+
+// clone returns a copy of the boot environment that can be rendered
+// independently of the original.
+func (b *BootEnv) clone() *BootEnv {
+	res := &BootEnv{}
+	*res = *b
+	res.Templates = make([]*TemplateInfo, len(b.Templates))
+	for i, tmpl := range b.Templates {
+		res.Templates[i] = &TemplateInfo{}
+		*res.Templates[i] = *tmpl
+	}
+	res.templates = nil
+	return res
+}
+
+// eachMachine calls fn for machines in parallel, and returns the
+// failures sorted by machine name.  At most --render-concurrency
+// machines are worked on at a time for the boot environment named
+// bootEnv, across every caller.  Machines that have not started by the
+// time ctx runs out are reported as failures.
+func eachMachine(ctx context.Context, bootEnv string, machines []*Machine, fn func(*Machine) error) []*MachineFailure {
+	sem, release := renderSlots.hold(bootEnv)
+	defer release()
+	wg := &sync.WaitGroup{}
+	mux := &sync.Mutex{}
+	failures := []*MachineFailure{}
+	for _, machine := range machines {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			mux.Lock()
+			failures = append(failures, newMachineFailure(machine.Name, fmt.Errorf("Timed out before rendering: %v", ctx.Err())))
+			mux.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func(machine *Machine) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := fn(machine); err != nil {
+				mux.Lock()
+				failures = append(failures, newMachineFailure(machine.Name, err))
+				mux.Unlock()
+			}
+		}(machine)
+	}
+	wg.Wait()
+	sort.Sort(machineFailuresByName(failures))
+	return failures
+}
+
+// activeMachines returns the machines that are not in maintenance.
+func (b *BootEnv) activeMachines(allMachines []*Machine) []*Machine {
+	machines := make([]*Machine, 0, len(allMachines))
+	for _, machine := range allMachines {
+		if machine.Maintenance {
+			logger.Printf("bootenv: Not rendering %s for %s, it is in maintenance\n", machine.Name, b.Name)
+			continue
+		}
+		machines = append(machines, machine)
+	}
+	return machines
+}
+
+// checkRenders renders the templates for machines in memory without
+// writing anything, and fails if any of them fail to render.
+func (b *BootEnv) checkRenders(ctx context.Context, machines []*Machine) error {
+	ctx, cancel := context.WithTimeout(ctx, renderTimeout)
+	defer cancel()
+	failures := eachMachine(ctx, b.Name, machines, func(machine *Machine) error {
+		_, err := b.clone().renderFiles(machine)
+		return err
+	})
+	if len(failures) > 0 {
+		return &RendersError{
+			BootEnv:  b.Name,
+			Machines: len(machines),
+			Rendered: len(machines) - len(failures),
+			Aborted:  true,
+			Failures: failures,
+		}
+	}
+	return nil
+}
+
+// writeRenders renders the templates for machines and writes them
+// out.  Every machine is rendered even if some of them fail, and the
+// failures are reported together.  Failures that OnRenderFailure
+// tolerates are recorded on the machines instead, and kept so that
+// saving the boot environment can report them.  Machines that render
+// have their recorded failures cleared.
+func (b *BootEnv) writeRenders(ctx context.Context, machines []*Machine) error {
+	ctx, cancel := context.WithTimeout(ctx, renderTimeout)
+	defer cancel()
+	mux := &sync.Mutex{}
+	b.renderFailures = nil
+	failures := eachMachine(ctx, b.Name, machines, func(machine *Machine) error {
+		unlock := machineRenderLocks.lock(machine.key())
+		defer unlock()
+		if err := b.clone().RenderTemplates(machine); err != nil {
+			failure, err := b.tolerateRenderFailure(machine, err)
+			if err != nil {
+				return err
+			}
+			mux.Lock()
+			b.renderFailures = append(b.renderFailures, failure)
+			mux.Unlock()
+			return nil
+		}
+		if machine.RenderFailure == nil {
+			return nil
+		}
+		return setRenderFailure(machine, nil)
+	})
+	sort.Sort(renderFailuresByMachine(b.renderFailures))
+	rendered := len(machines) - len(failures)
+	logger.Printf("bootenv: Rendered %d of %d machines for %s\n", rendered, len(machines), b.Name)
+	if len(failures) > 0 {
+		return &RendersError{
+			BootEnv:  b.Name,
+			Machines: len(machines),
+			Rendered: rendered,
+			Failures: failures,
+		}
+	}
+	return nil
+}
+
+// renderMachines renders the templates for machines in parallel, at
+// most --render-concurrency at a time for the boot environment.  Every machine is rendered even
+// if some of them fail, and the failures are reported together.
+// Machines that have not started rendering by the time ctx or
+// --render-timeout runs out are reported as failures.  Machines in
+// maintenance are skipped.
+//
+// With --render-validate-first, every machine is rendered in memory
+// first, and nothing is written unless all of them succeed.  Boot
+// environments that record render failures instead of failing skip
+// that, since they expect some machines to fail.
+func (b *BootEnv) renderMachines(ctx context.Context, allMachines []*Machine) error {
+	machines := b.activeMachines(allMachines)
+	tolerant := b.OnRenderFailure == renderFailureRecord || b.OnRenderFailure == renderFailureFallback
+	if renderValidateFirst && !tolerant {
+		if err := b.checkRenders(ctx, machines); err != nil {
+			return err
+		}
+	}
+	return b.writeRenders(ctx, machines)
+}
+
+// RenderedTemplateFile is a file rendered for a machine from one of
+// the templates of its boot environment.
+type RenderedTemplateFile struct {
+	Template string // The Name of the template.
+	Path     string // Where the file is on disk.
+}
+
+// DeleteRenderedTemplates deletes the templates that were rendered
+// for this bootenv/machine combination, and returns the files it
+// deleted.  The paths are worked out again from the templates as they
+// are now.  If dryRun is set, nothing is deleted, and the files that
+// would be deleted are returned instead.
+func (b *BootEnv) DeleteRenderedTemplates(machine *Machine, dryRun bool) ([]*RenderedTemplateFile, error) {
+	b.parseTemplates()
+	err := b.RenderPaths(machine)
+	res := []*RenderedTemplateFile{}
+	for _, tmpl := range b.templates {
+		if tmpl.finalPath == "" {
+			continue
+		}
+		if _, statErr := os.Stat(tmpl.finalPath); statErr != nil {
+			continue
+		}
+		if !dryRun {
+			if os.Remove(tmpl.finalPath) != nil {
+				continue
+			}
+		}
+		res = append(res, &RenderedTemplateFile{Template: tmpl.Name, Path: tmpl.finalPath})
+	}
+	return res, err
+}
+
+// defaultCanaryName is the name explode_iso.sh gives its canary.
+const defaultCanaryName = ".{{.Name}}.rebar_canary"
+
+// legacyCanaryPath returns where explode_iso.sh leaves its canary: in
+// the install tree itself.
+func (b *BootEnv) legacyCanaryPath() (string, error) {
+	if b.OS == nil {
+		return "", b.missingOS()
+	}
+	return b.PathFor("disk", "."+b.OS.Name+".rebar_canary")
+}
+
+// canaryPath returns the path of the file that marks the ISO for the
+// boot environment as having been exploded.  It lives in --canary-dir
+// if that is set, and is named by rendering --canary-name against the
+// OsInfo, so that it can include the IsoSha256 the tree was exploded
+// from.  Everything that cares about the canary should go through
+// here or findCanary.
+func (b *BootEnv) canaryPath() (string, error) {
+	if b.OS == nil {
+		return "", b.missingOS()
+	}
+	if canaryDir == "" && canaryName == defaultCanaryName {
+		return b.legacyCanaryPath()
+	}
+	nameTmpl, err := newTemplate("canary-name", canaryName)
+	if err != nil {
+		return "", fmt.Errorf("iso: Bad --canary-name %q: %v", canaryName, err)
+	}
+	buf := &bytes.Buffer{}
+	if err := nameTmpl.Execute(buf, b.OS); err != nil {
+		return "", fmt.Errorf("iso: Error rendering --canary-name for %s: %v", b.Name, err)
+	}
+	name := buf.String()
+	if name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("iso: --canary-name rendered to %q for %s, which is not a file name", name, b.Name)
+	}
+	if canaryDir == "" {
+		return b.PathFor("disk", name)
+	}
+	dir := canaryDir
+	if !path.IsAbs(dir) {
+		dir = path.Join(fileRoot, dir)
+	}
+	return path.Join(dir, b.OS.treeName(), name), nil
+}
+
+// findCanary returns the path of the canary for the boot environment
+// if there is one, or "" if its ISO has not been exploded.  Canaries
+// left in the install tree before --canary-dir or --canary-name were
+// changed are still recognized, but only if they record the IsoSha256
+// we want now, since --canary-name may have been changed to tell the
+// trees of different ISOs apart.
+func (b *BootEnv) findCanary() (string, error) {
+	canaryPath, err := b.canaryPath()
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(canaryPath); err == nil {
+		return canaryPath, nil
+	}
+	legacyPath, err := b.legacyCanaryPath()
+	if err != nil || legacyPath == canaryPath {
+		return "", err
+	}
+	if _, err := os.Stat(legacyPath); err != nil {
+		return "", nil
+	}
+	recorded := recordedIsoSha256(legacyPath)
+	if recorded == "" || !strings.EqualFold(recorded, b.OS.IsoSha256) {
+		logger.Printf("Explode ISO: Ignoring the canary %s for %s, it does not record the ISO we want\n", legacyPath, b.Name)
+		return "", nil
+	}
+	return legacyPath, nil
+}
+
+// recordedIsoSha256 returns the IsoSha256 of the ISO that the canary at
+// canaryPath says its tree was exploded from, or "" if it does not say.
+// It is kept in the canary itself, or next to it in trees exploded
+// before the canary recorded it.
+func recordedIsoSha256(canaryPath string) string {
+	for _, p := range []string{canaryPath, canaryPath + ".sha256"} {
+		if buf, err := ioutil.ReadFile(p); err == nil && len(bytes.TrimSpace(buf)) > 0 {
+			return string(bytes.TrimSpace(buf))
+		}
+	}
+	return ""
+}
+
+// removeCanaries removes the canary for the boot environment, along
+// with the one in the install tree if it is somewhere else.
+func (b *BootEnv) removeCanaries() error {
+	canaryPath, err := b.canaryPath()
+	if err != nil {
+		return err
+	}
+	legacyPath, err := b.legacyCanaryPath()
+	if err != nil {
+		return err
+	}
+	for _, p := range []string{canaryPath, legacyPath, canaryPath + ".sha256", legacyPath + ".sha256"} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepIso returns whether the ISO should be kept after it has been
+// exploded.
+func (o *OsInfo) keepIso() bool {
+	if o == nil || o.KeepIso == nil {
+		return keepIsos
+	}
+	return *o.KeepIso
+}
+
+// explodedIsoSha256 returns the IsoSha256 of the ISO the install tree
+// was exploded from, or "" if the tree has not been exploded or did
+// not record it.
+func (b *BootEnv) explodedIsoSha256() (string, error) {
+	canaryPath, err := b.findCanary()
+	if err != nil || canaryPath == "" {
+		return "", err
+	}
+	return recordedIsoSha256(canaryPath), nil
+}
+
+// currentCanary returns the canary of the install tree if the tree was
+// exploded from the ISO with the IsoSha256 we want now, or from an ISO
+// that was not recorded, and "" if the ISO has to be exploded (again).
+func (b *BootEnv) currentCanary() (string, error) {
+	canaryPath, err := b.findCanary()
+	if err != nil || canaryPath == "" || b.OS.IsoSha256 == "" {
+		return canaryPath, err
+	}
+	recorded := recordedIsoSha256(canaryPath)
+	if recorded != "" && !strings.EqualFold(recorded, b.OS.IsoSha256) {
+		return "", nil
+	}
+	return canaryPath, nil
+}
+
+// checkIsoStamp checks whether the install tree was exploded from an
+// ISO with a different IsoSha256 than the one we want now, in which
+// case the new ISO is downloaded if it is not around and exploded into
+// a new tree, which replaces the old one once it is ready.  If another
+// boot environment shares the tree and still wants the old ISO, either
+// as its IsoSha256 or the one it is pinned to, replacing the tree
+// would pull it out from under it, so the old tree is kept as if this
+// boot environment were pinned to it, and true is returned.  The tree
+// is exploded again once the last of them moves to the new ISO.
+func (b *BootEnv) checkIsoStamp() (bool, error) {
+	if b.OS == nil || b.OS.IsoSha256 == "" {
+		return false, nil
+	}
+	exploded, err := b.explodedIsoSha256()
+	if err != nil || exploded == "" || strings.EqualFold(exploded, b.OS.IsoSha256) {
+		return false, err
+	}
+	user, err := b.sharedTreeUser(exploded)
+	if err != nil {
+		return false, err
+	}
+	if user != "" {
+		logger.Printf("Explode ISO: Not exploding %s for %s yet, bootenv %s shares its install tree and still wants the ISO with SHA256 %s\n",
+			b.OS.IsoFile,
+			b.Name,
+			user,
+			exploded)
+		return true, nil
+	}
+	logger.Printf("Explode ISO: %s was exploded from an ISO with a different checksum, exploding it again\n", b.Name)
+	return false, nil
+}
+
+// keepPinnedTree checks whether the install tree is pinned to an ISO
+// other than IsoSha256, in which case it is left alone.  The new ISO
+// is still downloaded, so that promoting it only has to explode it.
+func (b *BootEnv) keepPinnedTree(ctx context.Context) (bool, error) {
+	pin := b.OS.PinnedIsoSha256
+	if pin == "" {
+		return false, nil
+	}
+	if strings.EqualFold(pin, b.OS.IsoSha256) {
+		return false, nil
+	}
+	exploded, err := b.explodedIsoSha256()
+	if err != nil {
+		return false, err
+	}
+	if !strings.EqualFold(exploded, pin) {
+		return false, fmt.Errorf("bootenv: %s is pinned to the ISO with SHA256 %s, but its install tree was not exploded from it",
+			b.Name,
+			pin)
+	}
+	if b.OS.IsoUrl != "" {
+		_, err := retryDownload(ctx, b.OS.IsoUrl, isoDownloadAttempts, isoRetryDelay, func() error {
+			return b.fetchIso(ctx)
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+	logger.Printf("Explode ISO: %s is pinned to %s, not exploding %s until it is promoted\n",
+		b.Name,
+		pin,
+		b.OS.IsoSha256)
+	return true, nil
+}
+
+// PromoteIso pins the boot environment to its IsoSha256, which
+// explodes the new ISO into its install tree if it was pinned to
+// another one.  It returns whether anything changed.
+func (b *BootEnv) PromoteIso() (bool, error) {
+	if b.OS == nil {
+		return false, b.missingOS()
 	}
-	for _, templateParams := range b.Templates {
-		pathBuf := &bytes.Buffer{}
-		if err := templateParams.pathTmpl.Execute(pathBuf, vars); err != nil {
-			return fmt.Errorf("template: Error rendering path %s (%s): %v",
-				templateParams.Name,
-				templateParams.Path,
-				err)
-		}
-		templateParams.finalPath = filepath.Join(fileRoot, pathBuf.String())
+	if b.OS.PinnedIsoSha256 == "" || strings.EqualFold(b.OS.PinnedIsoSha256, b.OS.IsoSha256) {
+		return false, nil
 	}
-	return nil
+	if b.OS.IsoSha256 == "" {
+		return false, &ValidationError{Kind: "bootenv", Name: b.Name, Field: "OS.IsoSha256", Message: "OS.IsoSha256 is required to promote an ISO"}
+	}
+	newEnv := b.clone()
+	newOS := *b.OS
+	newOS.PinnedIsoSha256 = b.OS.IsoSha256
+	newEnv.OS = &newOS
+	if err := backend.save(newEnv, b); err != nil {
+		return false, err
+	}
+	*b = *newEnv
+	return true, nil
 }
 
-// RenderTemplates renders the templates in the bootenv with the data from the machine.
-func (b *BootEnv) RenderTemplates(machine *Machine) error {
-	vars := &RenderData{
-		Machine:        machine,
-		Env:            b,
-		ProvisionerURL: provisionerURL,
-		CommandURL:     commandURL,
+// installIso makes sure that the ISO for the boot environment has
+// been downloaded, matches IsoSha256, and has been exploded.  Steps
+// that have already been done are skipped, so it is safe to run again
+// after a partial failure.  Failed downloads are retried with
+// exponential backoff.  IsoSha256 is resolved from IsoChecksumsUrl
+// first, so that the install tree, the ISO, and the explode are all
+// checked against the published checksum.
+func (b *BootEnv) installIso(ctx context.Context) error {
+	if b.OS == nil {
+		return b.missingOS()
 	}
-	if err := b.parseTemplates(); err != nil {
-		return err
+	if strings.HasSuffix(b.Name, "-install") && b.OS.IsoFile != "" {
+		if err := b.OS.resolveIsoSha256(ctx); err != nil {
+			return err
+		}
+		pinned, err := b.keepPinnedTree(ctx)
+		if err != nil || pinned {
+			return err
+		}
+		shared, err := b.checkIsoStamp()
+		if err != nil || shared {
+			return err
+		}
 	}
-	if err := b.RenderPaths(machine); err != nil {
+	if !strings.HasSuffix(b.Name, "-install") || b.OS.IsoFile == "" || b.OS.IsoUrl == "" {
+		return b.explode_iso(ctx)
+	}
+	canaryPath, err := b.currentCanary()
+	if err != nil {
 		return err
 	}
-	var missingParams []string
-	for _, param := range b.RequiredParams {
-		if _, ok := machine.Params[param]; !ok {
-			missingParams = append(missingParams, param)
-		}
+	if canaryPath != "" {
+		return b.explode_iso(ctx)
 	}
-	if len(missingParams) > 0 {
-		return fmt.Errorf("bootenv: %s missing required machine params for $s:\n %v", b.Name, machine.Name, missingParams)
+	_, err = retryDownload(ctx, b.OS.IsoUrl, isoDownloadAttempts, isoRetryDelay, func() error {
+		return b.fetchIso(ctx)
+	})
+	if err != nil {
+		return err
 	}
-	for _, templateParams := range b.Templates {
-		tmplPath := templateParams.finalPath
-		if err := os.MkdirAll(path.Dir(tmplPath), 0755); err != nil {
-			return fmt.Errorf("template: Unable to create dir for %s: %v", tmplPath, err)
-		}
+	return b.explode_iso(ctx)
+}
 
-		tmplDest, err := os.Create(tmplPath)
-		if err != nil {
-			return fmt.Errorf("template: Unable to create file %s: %v", tmplPath, err)
+// fetchIso downloads the ISO for the boot environment from IsoUrl,
+// unless it is already present and matches IsoSha256.  The ISO only
+// appears under isos once all of it has been downloaded and checked.
+func (b *BootEnv) fetchIso(ctx context.Context) error {
+	if b.OS == nil {
+		return b.missingOS()
+	}
+	isoPath := filepath.Join(fileRoot, "isos", b.OS.IsoFile)
+	if _, err := os.Stat(isoPath); err == nil {
+		if b.OS.IsoSha256 == "" {
+			return nil
 		}
-		defer tmplDest.Close()
-		if err := templateParams.contents.Render(tmplDest, vars); err != nil {
-			os.Remove(tmplPath)
-			return fmt.Errorf("template: Error rendering template %s: %v\n---template---\n %s",
-				templateParams.Name,
-				err,
-				templateParams.contents.Contents)
+		if hash, err := sha256File(isoPath); err == nil && hash == b.OS.IsoSha256 {
+			return nil
 		}
-		tmplDest.Sync()
+		logger.Printf("Fetch ISO: %s does not match its checksum, downloading it again\n", isoPath)
 	}
-	return nil
+	if err := makeDirs(path.Dir(isoPath), os.FileMode(dirMode)); err != nil {
+		return fmt.Errorf("iso: Unable to create dir for %s: %v", isoPath, err)
+	}
+	logger.Printf("Fetch ISO: Downloading %s for %s\n", b.OS.IsoUrl, b.Name)
+	return downloadVerified(ctx, b.OS.IsoUrl, isoPath, b.OS.IsoSha256, nil)
 }
 
-// DeleteRenderedTemplates deletes the templates that were rendered
-// for this bootenv/machine combination.
-func (b *BootEnv) DeleteRenderedTemplates(machine *Machine) {
-	b.parseTemplates()
-	b.RenderPaths(machine)
-	for _, tmpl := range b.Templates {
-		if tmpl.finalPath != "" {
-			os.Remove(tmpl.finalPath)
+// checkExplodedTree makes sure the kernel and initrds of the boot
+// environment made it into the tree exploded at treeDir.  Ones that
+// come from its Files instead of the ISO are not checked, since they
+// are downloaded later.
+func (b *BootEnv) checkExplodedTree(treeDir string) error {
+	fromFiles := map[string]bool{}
+	for _, f := range b.OS.Files {
+		fromFiles[f.Name] = true
+	}
+	paths := []string{}
+	if b.Kernel != "" {
+		paths = append(paths, b.Kernel)
+	}
+	paths = append(paths, b.Initrds...)
+	for _, p := range paths {
+		if fromFiles[p] {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(treeDir, p)); err != nil {
+			return fmt.Errorf("iso: %s was exploded for %s, but %s is not in it", b.OS.IsoFile, b.Name, p)
 		}
 	}
+	return nil
 }
 
-func (b *BootEnv) explode_iso() error {
+func (b *BootEnv) explode_iso(ctx context.Context) error {
 	// Only explode install things
 	if !strings.HasSuffix(b.Name, "-install") {
 		logger.Printf("Explode ISO: Skipping %s becausing not -install\n", b.Name)
 		return nil
 	}
 	// Only work on things that are requested.
-	if b.OS.IsoFile == "" {
+	if b.OS == nil || b.OS.IsoFile == "" {
 		logger.Printf("Explode ISO: Skipping %s becausing no iso image specified\n", b.Name)
 		return nil
 	}
-	// Have we already exploded this?  If file exists, then good!
-	canaryPath := b.PathFor("disk", "."+b.OS.Name+".rebar_canary")
-	if _, err := os.Stat(canaryPath); err == nil {
+	// Have we already exploded this?  If file exists and records the
+	// ISO we want, then good!
+	canaryPath, err := b.currentCanary()
+	if err != nil {
+		return err
+	}
+	if canaryPath != "" {
 		logger.Printf("Explode ISO: Skipping %s becausing canary file, %s, in place\n", b.Name, canaryPath)
 		return nil
 	}
+	installDir, err := b.PathFor("disk", "")
+	if err != nil {
+		return err
+	}
+	if canaryPath, err = b.canaryPath(); err != nil {
+		return err
+	}
 
 	isoPath := filepath.Join(fileRoot, "isos", b.OS.IsoFile)
-	if _, err := os.Stat(isoPath); os.IsNotExist(err) {
+	isoInfo, err := os.Stat(isoPath)
+	if os.IsNotExist(err) {
 		logger.Printf("Explode ISO: Skipping %s becausing iso doesn't exist: %s\n", b.Name, isoPath)
 		return nil
 	}
 
 	// Sha256sum iso for correctness
 	if b.OS.IsoSha256 != "" {
-		f, err := os.Open(isoPath)
+		hash, err := sha256File(isoPath)
 		if err != nil {
-			logger.Printf("Explode ISO: For %s, failed to open iso file %s\n", b.Name, isoPath)
-			return err
-		}
-		defer f.Close()
-		hasher := sha256.New()
-		if _, err := io.Copy(hasher, f); err != nil {
 			logger.Printf("Explode ISO: For %s, failed to read iso file %s\n", b.Name, isoPath)
 			return err
 		}
-		hash := hex.EncodeToString(hasher.Sum(nil))
 		if hash != b.OS.IsoSha256 {
-			return fmt.Errorf("iso: Iso checksum bad.  Re-download image: %s: actual: %v expected: %v", isoPath, hash, b.OS.IsoSha256)
+			return &ChecksumMismatchError{Path: isoPath, Expected: b.OS.IsoSha256, Actual: hash}
+		}
+	}
+
+	// Make sure the install tree will fit
+	if isoInfo != nil {
+		size, err := extractedSize(ctx, isoPath, isoInfo.Size())
+		if err != nil {
+			return err
+		}
+		if err := checkFreeSpace(installDir, size); err != nil {
+			return err
 		}
 	}
 
-	// Call extract script
-	// /explode_iso.sh b.OS.Name isoPath path.Dir(canaryPath)
-	cmdName := "/explode_iso.sh"
-	cmdArgs := []string{b.OS.Name, isoPath, path.Dir(canaryPath)}
-	if _, err := exec.Command(cmdName, cmdArgs...).Output(); err != nil {
-		logger.Printf("Explode ISO: Exec command failed for %s: %s\n", b.Name, err)
+	// Extract the ISO into a staging tree next to the install tree,
+	// natively if we can, or with
+	// /explode_iso.sh b.OS.Name isoPath stagingDir
+	// The install tree is only replaced once the new one is complete,
+	// so a failed explode leaves the old tree as it was.
+	stagingDir, err := newStagingTree(installDir)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+	ctx, cancel := context.WithTimeout(ctx, explodeTimeout)
+	defer cancel()
+	if err := b.extractIso(ctx, isoPath, stagingDir); err != nil {
+		logger.Printf("Explode ISO: Extracting failed for %s: %s\n", b.Name, err)
+		if ctx.Err() != nil {
+			return fmt.Errorf("iso: Timed out exploding %s: %v", isoPath, ctx.Err())
+		}
+		return err
+	}
+	if err := b.checkExplodedTree(stagingDir); err != nil {
+		return err
+	}
+	if err := fixTreePerms(stagingDir); err != nil {
+		return fmt.Errorf("iso: Failed to set the owner and modes of %s: %v", stagingDir, err)
+	}
+	// Other boot environments may have downloaded their files or
+	// combined their initrds into the tree, and those are kept.
+	siblingFiles, err := b.sharedTreeFiles()
+	if err != nil {
+		return err
+	}
+	keepTreeFiles(installDir, stagingDir, siblingFiles)
+	if err := swapInstallTree(stagingDir, installDir); err != nil {
+		return err
+	}
+	// The canary is only written once the tree is complete, and
+	// records the ISO it was exploded from.  Whatever explode_iso.sh
+	// left behind is replaced.
+	if err := b.removeCanaries(); err != nil {
+		return err
+	}
+	if err := writeFile(canaryPath, []byte(b.OS.IsoSha256), os.FileMode(dirMode)); err != nil {
 		return err
 	}
+	if !b.OS.keepIso() {
+		logger.Printf("Explode ISO: Removing %s now that it has been exploded\n", isoPath)
+		if err := os.Remove(isoPath); err != nil {
+			logger.Printf("Explode ISO: Failed to remove %s: %v\n", isoPath, err)
+		}
+	}
 
 	return nil
 }
 
-func (b *BootEnv) get_file(f *FileData) error {
+func (b *BootEnv) get_file(ctx context.Context, f *FileData) error {
 	logger.Printf("Downloading file: %s\n", f.Name)
-	filePath := b.PathFor("disk", f.Name)
-	if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
-		return fmt.Errorf("file: Unable to create dir for %s: %v", filePath, err)
+	filePath, err := b.PathFor("disk", f.diskName())
+	if err != nil {
+		return err
 	}
-
-	fileDest, err := os.Create(filePath)
+	mode, err := dirModeFor(f.DirMode)
 	if err != nil {
 		return err
 	}
-	defer fileDest.Close()
-
-	resp, err := http.Get(f.URL)
+	if err := makeDirs(path.Dir(filePath), mode); err != nil {
+		return fmt.Errorf("file: Unable to create dir for %s: %v", filePath, err)
+	}
+	expected, err := f.expectedSha256()
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	failures := []*MirrorFailure{}
+	for _, url := range append([]string{f.URL}, f.Mirrors...) {
+		err := downloadVerified(ctx, url, filePath, expected, func(tmpPath string) error {
+			return f.checkSignature(ctx, tmpPath)
+		})
+		if err == nil {
+			return nil
+		}
+		if len(f.Mirrors) == 0 {
+			return err
+		}
+		logger.Printf("Downloading file: %s failed from %s: %v\n", f.Name, url, err)
+		failures = append(failures, newMirrorFailure(url, err))
+	}
+	return &MirrorsError{File: f.Name, Failures: failures}
+}
 
-	_, err = io.Copy(fileDest, resp.Body)
-	return err
+// eachFile calls fn for each of the files of the boot environment,
+// at most --file-download-concurrency at a time and one file at a
+// time per install tree, and collects what happened to them in the
+// order the files are listed.  fn fills in the Status and Attempts of
+// the result.  Every file is tried even if some of them fail.  If any
+// of them fail, a FilesError reporting what happened to each of the
+// files is returned.
+func (b *BootEnv) eachFile(fn func(f *FileData, res *FileResult) error) ([]*FileResult, error) {
+	if b.OS == nil {
+		return nil, b.missingOS()
+	}
+	limit := fileDownloadConcurrency
+	if limit < 1 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+	wg := &sync.WaitGroup{}
+	results := make([]*FileResult, len(b.OS.Files))
+	for i, f := range b.OS.Files {
+		res := &FileResult{Name: f.Name, URL: f.URL}
+		results[i] = res
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(f *FileData, res *FileResult) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := installTreeFlights.do("file:"+b.OS.treeName()+"/"+f.Name, func() error {
+				return fn(f, res)
+			})
+			switch {
+			case err != nil:
+				res.Status = fileFailed
+				res.Error = err.Error()
+			case res.Status == "":
+				// Someone else fetched the file while we waited for them.
+				res.Status = fileSkipped
+			}
+		}(f, res)
+	}
+	wg.Wait()
+	failed := 0
+	for _, res := range results {
+		if res.Status == fileFailed {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, &FilesError{BootEnv: b.Name, Failed: failed, Files: results}
+	}
+	return results, nil
+}
+
+// fetchFiles makes sure that all of the files of the boot environment
+// have been downloaded and are valid, retrying each according to its
+// own retry policy.
+func (b *BootEnv) fetchFiles(ctx context.Context) ([]*FileResult, error) {
+	return b.eachFile(func(f *FileData, res *FileResult) error {
+		if b.validate_file(ctx, f) == nil {
+			res.Status = fileSkipped
+			return nil
+		}
+		attempts, delay, err := f.retryPolicy()
+		if err != nil {
+			return err
+		}
+		res.Attempts, err = retryDownload(ctx, f.URL, attempts, delay, func() error {
+			return b.get_file(ctx, f)
+		})
+		if err == nil {
+			res.Status = fileDownloaded
+		}
+		return err
+	})
 }
 
-func (b *BootEnv) validate_file(f *FileData) error {
+func (b *BootEnv) validate_file(ctx context.Context, f *FileData) error {
 	logger.Printf("Validating file: %s\n", f.Name)
-	filePath := b.PathFor("disk", f.Name)
+	filePath, err := b.PathFor("disk", f.diskName())
+	if err != nil {
+		return err
+	}
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		return fmt.Errorf("validate: File doesn't exist: %s\n", filePath)
 	}
+	if f.ValidationMethod == "gpg" {
+		return f.checkSignature(ctx, filePath)
+	}
+	expected, err := f.expectedSha256()
+	if err != nil || expected == "" {
+		return err
+	}
+	actual, err := sha256File(filePath)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return &ChecksumMismatchError{Path: filePath, Expected: expected, Actual: actual}
+	}
 	return nil
 }
 
-func (b *BootEnv) onChange(oldThing interface{}) error {
+// Validate checks the boot environment for mistakes that can be found
+// without downloading, exploding, or rendering anything.
+func (b *BootEnv) Validate() error {
+	if b.OS == nil {
+		return b.missingOS()
+	}
+	if b.OS.Name == "" {
+		return &ValidationError{Kind: "bootenv", Name: b.Name, Field: "OS.Name", Message: "OS.Name is required"}
+	}
 	seenPxeLinux := false
 	seenELilo := false
 	seenIPXE := false
-	for _, template := range b.Templates {
+	b.mergeTemplates()
+	for _, template := range b.templates {
 		if template.Name == "pxelinux" {
 			seenPxeLinux = true
 		}
@@ -389,38 +2058,178 @@ func (b *BootEnv) onChange(oldThing interface{}) error {
 			template.UUID == "" {
 			return errors.New(fmt.Sprintf("bootenv: Illegal template: %+v", template))
 		}
+		if err := template.check("bootenv"); err != nil {
+			return err
+		}
+	}
+	for name, info := range b.ParamInfo {
+		if info == nil {
+			return fmt.Errorf("bootenv: Missing ParamInfo for %s", name)
+		}
+		if info.Type == "" {
+			continue
+		}
+		isType, ok := paramTypes[info.Type]
+		if !ok {
+			return fmt.Errorf("bootenv: Unknown type %s for param %s", info.Type, name)
+		}
+		if info.Default != nil && !isType(info.Default) {
+			return fmt.Errorf("bootenv: Default for param %s is not a %s", name, info.Type)
+		}
+	}
+	if b.OS.PinnedIsoSha256 != "" && b.OS.IsoFile == "" {
+		return fmt.Errorf("bootenv: PinnedIsoSha256 for %s needs an IsoFile", b.OS.Name)
+	}
+	if b.OS.IsoSignatureUrl != "" {
+		if b.OS.IsoChecksumsUrl == "" {
+			return fmt.Errorf("bootenv: IsoSignatureUrl for %s needs an IsoChecksumsUrl", b.OS.Name)
+		}
+		if _, err := keyringPath(b.OS.IsoKeyring); err != nil {
+			return fmt.Errorf("bootenv: Invalid IsoKeyring for %s: %v", b.OS.Name, err)
+		}
+	}
+	if b.OS.Arch != "" && b.OS.Arch != archX86_64 && b.OS.Arch != archArm64 {
+		return fmt.Errorf("bootenv: Unknown arch %s for OS %s", b.OS.Arch, b.OS.Name)
+	}
+	switch b.CombineInitrds {
+	case "", initrdConcat, initrdGzip, initrdXz:
+	default:
+		return fmt.Errorf("bootenv: Unknown way to combine initrds %s", b.CombineInitrds)
+	}
+	for initrd, sha := range b.InitrdSha256s {
+		found := false
+		for _, candidate := range b.Initrds {
+			if candidate == initrd {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("bootenv: InitrdSha256s has a checksum for %s, which is not one of Initrds", initrd)
+		}
+		if sha == "" {
+			return fmt.Errorf("bootenv: InitrdSha256s has an empty checksum for %s", initrd)
+		}
+	}
+	switch b.OnMissingParams {
+	case "", missingParamsError, missingParamsSkip, missingParamsFallback:
+	default:
+		return fmt.Errorf("bootenv: Unknown way to handle missing params %s", b.OnMissingParams)
+	}
+	switch b.OnRenderFailure {
+	case "", renderFailureError, renderFailureRecord, renderFailureFallback:
+	default:
+		return fmt.Errorf("bootenv: Unknown way to handle render failures %s", b.OnRenderFailure)
+	}
+	if b.FallbackBootEnv != "" && b.FallbackBootEnv == b.Name {
+		return fmt.Errorf("bootenv: %s cannot fall back to itself", b.Name)
+	}
+	switch b.Type {
+	case "", bootEnvInstall:
+		if !seenIPXE {
+			if !(seenPxeLinux && seenELilo) {
+				return errors.New("bootenv: Missing elilo or pxelinux template")
+			}
+		}
+	case bootEnvLocal:
+	default:
+		return fmt.Errorf("bootenv: Unknown type %s", b.Type)
 	}
-	if !seenIPXE {
-		if !(seenPxeLinux && seenELilo) {
-			return errors.New("bootenv: Missing elilo or pxelinux template")
+	for _, f := range b.OS.Files {
+		if _, err := dirModeFor(f.DirMode); err != nil {
+			return fmt.Errorf("bootenv: Invalid DirMode for file %s: %v", f.Name, err)
+		}
+		if _, _, err := f.retryPolicy(); err != nil {
+			return fmt.Errorf("bootenv: Invalid retry policy for file %s: %v", f.Name, err)
+		}
+		if f.Template && f.RenderPath == "" && !f.nameIsTemplate() {
+			return fmt.Errorf("bootenv: Templated file %s needs a RenderPath", f.Name)
+		}
+		if !f.Template && strings.Contains(f.Name, "{{") {
+			return fmt.Errorf("bootenv: File %s can only have a templated Name if Template is set", f.Name)
+		}
+		for _, mirror := range f.Mirrors {
+			if mirror == "" {
+				return fmt.Errorf("bootenv: File %s has an empty mirror", f.Name)
+			}
+		}
+		switch f.ValidationMethod {
+		case "", "sha256":
+		case "gpg":
+			if f.ValidationURL == "" {
+				return fmt.Errorf("bootenv: File %s needs a ValidationURL to check its signature", f.Name)
+			}
+			if _, err := keyringPath(f.Keyring); err != nil {
+				return fmt.Errorf("bootenv: Invalid Keyring for file %s: %v", f.Name, err)
+			}
+		default:
+			return fmt.Errorf("bootenv: Unknown validation method %s for file %s", f.ValidationMethod, f.Name)
 		}
 	}
+	return nil
+}
+
+// saveRetries makes saving a boot environment be retried, so that
+// failing to store it is retried along with the work done by
+// onChange, and failing to tell Rebar about it is retried on its own.
+func (b *BootEnv) saveRetries() (int, time.Duration) {
+	return bootEnvSaveAttempts, bootEnvSaveRetryDelay
+}
+
+func (b *BootEnv) onChange(oldThing interface{}) error {
+	if err := b.Validate(); err != nil {
+		return err
+	}
+	release := acquireBootEnvSave(b.Name)
+	defer release()
+	return b.applyChange(oldThing)
+}
+
+// applyChange does the work of saving the boot environment: exploding
+// its ISO, downloading its files, and rendering its machines again.
+func (b *BootEnv) applyChange(oldThing interface{}) error {
+	// Bound how long downloading, exploding, and rendering can take,
+	// so that a stuck ISO cannot wedge the bootenv forever.
+	ctx, cancel := context.WithTimeout(context.Background(), bootEnvTimeout)
+	defer cancel()
 
 	// Make sure the ISO is exploded
 	if b.OS.IsoFile != "" {
 		logger.Printf("Exploding ISO for %s\n", b.OS.Name)
-		if err := b.explode_iso(); err != nil {
+		err := installTreeFlights.do("iso:"+b.OS.treeName(), func() error {
+			return b.installIso(ctx)
+		})
+		if err != nil {
 			return err
 		}
 	}
 
 	// Make sure we download extra files
-	for _, f := range b.OS.Files {
-		if b.validate_file(f) != nil {
-			if err := b.get_file(f); err != nil {
-				return err
-			}
-		}
-		if err := b.validate_file(f); err != nil {
+	if len(b.OS.Files) > 0 {
+		results, err := b.fetchFiles(ctx)
+		if err != nil {
 			return err
 		}
+		downloaded := 0
+		for _, res := range results {
+			if res.Status == fileDownloaded {
+				downloaded++
+			}
+		}
+		logger.Printf("bootenv: Files for %s: %d downloaded, %d already valid\n",
+			b.Name,
+			downloaded,
+			len(results)-downloaded)
 	}
 
 	if err := b.parseTemplates(); err != nil {
 		return err
 	}
-	if b.Kernel != "" {
-		kPath := b.PathFor("disk", b.Kernel)
+	if b.Kernel != "" && b.Type != bootEnvLocal {
+		kPath, err := b.PathFor("disk", b.Kernel)
+		if err != nil {
+			return err
+		}
 		kernelStat, err := os.Stat(kPath)
 		if err != nil {
 			return fmt.Errorf("bootenv: %s: missing kernel %s (%s)",
@@ -435,9 +2244,12 @@ func (b *BootEnv) onChange(oldThing interface{}) error {
 				kPath)
 		}
 	}
-	if len(b.Initrds) > 0 {
+	if len(b.Initrds) > 0 && b.Type != bootEnvLocal {
 		for _, initrd := range b.Initrds {
-			iPath := b.PathFor("disk", initrd)
+			iPath, err := b.PathFor("disk", initrd)
+			if err != nil {
+				return err
+			}
 			initrdStat, err := os.Stat(iPath)
 			if err != nil {
 				return fmt.Errorf("bootenv: %s: missing initrd %s (%s)",
@@ -451,6 +2263,25 @@ func (b *BootEnv) onChange(oldThing interface{}) error {
 					initrd,
 					iPath)
 			}
+			if expected, ok := b.InitrdSha256s[initrd]; ok {
+				actual, err := sha256File(iPath)
+				if err != nil {
+					return fmt.Errorf("bootenv: %s: unable to checksum initrd %s (%s): %v",
+						b.Name,
+						initrd,
+						iPath,
+						err)
+				}
+				if !strings.EqualFold(actual, expected) {
+					return &ChecksumMismatchError{Path: iPath, Expected: expected, Actual: actual}
+				}
+			}
+		}
+		err := installTreeFlights.do("initrd:"+b.Name, func() error {
+			return b.combineInitrds(ctx)
+		})
+		if err != nil {
+			return err
 		}
 	}
 
@@ -464,13 +2295,15 @@ func (b *BootEnv) onChange(oldThing interface{}) error {
 			return err
 		}
 
+		toRender := []*Machine{}
 		for _, machine := range machines {
 			if machine.BootEnv != old.Name {
 				continue
 			}
-			if err := b.RenderTemplates(machine); err != nil {
-				return err
-			}
+			toRender = append(toRender, machine)
+		}
+		if err := b.renderMachines(ctx, toRender); err != nil {
+			return err
 		}
 	}
 
@@ -496,7 +2329,7 @@ func (b *BootEnv) List() ([]*BootEnv, error) {
 	res := make([]*BootEnv, len(things))
 	for i, blob := range things {
 		bootenv := &BootEnv{}
-		if err := json.Unmarshal(blob, bootenv); err != nil {
+		if err := decodeThing(blob, bootenv); err != nil {
 			return nil, err
 		}
 		res[i] = bootenv
@@ -504,7 +2337,85 @@ func (b *BootEnv) List() ([]*BootEnv, error) {
 	return res, nil
 }
 
-func (b *BootEnv) RebuildRebarData() error {
+// ListFamily returns all of the boot environments whose OS is in family.
+func (b *BootEnv) ListFamily(family string) ([]*BootEnv, error) {
+	bootEnvs, err := b.List()
+	if err != nil {
+		return nil, err
+	}
+	res := []*BootEnv{}
+	for _, bootEnv := range bootEnvs {
+		if bootEnv.OS != nil && bootEnv.OS.Family == family {
+			res = append(res, bootEnv)
+		}
+	}
+	return res, nil
+}
+
+func listBootEnvs(c *gin.Context) {
+	family := c.Query("family")
+	if family == "" {
+		listThings(c, &BootEnv{})
+		return
+	}
+	bootEnv := &BootEnv{}
+	res, err := bootEnv.ListFamily(family)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+func bootEnvPromoteIso(c *gin.Context) {
+	bootEnv := &BootEnv{Name: c.Param(`name`)}
+	if err := backend.load(bootEnv); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	changed, err := bootEnv.PromoteIso()
+	if err != nil {
+		respondWithError(c, http.StatusConflict, err)
+		return
+	}
+	status := http.StatusOK
+	if changed {
+		status = http.StatusAccepted
+	}
+	c.JSON(status, bootEnv)
+}
+
+// RebarOSData is what the provisioner tells Rebar about the OSes it
+// can install.
+type RebarOSData struct {
+	AvailableOSes map[string]bool     // The OSes of all of the -install boot environments that may be offered.
+	OSArches      map[string][]string // The arches each of the OSes can be installed on.
+	DefaultOS     string              // The OS Rebar should install if nothing says otherwise.
+}
+
+// inOSList returns whether name is in list, which is a comma-separated
+// list of OS names.
+func inOSList(list, name string) bool {
+	for _, entry := range strings.Split(list, ",") {
+		if strings.TrimSpace(entry) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// rebarOSAllowed returns whether the OS called name may be offered to
+// Rebar, according to --rebar-os-allow and --rebar-os-deny.
+func rebarOSAllowed(name string) bool {
+	if strings.TrimSpace(rebarOSAllow) != "" && !inOSList(rebarOSAllow, name) {
+		return false
+	}
+	return !inOSList(rebarOSDeny, name)
+}
+
+// rebarOSData works out what to tell Rebar about the OSes the
+// provisioner can install from the boot environments.
+func (b *BootEnv) rebarOSData() (*RebarOSData, error) {
 	preferred_oses := map[string]int{
 		"centos-7.2.1511": 0,
 		"centos-7.1.1503": 1,
@@ -518,19 +2429,28 @@ func (b *BootEnv) RebuildRebarData() error {
 	}
 
 	attrValOSes := make(map[string]bool)
+	attrValOSArches := make(map[string][]string)
 	attrValOS := "STRING"
 	attrPref := 1000
 
 	bes, err := b.List()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for _, be := range bes {
-		if !strings.HasSuffix(be.Name, "-install") {
+		if !strings.HasSuffix(be.Name, "-install") || be.OS == nil {
+			continue
+		}
+		if !rebarOSAllowed(be.OS.Name) {
 			continue
 		}
 		attrValOSes[be.OS.Name] = true
+		arch := be.OS.Arch
+		if arch == "" {
+			arch = archX86_64
+		}
+		attrValOSArches[be.OS.Name] = append(attrValOSArches[be.OS.Name], arch)
 		numPref, ok := preferred_oses[be.OS.Name]
 		if !ok {
 			numPref = 999
@@ -540,7 +2460,27 @@ func (b *BootEnv) RebuildRebarData() error {
 			attrPref = numPref
 		}
 	}
+	return &RebarOSData{
+		AvailableOSes: attrValOSes,
+		OSArches:      attrValOSArches,
+		DefaultOS:     attrValOS,
+	}, nil
+}
+
+// RebuildRebarData tells Rebar which OSes the boot environments can
+// install, what arches they can be installed on, and which one to
+// install by default.
+func (b *BootEnv) RebuildRebarData() error {
+	data, err := b.rebarOSData()
+	if err != nil {
+		return err
+	}
+	return publishRebarOSData(data)
+}
 
+// publishRebarOSData sets the attribs of the provisioner-service
+// deployment role in Rebar from data.
+func publishRebarOSData(data *RebarOSData) error {
 	deployment := &client.Deployment{}
 	if err := client.Fetch(deployment, "system"); err != nil {
 		return err
@@ -558,28 +2498,44 @@ func (b *BootEnv) RebuildRebarData() error {
 	if err := client.Match("deployment_roles", matcher, &drs); err != nil {
 		return err
 	}
+	if len(drs) == 0 {
+		return fmt.Errorf("bootenv: No provisioner-service role in the system deployment")
+	}
 
 	var tgt client.Attriber
 	tgt = drs[0]
 
 	attrib := &client.Attrib{}
 	attrib.SetId("provisioner-available-oses")
-	attrib, err = client.GetAttrib(tgt, attrib, "")
+	attrib, err := client.GetAttrib(tgt, attrib, "")
 	if err != nil {
 		return err
 	}
-	attrib.Value = attrValOSes
+	attrib.Value = data.AvailableOSes
 	if err := client.SetAttrib(tgt, attrib, ""); err != nil {
 		return err
 	}
 
+	// Older rebars do not know about arches, so carry on without
+	// them if the attrib is missing.
+	attrib = &client.Attrib{}
+	attrib.SetId("provisioner-available-os-arches")
+	if attrib, err = client.GetAttrib(tgt, attrib, ""); err != nil {
+		logger.Printf("bootenv: Not reporting OS arches to rebar: %v\n", err)
+	} else {
+		attrib.Value = data.OSArches
+		if err := client.SetAttrib(tgt, attrib, ""); err != nil {
+			return err
+		}
+	}
+
 	attrib = &client.Attrib{}
 	attrib.SetId("provisioner-default-os")
 	attrib, err = client.GetAttrib(tgt, attrib, "")
 	if err != nil {
 		return err
 	}
-	attrib.Value = attrValOS
+	attrib.Value = data.DefaultOS
 	if err := client.SetAttrib(tgt, attrib, ""); err != nil {
 		return err
 	}
@@ -590,3 +2546,25 @@ func (b *BootEnv) RebuildRebarData() error {
 
 	return nil
 }
+
+// RebuildRebarResult reports what was sent to Rebar by POST
+// /rebuild-rebar-data.
+type RebuildRebarResult struct {
+	RebarOSData
+	Error string `json:",omitempty"` // Why Rebar could not be updated, if it could not.
+}
+
+func rebuildRebarData(c *gin.Context) {
+	data, err := (&BootEnv{}).rebarOSData()
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	res := &RebuildRebarResult{RebarOSData: *data}
+	if err := publishRebarOSData(data); err != nil {
+		res.Error = err.Error()
+		c.JSON(http.StatusBadGateway, res)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bootEnvIndex keeps track of which machines are on which boot
+// environment, so that we can tell how many machines a boot
+// environment has without loading every machine.  It is built the
+// first time it is used, and kept up to date as machines are saved
+// and deleted after that.
+type bootEnvIndex struct {
+	sync.Mutex
+	built bool
+	// machines[bootEnv][machine key] is the name of the machine.
+	machines map[string]map[string]string
+}
+
+var machineBootEnvIndex = &bootEnvIndex{machines: map[string]map[string]string{}}
+
+func (i *bootEnvIndex) add(machine *Machine) {
+	if i.machines[machine.BootEnv] == nil {
+		i.machines[machine.BootEnv] = map[string]string{}
+	}
+	i.machines[machine.BootEnv][machine.key()] = machine.Name
+}
+
+func (i *bootEnvIndex) drop(machine *Machine) {
+	delete(i.machines[machine.BootEnv], machine.key())
+	if len(i.machines[machine.BootEnv]) == 0 {
+		delete(i.machines, machine.BootEnv)
+	}
+}
+
+// update replaces old with machine in the index.  Either of them can
+// be nil.
+func (i *bootEnvIndex) update(old, machine *Machine) {
+	i.Lock()
+	defer i.Unlock()
+	if !i.built {
+		return
+	}
+	if old != nil {
+		i.drop(old)
+	}
+	if machine != nil {
+		i.add(machine)
+	}
+}
+
+func (i *bootEnvIndex) build() error {
+	if i.built {
+		return nil
+	}
+	machines, err := (&Machine{}).List()
+	if err != nil {
+		return err
+	}
+	for _, machine := range machines {
+		i.add(machine)
+	}
+	i.built = true
+	return nil
+}
+
+// BootEnvMachines is how many machines are on a boot environment.
+type BootEnvMachines struct {
+	BootEnv  string
+	Count    int
+	Machines []string `json:",omitempty"` // The names of the machines, sorted, if asked for.
+}
+
+type bootEnvMachinesByName []*BootEnvMachines
+
+func (b bootEnvMachinesByName) Len() int           { return len(b) }
+func (b bootEnvMachinesByName) Less(i, j int) bool { return b[i].BootEnv < b[j].BootEnv }
+func (b bootEnvMachinesByName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// counts returns how many machines are on each boot environment,
+// sorted by boot environment.  Boot environments with no machines are
+// included, as are machines on boot environments that do not exist.
+func (i *bootEnvIndex) counts(withNames bool) ([]*BootEnvMachines, error) {
+	bootEnvs, err := (&BootEnv{}).List()
+	if err != nil {
+		return nil, err
+	}
+	i.Lock()
+	defer i.Unlock()
+	if err := i.build(); err != nil {
+		return nil, err
+	}
+	found := map[string]*BootEnvMachines{}
+	for _, bootEnv := range bootEnvs {
+		found[bootEnv.Name] = &BootEnvMachines{BootEnv: bootEnv.Name}
+	}
+	for name, machines := range i.machines {
+		entry, ok := found[name]
+		if !ok {
+			entry = &BootEnvMachines{BootEnv: name}
+			found[name] = entry
+		}
+		entry.Count = len(machines)
+		if withNames {
+			entry.Machines = make([]string, 0, len(machines))
+			for _, machineName := range machines {
+				entry.Machines = append(entry.Machines, machineName)
+			}
+			sort.Strings(entry.Machines)
+		}
+	}
+	res := make([]*BootEnvMachines, 0, len(found))
+	for _, entry := range found {
+		res = append(res, entry)
+	}
+	sort.Sort(bootEnvMachinesByName(res))
+	return res, nil
+}
+
+func listBootEnvMachines(c *gin.Context) {
+	res, err := machineBootEnvIndex.counts(c.Query(`names`) == "true")
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BootFileInfo is what a DHCP helper needs to tell a machine how to
+// PXE boot.
+type BootFileInfo struct {
+	Machine    string `json:",omitempty"` // The machine with the MAC, if it is known.
+	BootEnv    string // The boot environment the machine boots into.
+	NextServer string // The TFTP server the machine should boot from.
+	Filename   string // The boot loader the machine should fetch, as a TFTP path.
+	Kernel     string `json:",omitempty"` // The kernel of the boot environment, as a TFTP path.
+	Initrds    []string
+	// The expanded boot params of the boot environment.  Left empty
+	// for unknown machines if they need params only a known machine
+	// has.
+	BootParams string `json:",omitempty"`
+}
+
+// machineByMac returns the machine with mac, or nil if there is none.
+func machineByMac(mac string) (*Machine, error) {
+	machines, err := (&Machine{}).List()
+	if err != nil {
+		return nil, err
+	}
+	for _, machine := range machines {
+		for _, machineMac := range machine.Macs {
+			if machineMac == mac {
+				return machine, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// normalizeMac returns mac in the lower-case, colon-separated form
+// machines store their MACs in.
+func normalizeMac(mac string) (string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(hw.String()), nil
+}
+
+// fileServerURL returns the base URL files under the file root are
+// served over HTTP from, which is the provisioner unless --file-url
+// says otherwise.
+func fileServerURL() string {
+	if fileURL != "" {
+		return strings.TrimSuffix(fileURL, "/")
+	}
+	return provisionerURL
+}
+
+// tftpServer returns the host machines should fetch their boot files
+// from, which is the host of the provisioner unless --tftp-server says
+// otherwise.
+func tftpServer() string {
+	if tftpServerHost != "" {
+		return tftpServerHost
+	}
+	u, err := url.Parse(provisionerURL)
+	if err != nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(u.Host); err == nil {
+		return host
+	}
+	return u.Host
+}
+
+// ResolveBootFile works out how the machine with mac should PXE boot.
+// arch and firmware are what the machine says it is booting with, and
+// take precedence over what the machine was saved with.  Machines that
+// are not known boot into --discovery-bootenv.
+func ResolveBootFile(mac, arch, firmware string) (*BootFileInfo, error) {
+	normalized, err := normalizeMac(mac)
+	if err != nil {
+		return nil, &ValidationError{Kind: "boot-file", Name: mac, Field: "mac", Message: err.Error()}
+	}
+	mac = normalized
+	machine, err := machineByMac(mac)
+	if err != nil {
+		return nil, err
+	}
+	known := machine != nil
+	if !known {
+		machine = &Machine{BootEnv: discoveryBootEnv, Macs: []string{mac}}
+	}
+	if arch != "" {
+		machine.Arch = arch
+	}
+	if firmware != "" {
+		machine.Firmware = firmware
+	}
+	if err := machine.normalizeArchFirmware(); err != nil {
+		return nil, &ValidationError{Kind: "boot-file", Name: mac, Field: "arch", Message: err.Error()}
+	}
+	bootEnv := &BootEnv{Name: machine.BootEnv}
+	if err := backend.load(bootEnv); err != nil {
+		return nil, fmt.Errorf("boot-file: No such bootenv %s", machine.BootEnv)
+	}
+	res := &BootFileInfo{
+		Machine:    machine.Name,
+		BootEnv:    bootEnv.Name,
+		NextServer: tftpServer(),
+		Filename:   biosBootFile,
+		Initrds:    []string{},
+	}
+	if machine.MachineFirmware() == firmwareUefi {
+		res.Filename = uefiBootFile
+	}
+	if bootEnv.Kernel != "" {
+		if res.Kernel, err = bootEnv.PathFor("tftp", bootEnv.Kernel); err != nil {
+			return nil, err
+		}
+	}
+	if res.Initrds, err = bootEnv.InitrdPaths("tftp"); err != nil {
+		return nil, err
+	}
+	extraInitrds, err := machine.InitrdPaths("tftp")
+	if err != nil {
+		return nil, err
+	}
+	res.Initrds = append(res.Initrds, extraInitrds...)
+	if bootEnv.BootParams != "" {
+		tmpl, err := newTemplate("machine", bootEnv.BootParams)
+		if err != nil {
+			return nil, &TemplateParseError{
+				Template: "BootParams",
+				Message:  err.Error(),
+				Contents: bootEnv.BootParams,
+			}
+		}
+		bootEnv.bootParamsTmpl = tmpl
+		vars := newRenderData(machine, bootEnv)
+		params := &bytes.Buffer{}
+		if err := tmpl.Execute(params, vars); err == nil {
+			res.BootParams = params.String()
+		} else if known {
+			return nil, &TemplateRenderError{
+				Template: "BootParams",
+				Machine:  machine.Name,
+				Message:  err.Error(),
+			}
+		}
+	}
+	return res, nil
+}
+
+func resolveBootFile(c *gin.Context) {
+	res, err := ResolveBootFile(c.Query(`mac`), c.Query(`arch`), c.Query(`firmware`))
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
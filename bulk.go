@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MachineFilter picks out machines.  Machines match if they are named
+// in Names, or if their param at Param is Value.  At least one of
+// them must be set.
+type MachineFilter struct {
+	Names []string // Names or UUIDs of machines.
+	Param string   // A param, as a dotted path for nested params.
+	Value string   // The value Param must have, as for GET /machines?param=&value=.
+}
+
+// machines returns the machines that match the filter, sorted by name.
+func (f *MachineFilter) machines() ([]*Machine, error) {
+	if len(f.Names) == 0 && f.Param == "" {
+		return nil, &ValidationError{Kind: "bulk", Name: "assign-bootenv", Field: "Filter", Message: "Filter needs Names or Param"}
+	}
+	found := map[string]*Machine{}
+	for _, name := range f.Names {
+		machine := popMachine(name)
+		if err := backend.load(machine); err != nil {
+			return nil, fmt.Errorf("bulk: No such machine %s", name)
+		}
+		found[machine.key()] = machine
+	}
+	if f.Param != "" {
+		matched, err := machineParamIndex.search(f.Param, f.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, machine := range matched {
+			found[machine.key()] = machine
+		}
+	}
+	res := make([]*Machine, 0, len(found))
+	for _, machine := range found {
+		res = append(res, machine)
+	}
+	sort.Sort(machinesByName(res))
+	return res, nil
+}
+
+// BulkBootEnvRequest asks for every machine matching Filter to be
+// moved to BootEnv.
+type BulkBootEnvRequest struct {
+	Filter  MachineFilter
+	BootEnv string // The boot environment to move the machines to.
+	DryRun  bool   // If set, only report what would change.
+}
+
+// BulkBootEnvChange is a machine that is, or would be, moved to
+// another boot environment.
+type BulkBootEnvChange struct {
+	Machine string
+	From    string
+	To      string
+}
+
+// BulkBootEnvResult reports what happened to a BulkBootEnvRequest.
+type BulkBootEnvResult struct {
+	BootEnv   string
+	DryRun    bool
+	Matched   int                  // How many machines the filter matched.
+	Unchanged int                  // How many of them were already in BootEnv.
+	Succeeded int                  // How many were, or would be, moved.  Nothing is moved if any fail.
+	Failed    int                  // How many could not be moved.
+	Changes   []*BulkBootEnvChange // The machines that were, or would be, moved.
+	Failures  []string             // Why machines could not be moved.
+}
+
+// failureMessages turns failures into the messages bulk results
+// report them with.
+func failureMessages(failures []*MachineFailure) []string {
+	res := make([]string, len(failures))
+	for i, f := range failures {
+		res[i] = f.String()
+	}
+	return res
+}
+
+// assignBootEnv moves all of the machines matching the request to its
+// boot environment, all or nothing.  Every machine is rendered with
+// the new boot environment in memory first, and nothing is changed
+// unless all of them render.  If saving any of the machines fails
+// after that, the machines that were already moved are moved back.
+func assignBootEnv(req *BulkBootEnvRequest) (*BulkBootEnvResult, error) {
+	res := &BulkBootEnvResult{
+		BootEnv:  req.BootEnv,
+		DryRun:   req.DryRun,
+		Changes:  []*BulkBootEnvChange{},
+		Failures: []string{},
+	}
+	bootEnv := &BootEnv{Name: req.BootEnv}
+	if err := backend.load(bootEnv); err != nil {
+		return nil, fmt.Errorf("bulk: No such bootenv %s", req.BootEnv)
+	}
+	matched, err := req.Filter.machines()
+	if err != nil {
+		return nil, err
+	}
+	res.Matched = len(matched)
+	toMove := []*Machine{}
+	for _, machine := range matched {
+		if machine.BootEnv == req.BootEnv {
+			res.Unchanged++
+			continue
+		}
+		toMove = append(toMove, machine)
+		res.Changes = append(res.Changes, &BulkBootEnvChange{
+			Machine: machine.Name,
+			From:    machine.BootEnv,
+			To:      req.BootEnv,
+		})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), renderTimeout)
+	defer cancel()
+	res.Failures = failureMessages(eachMachine(ctx, bootEnv.Name, toMove, func(machine *Machine) error {
+		if machine.Maintenance {
+			return fmt.Errorf("machine: %s is in maintenance", machine.Name)
+		}
+		moved := &Machine{}
+		*moved = *machine
+		moved.BootEnv = req.BootEnv
+		_, err := bootEnv.clone().renderFiles(moved)
+		return err
+	}))
+	res.Failed = len(res.Failures)
+	if req.DryRun {
+		res.Succeeded = len(toMove) - res.Failed
+		return res, nil
+	}
+	if res.Failed > 0 {
+		return res, nil
+	}
+
+	mux := &sync.Mutex{}
+	moved := []*Machine{}
+	res.Failures = failureMessages(eachMachine(context.Background(), bootEnv.Name, toMove, func(machine *Machine) error {
+		newMachine := &Machine{}
+		*newMachine = *machine
+		newMachine.BootEnv = req.BootEnv
+		if err := backend.save(newMachine, machine); err != nil {
+			return err
+		}
+		mux.Lock()
+		moved = append(moved, machine)
+		mux.Unlock()
+		return nil
+	}))
+	res.Failed = len(res.Failures)
+	if res.Failed == 0 {
+		res.Succeeded = len(toMove)
+		return res, nil
+	}
+	// Put the machines we already moved back where they were.
+	for _, machine := range moved {
+		current := &Machine{}
+		*current = *machine
+		current.BootEnv = req.BootEnv
+		if err := backend.save(machine, current); err != nil {
+			res.Failures = append(res.Failures, fmt.Sprintf("%s: Failed to move back to %s: %v", machine.Name, machine.BootEnv, err))
+		}
+	}
+	return res, nil
+}
+
+func bulkAssignBootEnv(c *gin.Context) {
+	req := &BulkBootEnvRequest{}
+	if err := c.Bind(req); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+		return
+	}
+	res, err := assignBootEnv(req)
+	if err != nil {
+		respondWithError(c, http.StatusConflict, err)
+		return
+	}
+	status := http.StatusOK
+	if res.Failed > 0 {
+		status = http.StatusConflict
+	}
+	c.JSON(status, res)
+}
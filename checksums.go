@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// sha256File returns the hex-encoded SHA256 of the file at filePath.
+func sha256File(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// expectedSha256 returns the SHA256 f should have, or "" if it has no
+// ValidationURL to check it against or is checked by signature
+// instead.
+func (f *FileData) expectedSha256() (string, error) {
+	if f.ValidationURL == "" {
+		return "", nil
+	}
+	switch f.ValidationMethod {
+	case "", "sha256":
+		return f.checksumFor()
+	case "gpg":
+		return "", nil
+	}
+	return "", fmt.Errorf("validate: Unknown validation method %s for %s", f.ValidationMethod, f.Name)
+}
+
+// checksumFor returns the expected SHA256 of f, as published at
+// f.ValidationURL.
+func (f *FileData) checksumFor() (string, error) {
+	resp, err := httpClient.Get(f.ValidationURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("checksum: %s returned %s", f.ValidationURL, resp.Status)
+	}
+	name := path.Base(f.Name)
+	if f.nameIsTemplate() {
+		// The file is published under its own name, not ours.
+		if u, err := url.Parse(f.URL); err == nil {
+			name = path.Base(u.Path)
+		}
+	}
+	return parseChecksums(resp.Body, name)
+}
+
+// bsdChecksumLine matches checksum lines in the "SHA256 (file) = hash"
+// format that BSD sha256 and GNU sha256sum --tag produce.
+var bsdChecksumLine = regexp.MustCompile(`^([A-Za-z0-9-]+) \((.+)\) = ([0-9A-Fa-f]+)$`)
+
+// isSha256 checks to see if hash looks like a hex-encoded SHA256.
+func isSha256(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// parseChecksums finds the SHA256 for name in a checksum file.  The
+// checksum file can consist of a single bare hash, of lines in the
+// "hash  filename" format that sha256sum produces, or of lines in the
+// "SHA256 (filename) = hash" format that BSD sha256 produces.  Lines
+// for other algorithms in BSD-format files are ignored, and filenames
+// match if either they or their last path element is name.  Checksum
+// files that are malformed, have no checksum for name, or have more
+// than one different checksum for it are errors.
+func parseChecksums(r io.Reader, name string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	bare := []string{}
+	found := ""
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var hash, file string
+		if match := bsdChecksumLine.FindStringSubmatch(line); match != nil {
+			if strings.ToUpper(match[1]) != "SHA256" {
+				continue
+			}
+			file, hash = match[2], match[3]
+		} else {
+			fields := strings.Fields(line)
+			hash = fields[0]
+			if len(fields) > 1 {
+				file = strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(line, hash)), "*")
+			}
+		}
+		if !isSha256(hash) {
+			return "", fmt.Errorf("checksum: Line %d is not a SHA256 checksum: %q", lineNum, line)
+		}
+		hash = strings.ToLower(hash)
+		if file == "" {
+			bare = append(bare, hash)
+			continue
+		}
+		if file != name && path.Base(file) != name {
+			continue
+		}
+		if found != "" && found != hash {
+			return "", fmt.Errorf("checksum: Conflicting checksums for %s: %s and %s", name, found, hash)
+		}
+		found = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if found != "" {
+		return found, nil
+	}
+	switch len(bare) {
+	case 0:
+		return "", fmt.Errorf("checksum: No checksum for %s", name)
+	case 1:
+		return bare[0], nil
+	default:
+		return "", fmt.Errorf("checksum: %d checksums without filenames, cannot tell which is for %s", len(bare), name)
+	}
+}
@@ -5,29 +5,44 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"reflect"
 
 	"github.com/VictorLowther/jsonpatch"
 	"github.com/gin-gonic/gin"
 )
 
+// redacter is implemented by things that are not sent back over the
+// API as they are stored, like ones holding secrets which must not be.
+type redacter interface {
+	redacted() interface{}
+}
+
+// publicForm returns thing the way it should appear in API responses.
+func publicForm(thing interface{}) interface{} {
+	if r, ok := thing.(redacter); ok {
+		return r.redacted()
+	}
+	return thing
+}
+
 func listThings(c *gin.Context, thing keySaver) {
 	things := backend.list(thing)
 	res := make([]interface{}, len(things))
 	for i, obj := range things {
-		var buf interface{}
-		if err := json.Unmarshal(obj, &buf); err != nil {
-			c.JSON(http.StatusInternalServerError,
-				NewError(fmt.Sprintf("list: error unmarshalling %v: %v", string(obj), err)))
+		buf := thing.newIsh()
+		if err := decodeThing(obj, buf); err != nil {
+			respondWithError(c, http.StatusInternalServerError,
+				fmt.Errorf("list: error unmarshalling %v: %v", string(obj), err))
                         return
 		}
-		res[i] = buf
+		res[i] = publicForm(buf)
 	}
 	c.JSON(http.StatusOK, res)
 }
 
 func createThing(c *gin.Context, newThing keySaver) {
 	if err := c.Bind(&newThing); err != nil {
-		c.JSON(http.StatusBadRequest, NewError(err.Error()))
+		respondWithError(c, http.StatusBadRequest, err)
                 return
 	}
 	finalStatus := http.StatusCreated
@@ -40,10 +55,10 @@ func createThing(c *gin.Context, newThing keySaver) {
 		oldThing = nil
 	}
 	if err := backend.save(newThing, oldThing); err != nil {
-		c.JSON(http.StatusConflict, NewError(err.Error()))
+		respondWithError(c, http.StatusConflict, err)
                 return
 	}
-	c.JSON(finalStatus, newThing)
+	c.JSON(finalStatus, publicForm(newThing))
 }
 
 func getThing(c *gin.Context, thing keySaver) {
@@ -51,42 +66,118 @@ func getThing(c *gin.Context, thing keySaver) {
 		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
                 return
 	}
-	c.JSON(http.StatusOK, thing)
+	c.JSON(http.StatusOK, publicForm(thing))
 }
 
-func updateThing(c *gin.Context, oldThing, newThing keySaver) {
+// patchThing loads oldThing and applies the JSON patch in the request
+// body to it in newThing, without saving anything.  It responds and
+// returns false if it could not.
+func patchThing(c *gin.Context, oldThing, newThing keySaver) bool {
 	if err := backend.load(oldThing); err != nil {
 		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
-                return
+		return false
 	}
 	patch, err := ioutil.ReadAll(c.Request.Body)
 	if err != nil {
 		c.Error(err)
 		c.Data(http.StatusExpectationFailed, gin.MIMEJSON, nil)
-                return
+		return false
 	}
 	oldThingBuf, _ := json.Marshal(oldThing)
 	newThingBuf, err, loc := jsonpatch.ApplyJSON(oldThingBuf, patch)
 	if err != nil {
-		c.JSON(http.StatusConflict, NewError(fmt.Sprintf("Failed to apply patch at %d: %v\n", loc, err)))
-                return
+		respondWithError(c, http.StatusConflict, fmt.Errorf("Failed to apply patch at %d: %v", loc, err))
+		return false
 	}
 	if err := json.Unmarshal(newThingBuf, &newThing); err != nil {
 		c.Error(err)
 		c.Data(http.StatusExpectationFailed, gin.MIMEJSON, nil)
-                return
+		return false
+	}
+	return true
+}
+
+func updateThing(c *gin.Context, oldThing, newThing keySaver) {
+	if !patchThing(c, oldThing, newThing) {
+		return
 	}
 	if err := backend.save(newThing, oldThing); err != nil {
-		c.JSON(http.StatusConflict, NewError(err.Error()))
+		respondWithError(c, http.StatusConflict, err)
                 return
 	}
-	c.JSON(http.StatusAccepted, newThing)
+	c.JSON(http.StatusAccepted, publicForm(newThing))
 }
 
 func deleteThing(c *gin.Context, thing keySaver) {
 	if err := backend.remove(thing); err != nil {
-		c.JSON(http.StatusConflict, NewError(fmt.Sprintf("Failed to delete %s: %v", thing.key(), err)))
+		respondWithError(c, http.StatusConflict, fmt.Errorf("Failed to delete %s: %v", thing.key(), err))
                 return
 	}
 	c.Data(http.StatusAccepted, gin.MIMEJSON, nil)
 }
+
+// EnsureResult reports what ensuring a thing did to it.
+type EnsureResult struct {
+	Result string      // One of created, updated, or unchanged.
+	Thing  interface{} // The thing as it is now.
+}
+
+const (
+	ensureCreated   = "created"
+	ensureUpdated   = "updated"
+	ensureUnchanged = "unchanged"
+)
+
+// sameThing returns whether a and b would be stored the same, ignoring
+// the schema version they were saved with.
+func sameThing(a, b keySaver) bool {
+	aObj, err := asJSONObject(storedForm(a))
+	if err != nil {
+		return false
+	}
+	bObj, err := asJSONObject(storedForm(b))
+	if err != nil {
+		return false
+	}
+	delete(aObj, "SchemaVersion")
+	delete(bObj, "SchemaVersion")
+	return reflect.DeepEqual(aObj, bObj)
+}
+
+// ensureThing makes oldThing look like the thing in the request body,
+// creating it if it does not exist and updating it if it differs.
+// Unlike createThing, a thing that already matches is left alone
+// without running its onChange hook again, so the same definition can
+// be sent as often as needed.
+func ensureThing(c *gin.Context, oldThing, newThing keySaver) {
+	if err := c.Bind(&newThing); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+		return
+	}
+	if newThing.key() != oldThing.key() {
+		respondWithError(c, http.StatusBadRequest,
+			fmt.Errorf("ensure: %s in the body does not match %s", newThing.key(), oldThing.key()))
+		return
+	}
+	res := &EnsureResult{Result: ensureCreated, Thing: newThing}
+	finalStatus := http.StatusCreated
+	if err := backend.load(oldThing); err == nil {
+		if sameThing(oldThing, newThing) {
+			res.Result, res.Thing = ensureUnchanged, publicForm(oldThing)
+			c.JSON(http.StatusOK, res)
+			return
+		}
+		logger.Printf("backend: Updating %v\n", oldThing.key())
+		res.Result = ensureUpdated
+		finalStatus = http.StatusAccepted
+	} else {
+		logger.Printf("backend: Creating %v\n", newThing.key())
+		oldThing = nil
+	}
+	if err := backend.save(newThing, oldThing); err != nil {
+		respondWithError(c, http.StatusConflict, err)
+		return
+	}
+	res.Thing = publicForm(newThing)
+	c.JSON(finalStatus, res)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FieldChange is a field that differs between two things.
+type FieldChange struct {
+	Field string      // The field, as a dotted path for nested fields.
+	A     interface{} // The value in the first thing, or null if it does not have it.
+	B     interface{} // The value in the second thing, or null if it does not have it.
+}
+
+// TemplateChange is a template that differs between two boot
+// environments.
+type TemplateChange struct {
+	Name  string        // The name of the template.
+	A     *TemplateInfo // The template in the first boot environment, or null if it does not have it.
+	B     *TemplateInfo // The template in the second boot environment, or null if it does not have it.
+	UUIDs bool          // Whether the templates have different UUIDs.
+	// Whether the contents of the templates differ.  Templates with
+	// different UUIDs can still have the same contents.
+	Contents bool
+}
+
+// BootEnvDiff describes how two boot environments differ.
+type BootEnvDiff struct {
+	A         string            // The name of the first boot environment.
+	B         string            // The name of the second boot environment.
+	Fields    []*FieldChange    // The fields that differ, other than the templates.
+	Templates []*TemplateChange // The templates that differ, including the ones inherited from OS families.
+}
+
+// diffValues appends the differences between a and b, which are
+// decoded JSON, to changes.  Objects are compared field by field, and
+// everything else is compared as a whole.
+func diffValues(field string, a, b interface{}, changes []*FieldChange) []*FieldChange {
+	aMap, aOk := a.(map[string]interface{})
+	bMap, bOk := b.(map[string]interface{})
+	if !aOk || !bOk {
+		if !reflect.DeepEqual(a, b) {
+			changes = append(changes, &FieldChange{Field: field, A: a, B: b})
+		}
+		return changes
+	}
+	keys := []string{}
+	for k := range aMap {
+		keys = append(keys, k)
+	}
+	for k := range bMap {
+		if _, ok := aMap[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		sub := k
+		if field != "" {
+			sub = field + "." + k
+		}
+		changes = diffValues(sub, aMap[k], bMap[k], changes)
+	}
+	return changes
+}
+
+// asJSONObject returns thing as decoded JSON.
+func asJSONObject(thing interface{}) (map[string]interface{}, error) {
+	buf, err := json.Marshal(thing)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]interface{}{}
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// templateSha256 returns the Sha256 of the contents of the template
+// with uuid, or "" if it cannot be loaded.
+func templateSha256(uuid string) string {
+	tmpl := &Template{UUID: uuid}
+	if err := backend.load(tmpl); err != nil {
+		return ""
+	}
+	return tmpl.Sha256
+}
+
+// Diff compares the boot environment with other.
+func (b *BootEnv) Diff(other *BootEnv) (*BootEnvDiff, error) {
+	res := &BootEnvDiff{
+		A:         b.Name,
+		B:         other.Name,
+		Fields:    []*FieldChange{},
+		Templates: []*TemplateChange{},
+	}
+	aObj, err := asJSONObject(b)
+	if err != nil {
+		return nil, err
+	}
+	bObj, err := asJSONObject(other)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range []string{"Name", "Templates", "SchemaVersion"} {
+		delete(aObj, field)
+		delete(bObj, field)
+	}
+	res.Fields = diffValues("", aObj, bObj, res.Fields)
+
+	b.mergeTemplates()
+	other.mergeTemplates()
+	aTmpls := map[string]*TemplateInfo{}
+	bTmpls := map[string]*TemplateInfo{}
+	names := []string{}
+	for _, ti := range b.templates {
+		aTmpls[ti.Name] = ti
+		names = append(names, ti.Name)
+	}
+	for _, ti := range other.templates {
+		bTmpls[ti.Name] = ti
+		if _, ok := aTmpls[ti.Name]; !ok {
+			names = append(names, ti.Name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		aTi, bTi := aTmpls[name], bTmpls[name]
+		change := &TemplateChange{Name: name, A: aTi, B: bTi}
+		if aTi != nil && bTi != nil {
+			aInfo, err := asJSONObject(aTi)
+			if err != nil {
+				return nil, err
+			}
+			bInfo, err := asJSONObject(bTi)
+			if err != nil {
+				return nil, err
+			}
+			if reflect.DeepEqual(aInfo, bInfo) {
+				continue
+			}
+			change.UUIDs = aTi.UUID != bTi.UUID
+			change.Contents = change.UUIDs && templateSha256(aTi.UUID) != templateSha256(bTi.UUID)
+		}
+		res.Templates = append(res.Templates, change)
+	}
+	return res, nil
+}
+
+func diffBootEnvs(c *gin.Context) {
+	a := &BootEnv{Name: c.Query(`a`)}
+	if err := backend.load(a); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	b := &BootEnv{Name: c.Query(`b`)}
+	if err := backend.load(b); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	res, err := a.Diff(b)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
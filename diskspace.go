@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// diskSpaceMargin is how much space is left free on top of what a
+// download or explode needs, so that the provisioner volume is never
+// filled up completely.
+const diskSpaceMargin = 64 << 20
+
+// explodeSpaceFactor is how much bigger than its ISO an install tree
+// is assumed to be when checking there is room to explode it.
+const explodeSpaceFactor = 1.2
+
+// freeSpace returns how many bytes are free for unprivileged users on
+// the filesystem dir is on.  If dir does not exist yet, the
+// filesystem of the closest parent that does is used.
+func freeSpace(dir string) (uint64, error) {
+	for {
+		if _, err := os.Stat(dir); err == nil || dir == filepath.Dir(dir) {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	stat := &syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+// checkFreeSpace makes sure there are at least size bytes, plus
+// diskSpaceMargin, free to write path.  Sizes less than 0 are
+// unknown, and always fit.
+func checkFreeSpace(path string, size int64) error {
+	if size < 0 {
+		return nil
+	}
+	available, err := freeSpace(filepath.Dir(path))
+	if err != nil {
+		// Not being able to tell is not a reason to fail.
+		logger.Printf("disk: Unable to check the free space for %s: %v\n", path, err)
+		return nil
+	}
+	required := uint64(size) + diskSpaceMargin
+	if available < required {
+		return &InsufficientSpaceError{Path: path, Required: required, Available: available}
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// httpClient is used for everything the provisioner fetches from
+// other servers.  It is replaced in main with one that uses
+// --download-connect-timeout and --download-read-timeout.
+var httpClient = http.DefaultClient
+
+// newHTTPClient returns a client that gives up on servers that take
+// longer than connectTimeout to connect to, or longer than
+// readTimeout to start answering.
+func newHTTPClient(connectTimeout, readTimeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   connectTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   connectTimeout,
+			ResponseHeaderTimeout: readTimeout,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+}
+
+// stallTimer cancels a download that has gone --download-read-timeout
+// without receiving anything.  Reads through it push the deadline
+// back.  A --download-read-timeout of 0 lets downloads stall forever.
+type stallTimer struct {
+	r       io.Reader
+	timer   *time.Timer
+	stalled int32
+}
+
+func newStallTimer(r io.Reader, cancel context.CancelFunc) *stallTimer {
+	res := &stallTimer{r: r}
+	if downloadReadTimeout > 0 {
+		res.timer = time.AfterFunc(downloadReadTimeout, func() {
+			atomic.StoreInt32(&res.stalled, 1)
+			cancel()
+		})
+	}
+	return res
+}
+
+func (s *stallTimer) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 && s.timer != nil {
+		s.timer.Reset(downloadReadTimeout)
+	}
+	return n, err
+}
+
+func (s *stallTimer) stop() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+// copyErr turns a failure to save url to dest into a DownloadError
+// that says whether the download timed out or stalled.
+func (s *stallTimer) copyErr(ctx context.Context, url, dest string, err error) error {
+	if atomic.LoadInt32(&s.stalled) != 0 {
+		return &DownloadError{URL: url, Message: fmt.Sprintf("Nothing received for %v saving to %s", downloadReadTimeout, dest)}
+	}
+	if ctx.Err() != nil {
+		return &DownloadError{URL: url, Message: fmt.Sprintf("Timed out saving to %s: %v", dest, ctx.Err())}
+	}
+	return &DownloadError{URL: url, Message: fmt.Sprintf("Failed to save to %s: %v", dest, err)}
+}
+
+// downloadProgressInterval is how often the progress of a download is
+// logged.
+const downloadProgressInterval = 10 * time.Second
+
+// downloadProgress logs how far along a download is every
+// downloadProgressInterval as it is written to, so that slow
+// downloads can be told apart from stuck ones.
+type downloadProgress struct {
+	url     string
+	start   int64 // How much was already downloaded before this attempt.
+	done    int64 // How much has been downloaded, including start.
+	total   int64 // How big the download is, or -1 if we do not know.
+	began   time.Time
+	lastLog time.Time
+}
+
+func newDownloadProgress(url string, start, length int64) *downloadProgress {
+	total := int64(-1)
+	if length >= 0 {
+		total = start + length
+	}
+	now := time.Now()
+	return &downloadProgress{url: url, start: start, done: start, total: total, began: now, lastLog: now}
+}
+
+func (p *downloadProgress) Write(buf []byte) (int, error) {
+	p.done += int64(len(buf))
+	if now := time.Now(); now.Sub(p.lastLog) >= downloadProgressInterval {
+		p.lastLog = now
+		p.log(now)
+	}
+	return len(buf), nil
+}
+
+func (p *downloadProgress) log(now time.Time) {
+	elapsed := now.Sub(p.began)
+	if p.total <= 0 {
+		logger.Printf("download: %s: %d bytes so far\n", p.url, p.done)
+		return
+	}
+	msg := fmt.Sprintf("download: %s: %d of %d bytes (%.1f%%)",
+		p.url,
+		p.done,
+		p.total,
+		float64(p.done)*100/float64(p.total))
+	if got := p.done - p.start; got > 0 && elapsed > 0 {
+		rate := float64(got) / elapsed.Seconds()
+		eta := time.Duration(float64(p.total-p.done)/rate) * time.Second
+		msg += fmt.Sprintf(", about %v left", eta)
+	}
+	logger.Printf("%s\n", msg)
+}
+
+// downloadFile fetches url and saves it to dest.  The download is
+// abandoned if it takes longer than --download-timeout or ctx is done.
+func downloadFile(ctx context.Context, url, dest string) error {
+	return downloadVerified(ctx, url, dest, "", nil)
+}
+
+// downloadVerified fetches url and saves it to dest like downloadFile.
+// If expectedSha256 is set, the SHA256 of the download is worked out
+// as it is saved, and the download is thrown away if it does not
+// match.  If verify is not nil, it is called with the path of the
+// complete download, and the download is thrown away if it fails.
+// The download is saved to dest.tmp and only moved to dest once it is
+// complete and checked, so a failed download or one that does not
+// check out never leaves anything at dest.
+//
+// If the server accepts byte ranges, an interrupted download is left
+// in dest.tmp along with the URL and cache validators it came from,
+// and the next download of dest from the same URL picks up where it
+// left off instead of starting again.  The server is asked to send the
+// rest with If-Range, so that if the file has changed since, it is
+// sent whole instead.  Partial downloads without validators are not
+// resumed.  The SHA256 still covers the whole file, so a corrupt
+// partial download is not silently extended.
+func downloadVerified(ctx context.Context, url, dest, expectedSha256 string, verify func(tmpPath string) error) error {
+	ctx, cancel := context.WithTimeout(ctx, downloadTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	tmpPath := dest + ".tmp"
+	var offset int64
+	if info, err := os.Stat(tmpPath); err == nil && info.Mode().IsRegular() && info.Size() > 0 {
+		if ifRange := partialIfRange(tmpPath, url); ifRange != "" {
+			offset = info.Size()
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			req.Header.Set("If-Range", ifRange)
+		} else {
+			removePartial(tmpPath)
+		}
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return &DownloadError{URL: url, Message: err.Error()}
+	}
+	defer resp.Body.Close()
+	if err := checkFreeSpace(dest, resp.ContentLength); err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	var out *os.File
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			removePartial(tmpPath)
+			return &DownloadError{
+				URL:        url,
+				StatusCode: resp.StatusCode,
+				Message:    "Server resumed from the wrong place: " + resp.Header.Get("Content-Range"),
+			}
+		}
+		if out, err = os.OpenFile(tmpPath, os.O_RDWR, 0644); err != nil {
+			return err
+		}
+		// Hash what we already have, which also leaves out at the
+		// end of the file to append the rest to.
+		if _, err := io.Copy(hasher, out); err != nil {
+			out.Close()
+			removePartial(tmpPath)
+			return err
+		}
+		logger.Printf("download: Resuming %s at %d bytes\n", url, offset)
+	case resp.StatusCode == http.StatusOK:
+		offset = 0
+		if out, err = os.Create(tmpPath); err != nil {
+			return err
+		}
+		partial := &cacheValidators{
+			URL:          url,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		}
+		if err := saveValidators(tmpPath, partial); err != nil {
+			logger.Printf("download: Failed to save the validators for %s, it cannot be resumed: %v\n", tmpPath, err)
+		}
+	default:
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			// The partial download is no good to resume from.
+			removePartial(tmpPath)
+		}
+		return &DownloadError{
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			Message:    "Server returned " + resp.Status,
+		}
+	}
+	body := newStallTimer(resp.Body, cancel)
+	defer body.stop()
+	progress := newDownloadProgress(url, offset, resp.ContentLength)
+	if _, err := io.Copy(io.MultiWriter(out, hasher, progress), body); err != nil {
+		out.Sync()
+		out.Close()
+		if resp.Header.Get("Accept-Ranges") != "bytes" && resp.StatusCode != http.StatusPartialContent {
+			removePartial(tmpPath)
+		}
+		return body.copyErr(ctx, url, dest, err)
+	}
+	out.Sync()
+	if err := out.Close(); err != nil {
+		removePartial(tmpPath)
+		return err
+	}
+	if expectedSha256 != "" {
+		actual := hex.EncodeToString(hasher.Sum(nil))
+		if !strings.EqualFold(actual, expectedSha256) {
+			removePartial(tmpPath)
+			return &ChecksumMismatchError{Path: dest, Expected: expectedSha256, Actual: actual}
+		}
+	}
+	if verify != nil {
+		if err := verify(tmpPath); err != nil {
+			removePartial(tmpPath)
+			return err
+		}
+	}
+	os.Remove(validatorsPath(tmpPath))
+	if err := os.Rename(tmpPath, dest); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("download: Unable to move %s into place: %v", dest, err)
+	}
+	return nil
+}
+
+// partialIfRange returns what to send as If-Range to resume the partial
+// download at tmpPath from url, or "" if it cannot be resumed because
+// it came from another URL or the server did not say enough about it
+// to tell whether it has changed since.
+func partialIfRange(tmpPath, url string) string {
+	v := loadValidators(tmpPath)
+	switch {
+	case v == nil || v.URL != url:
+		return ""
+	case v.ETag != "" && !strings.HasPrefix(v.ETag, "W/"):
+		return v.ETag
+	default:
+		return v.LastModified
+	}
+}
+
+// removePartial removes the partial download at tmpPath, along with
+// what was saved to resume it.
+func removePartial(tmpPath string) {
+	os.Remove(tmpPath)
+	os.Remove(validatorsPath(tmpPath))
+}
+
+// retryDownload calls fetch until it succeeds or has been tried
+// attempts times, waiting delay before the first retry and doubling
+// the wait after each one.  Failures that trying again will not fix,
+// like a checksum mismatch or a 404, are not retried.  It returns how
+// many attempts were made.  If fetch keeps failing, the last error is
+// returned with the number of attempts filled in: typed errors are
+// kept as they are, and anything else becomes a DownloadError for
+// url.
+func retryDownload(ctx context.Context, url string, attempts int, delay time.Duration, fetch func() error) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := fetch()
+		if err == nil {
+			return attempt, nil
+		}
+		if attempt >= attempts || !isTransient(err) {
+			return attempt, retriedError(url, attempt, err)
+		}
+		logger.Printf("download: Attempt %d for %s failed, retrying in %v: %v\n", attempt, url, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return attempt, fmt.Errorf("download: Gave up waiting to retry %s: %v", url, ctx.Err())
+		}
+		delay *= 2
+	}
+}
+
+// retriedError records that err is what was left after attempts tries
+// at downloading url.
+func retriedError(url string, attempts int, err error) error {
+	switch e := err.(type) {
+	case *DownloadError:
+		res := *e
+		res.Attempts = attempts
+		return &res
+	case *MirrorsError:
+		res := *e
+		res.Attempts = attempts
+		return &res
+	case typedError:
+		return err
+	}
+	return &DownloadError{URL: url, Attempts: attempts, Message: err.Error()}
+}
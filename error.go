@@ -1,9 +1,510 @@
 package main
 
-type pkgError struct {
-	Message string
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// isTransient reports whether err is the sort of failure that may go
+// away if whatever failed is tried again, such as failing to talk to
+// the backend or Rebar, or a server error from a download.
+func isTransient(err error) bool {
+	switch e := err.(type) {
+	case *DownloadError:
+		// Downloads that were already retried have had their chance.
+		if e.Attempts > 1 {
+			return false
+		}
+		return e.StatusCode == 0 ||
+			e.StatusCode == http.StatusTooManyRequests ||
+			e.StatusCode >= http.StatusInternalServerError
+	case *MirrorsError:
+		if e.Attempts > 1 {
+			return false
+		}
+		for _, f := range e.Failures {
+			if isTransient(f.err) {
+				return true
+			}
+		}
+		return false
+	case *BackendError, *RebarError:
+		return true
+	case net.Error:
+		return e.Timeout() || e.Temporary()
+	}
+	return false
+}
+
+// apiError is the body of every error the API returns:
+// {"error": {"code": ..., "message": ..., "details": ...}}.
+type apiError struct {
+	Error *apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	// The Type of a typed error, or the HTTP status without spaces,
+	// like NotFound.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// The fields of a typed error, if any.
+	Details interface{} `json:"details,omitempty"`
+}
+
+// typedError is implemented by errors that carry structured details
+// for API clients, and know which HTTP status they should be reported
+// with.
+type typedError interface {
+	error
+	errorType() string
+	httpStatus() int
+}
+
+// statusCode returns the code for errors with status that are not
+// typed errors.
+func statusCode(status int) string {
+	return strings.Replace(http.StatusText(status), " ", "", -1)
+}
+
+// newAPIError wraps err for the client, along with the status it
+// should be reported with.  Typed errors are reported with their own
+// status, code, and details, and everything else is reported with
+// status.
+func newAPIError(status int, err error) (int, *apiError) {
+	if e, ok := err.(typedError); ok {
+		return e.httpStatus(), &apiError{&apiErrorBody{
+			Code:    e.errorType(),
+			Message: e.Error(),
+			Details: e,
+		}}
+	}
+	return status, &apiError{&apiErrorBody{Code: statusCode(status), Message: err.Error()}}
+}
+
+// respondWithError reports err to the client.
+func respondWithError(c *gin.Context, status int, err error) {
+	c.JSON(newAPIError(status, err))
+}
+
+// errorEnvelope makes sure that every error the API returns has a
+// body, for handlers that only set an error status, like a 404 for
+// something that does not exist.  The last error recorded with
+// c.Error is used as the message, if there is one.
+func errorEnvelope(c *gin.Context) {
+	c.Next()
+	status := c.Writer.Status()
+	if status < http.StatusBadRequest || c.Writer.Size() > 0 {
+		return
+	}
+	err := errors.New(http.StatusText(status))
+	if last := c.Errors.Last(); last != nil {
+		err = last.Err
+	}
+	_, body := newAPIError(status, err)
+	buf, jsonErr := json.Marshal(body)
+	if jsonErr != nil {
+		return
+	}
+	if !c.Writer.Written() {
+		c.Writer.Header().Set("Content-Type", gin.MIMEJSON+"; charset=utf-8")
+	}
+	c.Writer.Write(buf)
+}
+
+// ValidationError is returned when something is saved with a field
+// that is missing or malformed.
+type ValidationError struct {
+	Kind    string // The kind of thing that is invalid, like bootenv.
+	Name    string // The name of the thing.
+	Field   string // The field that is invalid.
+	Message string // What is wrong with it.
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Kind, e.Name, e.Message)
+}
+
+func (e *ValidationError) errorType() string {
+	return "Validation"
+}
+
+func (e *ValidationError) httpStatus() int {
+	return http.StatusBadRequest
+}
+
+// MissingParamsError is returned when a machine does not have all of
+// the RequiredParams of its boot environment.
+type MissingParamsError struct {
+	BootEnv string   // The boot environment that requires the params.
+	Machine string   // The machine that is missing them.
+	Params  []string // The missing params.
+	// What the boot environment's ParamInfo says about the missing
+	// params, for the ones it describes.
+	Descriptions []*MissingParam `json:",omitempty"`
+}
+
+// MissingParam describes a required param that a machine is missing,
+// so that whoever fills it in knows what it is for.
+type MissingParam struct {
+	Name        string
+	Description string      `json:",omitempty"`
+	Example     interface{} `json:",omitempty"`
+}
+
+func (e *MissingParamsError) Error() string {
+	res := fmt.Sprintf("bootenv: %s missing required machine params for %s:\n %v", e.BootEnv, e.Machine, e.Params)
+	for _, param := range e.Descriptions {
+		res += fmt.Sprintf("\n %s: %s", param.Name, param.Description)
+		if param.Example != nil {
+			res += fmt.Sprintf(" (e.g. %v)", param.Example)
+		}
+	}
+	return res
+}
+
+func (e *MissingParamsError) errorType() string {
+	return "MissingParams"
+}
+
+func (e *MissingParamsError) httpStatus() int {
+	return http.StatusUnprocessableEntity
+}
+
+// TemplateParseError is returned when a template, or the template for
+// its path, does not compile.
+type TemplateParseError struct {
+	Template string // The template that does not compile.
+	Message  string // What text/template said was wrong with it.
+	Contents string `json:",omitempty"` // The template, if it is useful for working out what went wrong.
+}
+
+func (e *TemplateParseError) Error() string {
+	if e.Contents == "" {
+		return fmt.Sprintf("template: %s does not compile: %s", e.Template, e.Message)
+	}
+	return fmt.Sprintf("template: %s does not compile: %s\n---template---\n %s", e.Template, e.Message, e.Contents)
+}
+
+func (e *TemplateParseError) errorType() string {
+	return "TemplateParse"
+}
+
+func (e *TemplateParseError) httpStatus() int {
+	return http.StatusUnprocessableEntity
+}
+
+// TemplateRenderError is returned when a template fails to render for
+// a machine, or its rendered output fails validation.
+type TemplateRenderError struct {
+	Template  string // The template that failed.
+	Machine   string // The machine it was being rendered for.
+	Validator string `json:",omitempty"` // The validator the output failed, if it rendered.
+	Message   string // What went wrong.
+}
+
+func (e *TemplateRenderError) Error() string {
+	if e.Validator != "" {
+		return fmt.Sprintf("template: Rendered template %s for %s failed %s validation: %s",
+			e.Template,
+			e.Machine,
+			e.Validator,
+			e.Message)
+	}
+	return fmt.Sprintf("template: Error rendering template %s for %s: %s", e.Template, e.Machine, e.Message)
+}
+
+func (e *TemplateRenderError) errorType() string {
+	return "TemplateRender"
+}
+
+func (e *TemplateRenderError) httpStatus() int {
+	return http.StatusUnprocessableEntity
+}
+
+// DownloadError is returned when an ISO or file cannot be downloaded.
+type DownloadError struct {
+	URL        string // What we were trying to download.
+	StatusCode int    `json:",omitempty"` // The HTTP status the server returned, if it got that far.
+	Attempts   int    `json:",omitempty"` // How many times we tried, if more than once.
+	Message    string // What went wrong.
+}
+
+func (e *DownloadError) Error() string {
+	if e.Attempts > 1 {
+		return fmt.Sprintf("download: Giving up on %s after %d attempts: %s", e.URL, e.Attempts, e.Message)
+	}
+	return fmt.Sprintf("download: %s: %s", e.URL, e.Message)
+}
+
+func (e *DownloadError) errorType() string {
+	return "Download"
+}
+
+func (e *DownloadError) httpStatus() int {
+	return http.StatusBadGateway
+}
+
+// MirrorFailure is what went wrong downloading a file from one of the
+// URLs in a MirrorsError.
+type MirrorFailure struct {
+	URL     string // The URL that failed.
+	Code    string `json:",omitempty"` // The Type of the error, if it was a typed error.
+	Message string // What went wrong.
+	// The details of the error, if it was a typed error.
+	Details interface{} `json:",omitempty"`
+	err     error
+}
+
+func newMirrorFailure(url string, err error) *MirrorFailure {
+	res := &MirrorFailure{URL: url, Message: err.Error(), err: err}
+	if e, ok := err.(typedError); ok {
+		res.Code = e.errorType()
+		res.Details = e
+	}
+	return res
+}
+
+// MirrorsError is returned when a file with Mirrors cannot be
+// downloaded from any of them.  It keeps what went wrong with each of
+// them, so that a bad checksum or signature is not mistaken for a
+// download that could work if it were tried again.
+type MirrorsError struct {
+	File     string           // The name of the file.
+	Attempts int              `json:",omitempty"` // How many times every mirror was tried, if more than once.
+	Failures []*MirrorFailure // What went wrong with each of the URLs, in the order they were tried.
+}
+
+func (e *MirrorsError) Error() string {
+	failures := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		failures[i] = fmt.Sprintf("%s: %s", f.URL, f.Message)
+	}
+	if e.Attempts > 1 {
+		return fmt.Sprintf("download: Giving up on %s after %d attempts at every mirror:\n%s", e.File, e.Attempts, strings.Join(failures, "\n"))
+	}
+	return fmt.Sprintf("download: Failed to download %s from every mirror:\n%s", e.File, strings.Join(failures, "\n"))
+}
+
+func (e *MirrorsError) errorType() string {
+	return "Mirrors"
+}
+
+func (e *MirrorsError) httpStatus() int {
+	return http.StatusBadGateway
+}
+
+// FilesError is returned when some of the files of a boot environment
+// could not be fetched.  It reports what happened to all of them, so
+// that it is clear which ones need fixing.
+type FilesError struct {
+	BootEnv string        // The boot environment the files are for.
+	Failed  int           // How many of the files failed.
+	Files   []*FileResult // What happened to each of the files.
+}
+
+func (e *FilesError) Error() string {
+	failures := []string{}
+	for _, f := range e.Files {
+		if f.Status == fileFailed {
+			failures = append(failures, fmt.Sprintf("%s: %s", f.Name, f.Error))
+		}
+	}
+	return fmt.Sprintf("bootenv: Failed to fetch %d of %d files for %s:\n%s",
+		e.Failed,
+		len(e.Files),
+		e.BootEnv,
+		strings.Join(failures, "\n"))
+}
+
+func (e *FilesError) errorType() string {
+	return "Files"
+}
+
+func (e *FilesError) httpStatus() int {
+	return http.StatusBadGateway
+}
+
+// ChecksumMismatchError is returned when an ISO or file on disk does
+// not match the checksum it is supposed to have.
+type ChecksumMismatchError struct {
+	Path     string // The file that was checked.
+	Expected string // The checksum it should have.
+	Actual   string // The checksum it does have.
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum: Checksum mismatch for %s: actual: %s expected: %s", e.Path, e.Actual, e.Expected)
+}
+
+func (e *ChecksumMismatchError) errorType() string {
+	return "ChecksumMismatch"
+}
+
+func (e *ChecksumMismatchError) httpStatus() int {
+	return http.StatusUnprocessableEntity
+}
+
+// SignatureMismatchError is returned when a file is not signed by a
+// key in the keyring it is supposed to be checked with.
+type SignatureMismatchError struct {
+	File    string // The name of the file that was checked.
+	Message string // What gpgv had to say about it.
+}
+
+func (e *SignatureMismatchError) Error() string {
+	return fmt.Sprintf("file: Bad signature on %s: %s", e.File, e.Message)
+}
+
+func (e *SignatureMismatchError) errorType() string {
+	return "SignatureMismatch"
+}
+
+func (e *SignatureMismatchError) httpStatus() int {
+	return http.StatusUnprocessableEntity
+}
+
+// InsufficientSpaceError is returned when there is not enough free
+// space to download or explode something.
+type InsufficientSpaceError struct {
+	Path      string // Where the space is needed.
+	Required  uint64 // How many bytes are needed, including the margin.
+	Available uint64 // How many bytes are free.
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("disk: Insufficient disk space for %s: %d bytes required, %d bytes available", e.Path, e.Required, e.Available)
+}
+
+func (e *InsufficientSpaceError) errorType() string {
+	return "InsufficientSpace"
+}
+
+func (e *InsufficientSpaceError) httpStatus() int {
+	return http.StatusInsufficientStorage
+}
+
+// MachineFailure is what went wrong for one of the machines in a
+// RendersError.
+type MachineFailure struct {
+	Machine string // The machine that failed.
+	Code    string `json:",omitempty"` // The Type of the error, if it was a typed error.
+	Message string // What went wrong.
+	// The details of the error, if it was a typed error.
+	Details interface{} `json:",omitempty"`
+	err     error
+}
+
+func newMachineFailure(machine string, err error) *MachineFailure {
+	res := &MachineFailure{Machine: machine, Message: err.Error(), err: err}
+	if e, ok := err.(typedError); ok {
+		res.Code = e.errorType()
+		res.Details = e
+	}
+	return res
+}
+
+func (f *MachineFailure) String() string {
+	return fmt.Sprintf("%s: %s", f.Machine, f.Message)
+}
+
+type machineFailuresByName []*MachineFailure
+
+func (m machineFailuresByName) Len() int           { return len(m) }
+func (m machineFailuresByName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m machineFailuresByName) Less(i, j int) bool { return m[i].Machine < m[j].Machine }
+
+// RendersError is returned when some of the machines of a boot
+// environment fail to render.  It keeps what went wrong for each of
+// them, so that typed errors like MissingParams are not lost.
+type RendersError struct {
+	BootEnv  string // The boot environment being rendered.
+	Machines int    // How many machines were being rendered.
+	Rendered int    // How many of them were rendered.
+	// Set if nothing was written because some of the machines failed
+	// to render first, with --render-validate-first.
+	Aborted  bool              `json:",omitempty"`
+	Failures []*MachineFailure // What went wrong for each machine that failed.
+}
+
+func (e *RendersError) Error() string {
+	failures := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		failures[i] = f.String()
+	}
+	if e.Aborted {
+		return fmt.Sprintf("bootenv: Not rendering any machines for %s, %d of %d failed to render, failures:\n%s",
+			e.BootEnv,
+			len(e.Failures),
+			e.Machines,
+			strings.Join(failures, "\n"))
+	}
+	return fmt.Sprintf("bootenv: Rendered %d of %d machines for %s, failures:\n%s",
+		e.Rendered,
+		e.Machines,
+		e.BootEnv,
+		strings.Join(failures, "\n"))
+}
+
+func (e *RendersError) errorType() string {
+	return "Renders"
+}
+
+// httpStatus is the status the failures have in common, if they are
+// all typed errors with the same one, and 409 otherwise.
+func (e *RendersError) httpStatus() int {
+	status := 0
+	for _, f := range e.Failures {
+		typed, ok := f.err.(typedError)
+		if !ok || (status != 0 && typed.httpStatus() != status) {
+			return http.StatusConflict
+		}
+		status = typed.httpStatus()
+	}
+	if status == 0 {
+		return http.StatusConflict
+	}
+	return status
+}
+
+// BackendError is returned when the backend cannot be talked to.
+type BackendError struct {
+	Key     string // The key that was being saved, loaded, or deleted.
+	Message string // What went wrong.
+}
+
+func (e *BackendError) Error() string {
+	return fmt.Sprintf("consul: %s: %s", e.Key, e.Message)
+}
+
+func (e *BackendError) errorType() string {
+	return "Backend"
+}
+
+func (e *BackendError) httpStatus() int {
+	return http.StatusServiceUnavailable
+}
+
+// RebarError is returned when something was saved, but Rebar could not
+// be told about it.
+type RebarError struct {
+	Key     string // The thing that was saved.
+	Message string // What went wrong.
+}
+
+func (e *RebarError) Error() string {
+	return fmt.Sprintf("rebar: Failed to update Rebar after saving %s: %s", e.Key, e.Message)
+}
+
+func (e *RebarError) errorType() string {
+	return "Rebar"
 }
 
-func NewError(s string) *pkgError {
-	return &pkgError{Message: s}
+func (e *RebarError) httpStatus() int {
+	return http.StatusBadGateway
 }
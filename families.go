@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+)
+
+// OsFamily holds the default templates for all of the boot
+// environments whose OS is in the family.  A boot environment
+// inherits all of the templates of its family, except for the ones
+// it overrides by having a template with the same name.
+type OsFamily struct {
+	Name      string          // The name of the family.  Matches OsInfo.Family.
+	Templates []*TemplateInfo // The default templates for the family.
+}
+
+func (f *OsFamily) prefix() string {
+	return "families"
+}
+
+func (f *OsFamily) key() string {
+	return path.Join(f.prefix(), f.Name)
+}
+
+func (f *OsFamily) newIsh() keySaver {
+	res := &OsFamily{Name: f.Name}
+	return keySaver(res)
+}
+
+func (f *OsFamily) onChange(oldThing interface{}) error {
+	if f.Name == "" {
+		return errors.New("family: Missing name")
+	}
+	for _, tmpl := range f.Templates {
+		if tmpl.Name == "" ||
+			tmpl.Path == "" ||
+			tmpl.UUID == "" {
+			return fmt.Errorf("family: Illegal template: %+v", tmpl)
+		}
+		if err := tmpl.check("family"); err != nil {
+			return err
+		}
+		if _, err := loadTemplate(tmpl.UUID); err != nil {
+			return fmt.Errorf("family: Error loading template %s for %s: %v", tmpl.UUID, tmpl.Name, err)
+		}
+	}
+	old, ok := oldThing.(*OsFamily)
+	if !ok || old == nil {
+		return nil
+	}
+	if old.Name != f.Name {
+		return errors.New("family: Cannot change name of family")
+	}
+	bootEnv := &BootEnv{}
+	bootEnvs, err := bootEnv.ListFamily(f.Name)
+	if err != nil {
+		return err
+	}
+	machine := &Machine{}
+	machines, err := machine.List()
+	if err != nil {
+		return err
+	}
+	toRender := make([][]*Machine, len(bootEnvs))
+	for i, bootEnv := range bootEnvs {
+		// We have not been saved yet, so make sure the bootenv
+		// renders with our templates instead of the old ones.
+		bootEnv.family = f
+		all := []*Machine{}
+		for _, machine := range machines {
+			if machine.BootEnv == bootEnv.Name {
+				all = append(all, machine)
+			}
+		}
+		toRender[i] = bootEnv.activeMachines(all)
+	}
+	// Make sure every machine of every bootenv renders before writing
+	// anything, if asked to.
+	if renderValidateFirst {
+		for i, bootEnv := range bootEnvs {
+			if err := bootEnv.checkRenders(context.Background(), toRender[i]); err != nil {
+				return err
+			}
+		}
+	}
+	for i, bootEnv := range bootEnvs {
+		if err := bootEnv.writeRenders(context.Background(), toRender[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *OsFamily) onDelete() error {
+	bootEnv := &BootEnv{}
+	bootEnvs, err := bootEnv.ListFamily(f.Name)
+	if err != nil {
+		return err
+	}
+	if len(bootEnvs) > 0 {
+		return fmt.Errorf("family: %s in use by bootenv %s", f.Name, bootEnvs[0].Name)
+	}
+	return nil
+}
+
+func (f *OsFamily) List() ([]*OsFamily, error) {
+	things := backend.list(f)
+	res := make([]*OsFamily, len(things))
+	for i, blob := range things {
+		family := &OsFamily{}
+		if err := decodeThing(blob, family); err != nil {
+			return nil, err
+		}
+		res[i] = family
+	}
+	return res, nil
+}
+
+func (f *OsFamily) RebuildRebarData() error {
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// fileMode is a flag.Value for permission bits written in octal.
+type fileMode os.FileMode
+
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+func (m *fileMode) Set(s string) error {
+	mode, err := parseFileMode(s)
+	if err != nil {
+		return err
+	}
+	*m = fileMode(mode)
+	return nil
+}
+
+// parseFileMode parses permission bits written in octal, like "0775".
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not an octal file mode", s)
+	}
+	if mode&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("%s has bits set other than permission bits", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// dirModeFor returns the mode that directories should be created
+// with.  override takes precedence over --dir-mode if it is set.
+func dirModeFor(override string) (os.FileMode, error) {
+	if override == "" {
+		return os.FileMode(dirMode), nil
+	}
+	return parseFileMode(override)
+}
+
+// makeDirs creates dir along with any missing parents, and gives all
+// of the directories it creates mode.  Unlike os.MkdirAll, the mode is
+// not subject to the umask, so that directories can be created
+// group-writable.  Directories that already exist are left alone.
+func makeDirs(dir string, mode os.FileMode) error {
+	missing := []string{}
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		}
+		missing = append(missing, d)
+		if d == filepath.Dir(d) {
+			break
+		}
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+	for _, d := range missing {
+		if err := os.Chmod(d, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// optionalFileMode is a fileMode flag that can be left unset.
+type optionalFileMode struct {
+	mode os.FileMode
+	set  bool
+}
+
+func (m *optionalFileMode) String() string {
+	if !m.set {
+		return ""
+	}
+	return fmt.Sprintf("%#o", uint32(m.mode))
+}
+
+func (m *optionalFileMode) Set(s string) error {
+	mode, err := parseFileMode(s)
+	if err != nil {
+		return err
+	}
+	m.mode, m.set = mode, true
+	return nil
+}
+
+// fileOwner is a flag.Value for the owner of files, written as user
+// or user:group.  Users and groups can be names or numeric IDs.  If
+// the group is left out, the primary group of the user is used.
+type fileOwner struct {
+	spec     string
+	uid, gid int
+}
+
+func (o *fileOwner) String() string {
+	return o.spec
+}
+
+func (o *fileOwner) Set(s string) error {
+	userName, groupName := s, ""
+	if idx := strings.Index(s, ":"); idx != -1 {
+		userName, groupName = s[:idx], s[idx+1:]
+	}
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return fmt.Errorf("Unknown user %s", userName)
+		}
+	}
+	gid := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return fmt.Errorf("Unknown group %s", groupName)
+			}
+		}
+		gid = g.Gid
+	}
+	if o.uid, err = strconv.Atoi(u.Uid); err != nil {
+		return err
+	}
+	if o.gid, err = strconv.Atoi(gid); err != nil {
+		return err
+	}
+	o.spec = s
+	return nil
+}
+
+// fixTreePerms gives everything under root the --explode-owner, and
+// the modes it would have had if it had been created with
+// --explode-umask, if they are set.  Directories and executable files
+// get 0777 minus the umask, and other files get 0666 minus the umask.
+func fixTreePerms(root string) error {
+	if explodeOwner.spec == "" && !explodeUmask.set {
+		return nil
+	}
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if explodeOwner.spec != "" {
+			if err := os.Lchown(p, explodeOwner.uid, explodeOwner.gid); err != nil {
+				return err
+			}
+		}
+		if !explodeUmask.set || info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		mode := os.FileMode(0666)
+		if info.IsDir() || info.Mode()&0111 != 0 {
+			mode = 0777
+		}
+		return os.Chmod(p, mode&^explodeUmask.mode)
+	})
+}
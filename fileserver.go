@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// etagFor returns the ETag for content with the given SHA256.
+func etagFor(sha string) string {
+	return `"` + sha + `"`
+}
+
+// etagMatches reports whether the If-None-Match header ifNoneMatch
+// names etag, so that the client already has it.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// etagForFile returns the ETag of the file that info describes.  It is
+// made from the inode, size, and modification time of the file rather
+// than its contents, so that serving a large ISO does not mean reading
+// all of it first.  Files are replaced by renaming new ones into place,
+// which changes the inode even if the size and time happen to match.
+func etagForFile(info os.FileInfo) string {
+	var ino uint64
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		ino = uint64(st.Ino)
+	}
+	return fmt.Sprintf(`"%x-%x-%x"`, ino, info.Size(), info.ModTime().UnixNano())
+}
+
+// staticFileHandler serves everything under the file root, laid out
+// the same way PathFor "http" builds URLs, so that small deployments
+// do not need a separate web server.  Range requests are honored, so
+// installers can resume large downloads.  Anything with a path segment
+// starting with a dot, such as the staging directory or saved cache
+// validators, is kept private.  Files are served with an ETag, and
+// conditional GETs for files that have not changed get a 304.
+func staticFileHandler() http.Handler {
+	files := http.FileServer(http.Dir(fileRoot))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		for _, part := range strings.Split(r.URL.Path, "/") {
+			if strings.HasPrefix(part, ".") {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		filePath := filepath.Join(fileRoot, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+		if info, err := os.Stat(filePath); err == nil && info.Mode().IsRegular() {
+			// ServeContent answers If-None-Match with a 304 once
+			// the ETag is set.
+			w.Header().Set("ETag", etagForFile(info))
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// serveFiles serves the file root over plain HTTP on port, forever.
+// Machines fetching install media do not have client certificates,
+// so this cannot share the API's listener.
+func serveFiles(port int64) error {
+	logger.Printf("files: Serving %s over HTTP on port %d\n", fileRoot, port)
+	s := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: staticFileHandler(),
+	}
+	return s.ListenAndServe()
+}
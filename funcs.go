@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// fetchTimeout is how long the fetch helper waits for a URL before
+// giving up on it.
+const fetchTimeout = 30 * time.Second
+
+// templateFunc is a helper function that templates can call.
+type templateFunc struct {
+	fn interface{}
+	// dangerous functions reach outside of the provisioner, and are
+	// disabled when --template-sandbox is set.
+	dangerous bool
+	// enabled, if set, says whether the function has been turned on.
+	// Functions that are not turned on are forbidden.
+	enabled func() bool
+}
+
+// templateFuncs are all of the helper functions available to
+// templates, subject to the function policy.
+var templateFuncs = map[string]*templateFunc{
+	"join":      {fn: strings.Join},
+	"split":     {fn: strings.Split},
+	"contains":  {fn: strings.Contains},
+	"hasPrefix": {fn: strings.HasPrefix},
+	"hasSuffix": {fn: strings.HasSuffix},
+	"trim":      {fn: strings.TrimSpace},
+	"lower":     {fn: strings.ToLower},
+	"upper":     {fn: strings.ToUpper},
+	"replace": {fn: func(s, old, new string) string {
+		return strings.Replace(s, old, new, -1)
+	}},
+	"fetch": {fn: fetchURL, dangerous: true, enabled: func() bool {
+		return templateFetchHosts != ""
+	}},
+	"toJson":       {fn: toJSON},
+	"toPrettyJson": {fn: toPrettyJSON},
+}
+
+// marshalJSON serializes v without escaping HTML characters, since
+// templates do not render into HTML.
+func marshalJSON(v interface{}, indent string) (string, error) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", indent)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// toJSON serializes v as compact JSON.
+func toJSON(v interface{}) (string, error) {
+	return marshalJSON(v, "")
+}
+
+// toPrettyJSON serializes v as JSON indented with two spaces.
+func toPrettyJSON(v interface{}) (string, error) {
+	return marshalJSON(v, "  ")
+}
+
+// fetchHostAllowed checks to see if --template-fetch-hosts lets the
+// fetch helper get things from u.
+func fetchHostAllowed(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range strings.Split(templateFetchHosts, ",") {
+		if strings.ToLower(strings.TrimSpace(allowed)) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchURL returns the body of whatever is at rawURL, which must be on
+// one of the hosts in --template-fetch-hosts.  Redirects are only
+// followed to those hosts as well.
+func fetchURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("fetch: Invalid URL %s: %v", rawURL, err)
+	}
+	if !fetchHostAllowed(u) {
+		return "", fmt.Errorf("fetch: %s is not on a host in --template-fetch-hosts", rawURL)
+	}
+	client := *httpClient
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if !fetchHostAllowed(req.URL) {
+			return fmt.Errorf("redirect to %s is not on a host in --template-fetch-hosts", req.URL)
+		}
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetch: %s returned %s", rawURL, resp.Status)
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// templateFuncAllowed checks to see if the function policy lets
+// templates call the named helper function.
+func templateFuncAllowed(name string) bool {
+	fn, ok := templateFuncs[name]
+	if !ok {
+		return true
+	}
+	if templateSandbox && fn.dangerous {
+		return false
+	}
+	if fn.enabled != nil && !fn.enabled() {
+		return false
+	}
+	for _, denied := range strings.Split(templateDenyFuncs, ",") {
+		if strings.TrimSpace(denied) == name {
+			return false
+		}
+	}
+	return true
+}
+
+func templateFuncMap() template.FuncMap {
+	res := template.FuncMap{}
+	for name, fn := range templateFuncs {
+		res[name] = fn.fn
+	}
+	return res
+}
+
+// checkTemplateFuncs makes sure that tmpl does not call any helper
+// functions forbidden by the function policy.
+func checkTemplateFuncs(tmpl *template.Template) error {
+	var err error
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		walkTemplate(t.Tree.Root, func(node parse.Node) {
+			ident, ok := node.(*parse.IdentifierNode)
+			if !ok || err != nil || templateFuncAllowed(ident.Ident) {
+				return
+			}
+			location, _ := t.Tree.ErrorContext(node)
+			err = fmt.Errorf("template: %s: function %s is forbidden by the template function policy",
+				location,
+				ident.Ident)
+		})
+	}
+	return err
+}
+
+// newTemplate compiles text into a template with the helper
+// functions the function policy allows.
+func newTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncMap()).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTemplateFuncs(tmpl); err != nil {
+		return nil, err
+	}
+	return tmpl.Option("missingkey=error"), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+)
+
+// GlobalParam is a param that global templates are rendered with.
+// Global templates have no machine to take params from, so they use
+// these instead.
+type GlobalParam struct {
+	Name     string      // The name of the global param.
+	Value    interface{} // The value of the global param.
+	oldPaths map[string]string
+}
+
+func (p *GlobalParam) prefix() string {
+	return "global-params"
+}
+
+func (p *GlobalParam) key() string {
+	return path.Join(p.prefix(), p.Name)
+}
+
+func (p *GlobalParam) newIsh() keySaver {
+	res := &GlobalParam{Name: p.Name}
+	return keySaver(res)
+}
+
+func (p *GlobalParam) onChange(oldThing interface{}) error {
+	if p.Name == "" {
+		return fmt.Errorf("global-param: Illegal global param %+v", p)
+	}
+	old, _ := oldThing.(*GlobalParam)
+	if old != nil && old.Name != p.Name {
+		return errors.New("global-param: Cannot change name of global param")
+	}
+	oldPaths, err := globalTemplatePaths()
+	if err != nil {
+		return err
+	}
+	p.oldPaths = oldPaths
+	return nil
+}
+
+// afterSave renders the global templates again with the new value.
+func (p *GlobalParam) afterSave(oldThing interface{}) error {
+	return renderGlobalTemplates(p.oldPaths)
+}
+
+func (p *GlobalParam) onDelete() error {
+	oldPaths, err := globalTemplatePaths()
+	if err != nil {
+		return err
+	}
+	p.oldPaths = oldPaths
+	return nil
+}
+
+// afterRemove renders the global templates again without the param.
+func (p *GlobalParam) afterRemove() error {
+	return renderGlobalTemplates(p.oldPaths)
+}
+
+func (p *GlobalParam) List() ([]*GlobalParam, error) {
+	things := backend.list(p)
+	res := make([]*GlobalParam, len(things))
+	for i, blob := range things {
+		globalParam := &GlobalParam{}
+		if err := decodeThing(blob, globalParam); err != nil {
+			return nil, err
+		}
+		res[i] = globalParam
+	}
+	return res, nil
+}
+
+func (p *GlobalParam) RebuildRebarData() error {
+	return nil
+}
+
+// globalParams returns the values of the global params, by name.
+func globalParams() (map[string]interface{}, error) {
+	params, err := (&GlobalParam{}).List()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]interface{}, len(params))
+	for _, p := range params {
+		res[p.Name] = p.Value
+	}
+	return res, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+)
+
+// GlobalTemplate is a template that is rendered once for the whole
+// provisioner rather than once per machine, for files like a shared
+// PXE default config or an iPXE bootstrap script.
+type GlobalTemplate struct {
+	Name    string // The name of the global template.
+	Path    string // A template for where to write the rendered file, relative to the file root.
+	UUID    string // The UUID of the Template to render.
+	DirMode string `json:",omitempty"` // The mode to create missing directories with, in octal.  Defaults to --dir-mode.
+}
+
+// GlobalRenderData is what global templates are rendered with.  Unlike
+// RenderData, there is no machine or boot environment.
+type GlobalRenderData struct {
+	Name           string // The name of the global template being rendered.
+	ProvisionerURL string // The URL to the provisioner that all files should be fetched from
+	CommandURL     string // The URL of the API endpoint that machines should talk to for command and control
+	FileURL        string // The base URL files under the file root are served over HTTP from.
+	TftpServer     string // The host files under the file root are served over TFTP from.
+	// The values of the global params, by name.
+	Params map[string]interface{}
+}
+
+// Param is a helper function for extracting a global param.
+func (g *GlobalRenderData) Param(key string) (interface{}, error) {
+	res, ok := g.Params[key]
+	if !ok {
+		return nil, fmt.Errorf("No such global parameter %s", key)
+	}
+	return res, nil
+}
+
+// ParamPath is a helper function that returns a nested global param,
+// the same way as it does for machine templates.
+func (g *GlobalRenderData) ParamPath(keyPath string) (interface{}, error) {
+	res, ok := paramAt(g.Params, keyPath)
+	if !ok {
+		return nil, fmt.Errorf("No such global parameter %s", keyPath)
+	}
+	return res, nil
+}
+
+// ParamExists is a helper function that checks to see if there is a
+// global param at keyPath.
+func (g *GlobalRenderData) ParamExists(keyPath string) bool {
+	_, err := g.ParamPath(keyPath)
+	return err == nil
+}
+
+// ParamDefault is a helper function that returns the global param at
+// keyPath, or def if there is none.
+func (g *GlobalRenderData) ParamDefault(keyPath string, def interface{}) interface{} {
+	res, err := g.ParamPath(keyPath)
+	if err != nil {
+		return def
+	}
+	return res
+}
+
+func (g *GlobalTemplate) prefix() string {
+	return "global-templates"
+}
+
+func (g *GlobalTemplate) key() string {
+	return path.Join(g.prefix(), g.Name)
+}
+
+func (g *GlobalTemplate) newIsh() keySaver {
+	res := &GlobalTemplate{Name: g.Name}
+	return keySaver(res)
+}
+
+func (g *GlobalTemplate) renderData() (*GlobalRenderData, error) {
+	params, err := globalParams()
+	if err != nil {
+		return nil, err
+	}
+	return &GlobalRenderData{
+		Name:           g.Name,
+		ProvisionerURL: provisionerURL,
+		CommandURL:     commandURL,
+		FileURL:        fileServerURL(),
+		TftpServer:     tftpServer(),
+		Params:         params,
+	}, nil
+}
+
+// finalPath works out where the global template is rendered to.
+func (g *GlobalTemplate) finalPath() (string, error) {
+	pathTmpl, err := newTemplate(g.Name+".Path", g.Path)
+	if err != nil {
+		return "", &TemplateParseError{Template: g.Name + ".Path", Message: err.Error(), Contents: g.Path}
+	}
+	vars, err := g.renderData()
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err := pathTmpl.Execute(buf, vars); err != nil {
+		return "", fmt.Errorf("global-template: Error rendering path %s (%s): %v", g.Name, g.Path, err)
+	}
+	res, err := renderedPath(buf.String())
+	if err != nil {
+		return "", fmt.Errorf("global-template: Bad path for %s (%s): %v", g.Name, g.Path, err)
+	}
+	return res, nil
+}
+
+// render renders tmpl, which is the template of the global template,
+// and writes it out.  It returns where it was written.
+func (g *GlobalTemplate) render(tmpl *Template) (string, error) {
+	finalPath, err := g.finalPath()
+	if err != nil {
+		return "", err
+	}
+	mode, err := dirModeFor(g.DirMode)
+	if err != nil {
+		return "", err
+	}
+	vars, err := g.renderData()
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Render(buf, vars); err != nil {
+		return "", &TemplateRenderError{Template: g.Name, Message: err.Error()}
+	}
+	if err := writeFile(finalPath, buf.Bytes(), mode); err != nil {
+		return "", err
+	}
+	return finalPath, nil
+}
+
+func (g *GlobalTemplate) onChange(oldThing interface{}) error {
+	if g.Name == "" || g.Path == "" || g.UUID == "" {
+		return fmt.Errorf("global-template: Illegal global template %+v", g)
+	}
+	if _, err := dirModeFor(g.DirMode); err != nil {
+		return fmt.Errorf("global-template: Invalid DirMode for %s: %v", g.Name, err)
+	}
+	old, _ := oldThing.(*GlobalTemplate)
+	if old != nil && old.Name != g.Name {
+		return errors.New("global-template: Cannot change name of global template")
+	}
+	if _, err := g.template(); err != nil {
+		return err
+	}
+	_, err := g.finalPath()
+	return err
+}
+
+// template loads the template the global template renders.
+func (g *GlobalTemplate) template() (*Template, error) {
+	tmpl, err := loadTemplate(g.UUID)
+	if err != nil {
+		return nil, fmt.Errorf("global-template: Error loading template %s for %s: %v", g.UUID, g.Name, err)
+	}
+	return tmpl, nil
+}
+
+// afterSave renders the global template, and removes the file it was
+// rendered to before if its path changed.
+func (g *GlobalTemplate) afterSave(oldThing interface{}) error {
+	tmpl, err := g.template()
+	if err != nil {
+		return err
+	}
+	finalPath, err := g.render(tmpl)
+	if err != nil {
+		return err
+	}
+	if old, _ := oldThing.(*GlobalTemplate); old != nil {
+		if oldPath, err := old.finalPath(); err == nil && oldPath != finalPath {
+			os.Remove(oldPath)
+		}
+	}
+	return nil
+}
+
+func (g *GlobalTemplate) onDelete() error {
+	if finalPath, err := g.finalPath(); err == nil {
+		os.Remove(finalPath)
+	}
+	return nil
+}
+
+func (g *GlobalTemplate) List() ([]*GlobalTemplate, error) {
+	things := backend.list(g)
+	res := make([]*GlobalTemplate, len(things))
+	for i, blob := range things {
+		globalTemplate := &GlobalTemplate{}
+		if err := decodeThing(blob, globalTemplate); err != nil {
+			return nil, err
+		}
+		res[i] = globalTemplate
+	}
+	return res, nil
+}
+
+func (g *GlobalTemplate) RebuildRebarData() error {
+	return nil
+}
+
+// renderGlobalTemplatesUsing renders every global template that uses
+// tmpl again, since tmpl has been saved with new contents.
+func renderGlobalTemplatesUsing(tmpl *Template) error {
+	globalTemplates, err := (&GlobalTemplate{}).List()
+	if err != nil {
+		return err
+	}
+	for _, g := range globalTemplates {
+		if g.UUID != tmpl.UUID {
+			continue
+		}
+		if _, err := g.render(tmpl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// globalTemplatePaths returns where each global template is rendered
+// to now, by name, leaving out the ones whose paths do not render.
+func globalTemplatePaths() (map[string]string, error) {
+	globalTemplates, err := (&GlobalTemplate{}).List()
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]string{}
+	for _, g := range globalTemplates {
+		if finalPath, err := g.finalPath(); err == nil {
+			res[g.Name] = finalPath
+		}
+	}
+	return res, nil
+}
+
+// renderGlobalTemplates renders every global template again, since
+// the global params they are rendered with have changed.  oldPaths
+// are where they were rendered to before, as from
+// globalTemplatePaths, and the files at them are removed if the
+// global templates are now rendered somewhere else.
+func renderGlobalTemplates(oldPaths map[string]string) error {
+	globalTemplates, err := (&GlobalTemplate{}).List()
+	if err != nil {
+		return err
+	}
+	for _, g := range globalTemplates {
+		tmpl, err := g.template()
+		if err != nil {
+			return err
+		}
+		finalPath, err := g.render(tmpl)
+		if err != nil {
+			return err
+		}
+		if oldPath, ok := oldPaths[g.Name]; ok && oldPath != finalPath {
+			os.Remove(oldPath)
+		}
+	}
+	return nil
+}
+
+// globalTemplateUsing returns the name of a global template that uses
+// the template with uuid, or "" if none do.
+func globalTemplateUsing(uuid string) (string, error) {
+	globalTemplates, err := (&GlobalTemplate{}).List()
+	if err != nil {
+		return "", err
+	}
+	for _, g := range globalTemplates {
+		if g.UUID == uuid {
+			return g.Name, nil
+		}
+	}
+	return "", nil
+}
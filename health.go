@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// explodeScript is the script that explodes ISOs into install trees.
+const explodeScript = "/explode_iso.sh"
+
+// checkExplodeTool makes sure the script that explodes ISOs is there
+// and can be run, so that a broken install fails loudly up front
+// instead of every install bootenv failing when it is saved.
+func checkExplodeTool() error {
+	info, err := os.Stat(explodeScript)
+	if err != nil {
+		return fmt.Errorf("iso: Cannot explode ISOs: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("iso: Cannot explode ISOs: %s is not a file", explodeScript)
+	}
+	if info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("iso: Cannot explode ISOs: %s is not executable", explodeScript)
+	}
+	return nil
+}
+
+// checkExploder makes sure that ISOs can be exploded.  They can always
+// be extracted natively, so explodeScript is only needed if
+// --explode-native is off.
+func checkExploder() error {
+	if explodeNative {
+		return nil
+	}
+	return checkExplodeTool()
+}
+
+// HealthCheck is the result of one of the checks the provisioner
+// needs to pass to do its job.
+type HealthCheck struct {
+	Name    string
+	OK      bool
+	Message string `json:",omitempty"` // What is wrong, if it is not OK.
+}
+
+// Health reports whether the provisioner is ready to do its job.
+type Health struct {
+	Ready  bool // Whether all of the Checks are OK.
+	Checks []*HealthCheck
+}
+
+// checkHealth runs all of the health checks.
+func checkHealth() *Health {
+	res := &Health{Ready: true, Checks: []*HealthCheck{}}
+	checks := []struct {
+		name  string
+		check func() error
+	}{
+		{"explode-iso", checkExploder},
+	}
+	for _, c := range checks {
+		check := &HealthCheck{Name: c.name, OK: true}
+		if err := c.check(); err != nil {
+			check.OK = false
+			check.Message = err.Error()
+			res.Ready = false
+		}
+		res.Checks = append(res.Checks, check)
+	}
+	return res
+}
+
+// logHealth logs any health checks that fail at startup.  They are not
+// fatal, since local bootenvs and machines work without them.
+func logHealth() {
+	for _, check := range checkHealth().Checks {
+		if !check.OK {
+			logger.Printf("health: %s check failed: %s\n", check.Name, check.Message)
+		}
+	}
+}
+
+func getHealth(c *gin.Context) {
+	res := checkHealth()
+	status := http.StatusOK
+	if !res.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, res)
+}
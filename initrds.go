@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+// The ways the initrds of a boot environment can be combined into a
+// single initrd.
+const (
+	// initrdConcat just concatenates the initrds.  The kernel can
+	// unpack concatenated archives, no matter how each is compressed.
+	initrdConcat = "concat"
+	// initrdGzip and initrdXz decompress each of the initrds and
+	// recompress all of them together.  Each initrd must be a single
+	// cpio archive that is either uncompressed, gzipped, or xzed.
+	initrdGzip = "gzip"
+	initrdXz   = "xz"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// combinedInitrdName is the partial path of the combined initrd for
+// the boot environment.
+func (b *BootEnv) combinedInitrdName() string {
+	return "." + b.Name + ".combined_initrd"
+}
+
+// initrdStamp identifies the current contents of the initrds of the
+// boot environment and how they should be combined, so that we can
+// tell when the combined initrd needs to be regenerated.
+func (b *BootEnv) initrdStamp() (string, error) {
+	hasher := sha256.New()
+	fmt.Fprintf(hasher, "%s\n", b.CombineInitrds)
+	for _, initrd := range b.Initrds {
+		filePath, err := b.PathFor("disk", initrd)
+		if err != nil {
+			return "", err
+		}
+		stat, err := os.Stat(filePath)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hasher, "%s %d %d\n", filePath, stat.Size(), stat.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// cmdReader reads the output of a command, and waits for the command
+// to exit when it is closed.
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (c *cmdReader) Close() error {
+	c.ReadCloser.Close()
+	return c.cmd.Wait()
+}
+
+// gzipFileReader reads a gzipped file, and closes the file when it
+// is closed.
+type gzipFileReader struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipFileReader) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// openDecompressed returns the uncompressed contents of the file at
+// filePath, which can be gzipped, xzed, or not compressed at all.  It
+// is used for initrds and for tarballs exploded like ISOs.
+func openDecompressed(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	magic, _ := bufio.NewReader(f).Peek(len(xzMagic))
+	if _, err := f.Seek(0, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("decompress: Failed to decompress %s: %v", filePath, err)
+		}
+		return &gzipFileReader{Reader: gz, f: f}, nil
+	case bytes.HasPrefix(magic, xzMagic):
+		cmd := exec.CommandContext(ctx, "xz", "-dc")
+		cmd.Stdin = f
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("decompress: Failed to run xz to decompress %s: %v", filePath, err)
+		}
+		// The command has its own copy of the file now.
+		f.Close()
+		return &cmdReader{ReadCloser: out, cmd: cmd}, nil
+	}
+	return f, nil
+}
+
+// writeCombinedInitrd writes the combined initrds of the boot
+// environment to out.
+func (b *BootEnv) writeCombinedInitrd(ctx context.Context, out io.Writer) error {
+	var w io.WriteCloser
+	var cmd *exec.Cmd
+	switch b.CombineInitrds {
+	case initrdGzip:
+		w = gzip.NewWriter(out)
+	case initrdXz:
+		// The kernel can only check CRC32s in xz streams.
+		cmd = exec.CommandContext(ctx, "xz", "--check=crc32", "-c")
+		cmd.Stdout = out
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("initrd: Failed to run xz: %v", err)
+		}
+		// Do not leave xz behind if we bail out early.
+		defer func() {
+			if cmd.ProcessState == nil {
+				stdin.Close()
+				cmd.Wait()
+			}
+		}()
+		w = stdin
+	}
+	for _, initrd := range b.Initrds {
+		filePath, err := b.PathFor("disk", initrd)
+		if err != nil {
+			return err
+		}
+		var src io.ReadCloser
+		if b.CombineInitrds == initrdConcat {
+			src, err = os.Open(filePath)
+		} else {
+			src, err = openDecompressed(ctx, filePath)
+		}
+		if err != nil {
+			return err
+		}
+		dest := out
+		if w != nil {
+			dest = w
+		}
+		_, err = io.Copy(dest, src)
+		if closeErr := src.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("initrd: Failed to add %s: %v", filePath, err)
+		}
+	}
+	if w != nil {
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	if cmd != nil {
+		if err := cmd.Wait(); err != nil {
+			return fmt.Errorf("initrd: xz failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// combineInitrds makes sure that the combined initrd for the boot
+// environment is up to date with its initrds, if it wants one.
+func (b *BootEnv) combineInitrds(ctx context.Context) error {
+	if b.CombineInitrds == "" || len(b.Initrds) == 0 {
+		return nil
+	}
+	dest, err := b.PathFor("disk", b.combinedInitrdName())
+	if err != nil {
+		return err
+	}
+	stamp, err := b.initrdStamp()
+	if err != nil {
+		return err
+	}
+	stampPath := dest + ".stamp"
+	if oldStamp, err := ioutil.ReadFile(stampPath); err == nil && string(oldStamp) == stamp {
+		if _, err := os.Stat(dest); err == nil {
+			return nil
+		}
+	}
+	logger.Printf("initrd: Combining %d initrds for %s with %s\n", len(b.Initrds), b.Name, b.CombineInitrds)
+	tmpPath := dest + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("initrd: Unable to create %s: %v", tmpPath, err)
+	}
+	if err := b.writeCombinedInitrd(ctx, out); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	out.Sync()
+	out.Close()
+	if err := os.Rename(tmpPath, dest); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("initrd: Unable to move %s into place: %v", dest, err)
+	}
+	return ioutil.WriteFile(stampPath, []byte(stamp), 0644)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// InstallTree reports the state of the install tree an ISO is
+// exploded into, which is shared by every boot environment for the
+// same OS and arch.
+type InstallTree struct {
+	Tree      string   // The directory of the tree under the file root.
+	BootEnvs  []string // The boot environments that use the tree, sorted.
+	IsoFile   string
+	Exploded  bool   // Whether the canary marking the ISO as exploded is there.
+	Canary    string `json:",omitempty"` // Where the canary is, if it is there.
+	IsoSha256 string `json:",omitempty"` // The SHA256 of the ISO the tree was exploded from, if it was recorded.
+	// Whether the tree was exploded from an ISO other than the one
+	// the boot environments want now, so that it will be exploded
+	// again the next time one of them is saved.
+	Stale bool
+	Size  int64 // The total size of the files in the tree, in bytes.
+	Files int   // How many files are in the tree.
+}
+
+// newStagingTree makes an empty directory next to installDir to
+// explode a new install tree into, so that it can be renamed into
+// place once it is complete.
+func newStagingTree(installDir string) (string, error) {
+	parent := filepath.Dir(installDir)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", err
+	}
+	res, err := ioutil.TempDir(parent, "."+filepath.Base(installDir)+".explode-")
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chmod(res, 0755); err != nil {
+		os.RemoveAll(res)
+		return "", err
+	}
+	return res, nil
+}
+
+// swapInstallTree moves the tree exploded at stagingDir into place at
+// installDir.  Whatever was at installDir is only removed once the new
+// tree is in place, and is put back if the new tree cannot be.
+func swapInstallTree(stagingDir, installDir string) error {
+	if filepath.Clean(installDir) == filepath.Clean(fileRoot) || !pathUnder(fileRoot, installDir) {
+		return fmt.Errorf("iso: Refusing to replace %s, it is not an install tree under %s", installDir, fileRoot)
+	}
+	oldDir := ""
+	if _, err := os.Lstat(installDir); err == nil {
+		oldDir = stagingDir + ".old"
+		if err := os.Rename(installDir, oldDir); err != nil {
+			return fmt.Errorf("iso: Unable to move the old install tree %s out of the way: %v", installDir, err)
+		}
+	}
+	if err := os.Rename(stagingDir, installDir); err != nil {
+		if oldDir != "" {
+			os.Rename(oldDir, installDir)
+		}
+		return fmt.Errorf("iso: Unable to move the new install tree into place at %s: %v", installDir, err)
+	}
+	if oldDir != "" {
+		logger.Printf("Explode ISO: Removing the old install tree that was at %s\n", installDir)
+		if err := os.RemoveAll(oldDir); err != nil {
+			logger.Printf("Explode ISO: Failed to remove %s: %v\n", oldDir, err)
+		}
+	}
+	return nil
+}
+
+// treeSize adds up the sizes of the files under dir.  A tree that is
+// not there is empty.
+func treeSize(dir string) (int64, int, error) {
+	var size int64
+	files := 0
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+			files++
+		}
+		return nil
+	})
+	return size, files, err
+}
+
+// staleFor checks whether the tree was exploded from an ISO other
+// than the one b wants, which is the one it is pinned to if it is.
+func (t *InstallTree) staleFor(b *BootEnv) bool {
+	wanted := b.OS.IsoSha256
+	if b.OS.PinnedIsoSha256 != "" {
+		wanted = b.OS.PinnedIsoSha256
+	}
+	return t.IsoSha256 != "" && wanted != "" && !strings.EqualFold(t.IsoSha256, wanted)
+}
+
+// treeSiblings returns the other boot environments that share the
+// install tree of b.
+func (b *BootEnv) treeSiblings() ([]*BootEnv, error) {
+	installDir, err := b.PathFor("disk", "")
+	if err != nil {
+		return nil, err
+	}
+	bootEnvs, err := (&BootEnv{}).List()
+	if err != nil {
+		return nil, err
+	}
+	res := []*BootEnv{}
+	for _, other := range bootEnvs {
+		if other.Name == b.Name || other.OS == nil {
+			continue
+		}
+		otherDir, err := other.PathFor("disk", "")
+		if err == nil && otherDir == installDir {
+			res = append(res, other)
+		}
+	}
+	return res, nil
+}
+
+// sharedTreeUser returns the name of another boot environment that
+// shares the install tree of b and still wants it exploded from the
+// ISO with the SHA256 exploded, either because it is its IsoSha256 or
+// because it is pinned to it, or "" if there is none.
+func (b *BootEnv) sharedTreeUser(exploded string) (string, error) {
+	siblings, err := b.treeSiblings()
+	if err != nil {
+		return "", err
+	}
+	for _, other := range siblings {
+		if other.OS.IsoFile == "" || !strings.HasSuffix(other.Name, "-install") {
+			continue
+		}
+		if strings.EqualFold(other.OS.IsoSha256, exploded) || strings.EqualFold(other.OS.PinnedIsoSha256, exploded) {
+			return other.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// sharedTreeFiles returns the paths, relative to the install tree,
+// of the files that other boot environments sharing the install tree
+// of b have put in it: their Files and combined initrds.
+func (b *BootEnv) sharedTreeFiles() ([]string, error) {
+	siblings, err := b.treeSiblings()
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for _, other := range siblings {
+		for _, f := range other.OS.Files {
+			res = append(res, f.diskName())
+		}
+		if other.CombineInitrds != "" {
+			res = append(res, other.combinedInitrdName(), other.combinedInitrdName()+".stamp")
+		}
+	}
+	return res, nil
+}
+
+// keepTreeFiles links the files at paths in the install tree at
+// installDir into the new tree at stagingDir, so that they survive
+// the new tree replacing the old one.  Files that cannot be kept are
+// logged and left to be downloaded or made again.
+func keepTreeFiles(installDir, stagingDir string, paths []string) {
+	for _, p := range paths {
+		src := filepath.Join(installDir, p)
+		dest := filepath.Join(stagingDir, p)
+		if !pathUnder(installDir, src) {
+			continue
+		}
+		if info, err := os.Lstat(src); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			logger.Printf("Explode ISO: Unable to keep %s in the new install tree: %v\n", src, err)
+			continue
+		}
+		os.Remove(dest)
+		if err := os.Link(src, dest); err != nil {
+			logger.Printf("Explode ISO: Unable to keep %s in the new install tree: %v\n", src, err)
+		}
+	}
+}
+
+type installTreesByName []*InstallTree
+
+func (t installTreesByName) Len() int           { return len(t) }
+func (t installTreesByName) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t installTreesByName) Less(i, j int) bool { return t[i].Tree < t[j].Tree }
+
+// installTrees reports the state of the install tree of every boot
+// environment that explodes an ISO.
+func installTrees() ([]*InstallTree, error) {
+	bootEnvs, err := (&BootEnv{}).List()
+	if err != nil {
+		return nil, err
+	}
+	trees := map[string]*InstallTree{}
+	res := []*InstallTree{}
+	for _, b := range bootEnvs {
+		if b.OS == nil || b.OS.IsoFile == "" {
+			continue
+		}
+		installDir, err := b.PathFor("disk", "")
+		if err != nil {
+			return nil, err
+		}
+		tree, ok := trees[installDir]
+		if ok {
+			tree.BootEnvs = append(tree.BootEnvs, b.Name)
+			tree.Stale = tree.Stale || tree.staleFor(b)
+			continue
+		}
+		tree = &InstallTree{BootEnvs: []string{b.Name}, IsoFile: b.OS.IsoFile}
+		if tree.Tree, err = filepath.Rel(fileRoot, installDir); err != nil {
+			tree.Tree = installDir
+		}
+		if tree.Canary, err = b.findCanary(); err != nil {
+			return nil, err
+		}
+		tree.Exploded = tree.Canary != ""
+		if tree.Exploded {
+			if tree.IsoSha256, err = b.explodedIsoSha256(); err != nil {
+				return nil, err
+			}
+			tree.Stale = tree.staleFor(b)
+		}
+		if tree.Size, tree.Files, err = treeSize(installDir); err != nil {
+			return nil, err
+		}
+		trees[installDir] = tree
+		res = append(res, tree)
+	}
+	for _, tree := range res {
+		sort.Strings(tree.BootEnvs)
+	}
+	sort.Sort(installTreesByName(res))
+	return res, nil
+}
+
+func listInstallTrees(c *gin.Context) {
+	res, err := installTrees()
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/gin-gonic/gin"
+)
+
+// isoSectorSize is the size of a logical sector in an ISO9660 image.
+const isoSectorSize = 2048
+
+// isoRecord is an entry in a directory of an ISO9660 image.
+type isoRecord struct {
+	name      string
+	extent    int64 // The sector the entry's data starts at.
+	size      int64 // The size of the entry's data in bytes.
+	isDir     bool
+	joliet    bool        // Whether the entry is in the Joliet tree.
+	rockRidge bool        // Whether the entry has a Rock Ridge name.
+	mode      os.FileMode // The Rock Ridge permissions of the entry, if it has them.
+	symlink   string      // Where the entry points, if it is a Rock Ridge symlink.
+	// Whether the entry's data carries on in the next record, which
+	// only happens for files bigger than 4GB.
+	multiExtent bool
+}
+
+// isoImage reads the directory tree of an ISO9660 image.  Rock Ridge
+// names are used when the image has them, and plain ISO9660 names are
+// matched without regard to case or their version suffix otherwise.
+// Images without Rock Ridge names that have a Joliet tree are
+// extracted from that instead, to get their long names.
+type isoImage struct {
+	f      *os.File
+	root   *isoRecord
+	joliet *isoRecord // The root of the Joliet tree, if there is one.
+}
+
+func openIsoImage(isoPath string) (*isoImage, error) {
+	f, err := os.Open(isoPath)
+	if err != nil {
+		return nil, err
+	}
+	res := &isoImage{f: f}
+	// Volume descriptors start at sector 16, and end with a
+	// terminator of type 255.
+	buf := make([]byte, isoSectorSize)
+	for sector := int64(16); ; sector++ {
+		if _, err := f.ReadAt(buf, sector*isoSectorSize); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("iso: %s is not an ISO9660 image: %v", isoPath, err)
+		}
+		if string(buf[1:6]) != "CD001" {
+			f.Close()
+			return nil, fmt.Errorf("iso: %s is not an ISO9660 image", isoPath)
+		}
+		if buf[0] == 255 {
+			break
+		}
+		switch buf[0] {
+		case 1:
+			if res.root == nil {
+				res.root, _ = parseIsoRecord(buf[156:190], false)
+			}
+		case 2:
+			// A supplementary volume descriptor is Joliet if its
+			// escape sequences pick one of the UCS-2 levels.
+			escapes := string(buf[88:120])
+			if res.joliet == nil && (strings.Contains(escapes, "%/@") ||
+				strings.Contains(escapes, "%/C") ||
+				strings.Contains(escapes, "%/E")) {
+				res.joliet, _ = parseIsoRecord(buf[156:190], true)
+			}
+		}
+	}
+	if res.root == nil {
+		f.Close()
+		return nil, fmt.Errorf("iso: %s has no root directory", isoPath)
+	}
+	return res, nil
+}
+
+func (i *isoImage) Close() error {
+	return i.f.Close()
+}
+
+// parseIsoRecord parses the directory record at the start of buf, and
+// returns it along with its length.  It returns a length of 0 if
+// there are no more records in the sector.  Joliet records have UCS-2
+// names and no Rock Ridge entries.
+func parseIsoRecord(buf []byte, joliet bool) (*isoRecord, int) {
+	if len(buf) < 34 || buf[0] == 0 || int(buf[0]) > len(buf) {
+		return nil, 0
+	}
+	recLen := int(buf[0])
+	nameLen := int(buf[32])
+	if 33+nameLen > recLen {
+		return nil, 0
+	}
+	rawName := buf[33 : 33+nameLen]
+	res := &isoRecord{
+		extent:      int64(binary.LittleEndian.Uint32(buf[2:6])),
+		size:        int64(binary.LittleEndian.Uint32(buf[10:14])),
+		isDir:       buf[25]&2 != 0,
+		multiExtent: buf[25]&0x80 != 0,
+		joliet:      joliet,
+	}
+	switch {
+	case nameLen == 1 && rawName[0] == 0:
+		res.name = "."
+	case nameLen == 1 && rawName[0] == 1:
+		res.name = ".."
+	default:
+		if joliet {
+			chars := make([]uint16, nameLen/2)
+			for i := range chars {
+				chars[i] = binary.BigEndian.Uint16(rawName[i*2:])
+			}
+			res.name = string(utf16.Decode(chars))
+		} else {
+			res.name = string(rawName)
+		}
+		if idx := strings.LastIndex(res.name, ";"); idx != -1 {
+			res.name = res.name[:idx]
+		}
+		res.name = strings.TrimSuffix(res.name, ".")
+	}
+	if joliet {
+		return res, recLen
+	}
+	// The System Use area after the name may hold Rock Ridge entries.
+	suStart := 33 + nameLen
+	if nameLen%2 == 0 {
+		suStart++
+	}
+	if suStart < recLen {
+		res.parseRockRidge(buf[suStart:recLen])
+	}
+	return res, recLen
+}
+
+// parseRockRidge fills in the name, permissions, and symlink target of
+// the record from the Rock Ridge NM, PX, and SL entries of its System
+// Use area.  Continuation areas are not followed.
+func (r *isoRecord) parseRockRidge(su []byte) {
+	name := &bytes.Buffer{}
+	link := []string{}
+	isLink := false
+	joinNext := false
+	for len(su) >= 4 {
+		entryLen := int(su[2])
+		if entryLen < 4 || entryLen > len(su) {
+			break
+		}
+		switch string(su[0:2]) {
+		case "NM":
+			if entryLen >= 5 {
+				name.Write(su[5:entryLen])
+			}
+		case "PX":
+			if entryLen >= 12 {
+				mode := binary.LittleEndian.Uint32(su[4:8])
+				r.mode = os.FileMode(mode & 0777)
+				isLink = mode&0170000 == 0120000
+			}
+		case "SL":
+			// Components are a flags byte, a length, and the
+			// component.  Flags mark the current directory, the
+			// parent, the root, or a component carried on in the
+			// next one.
+			for comps := su[5:entryLen]; len(comps) >= 2 && 2+int(comps[1]) <= len(comps); {
+				flags, part := comps[0], string(comps[2:2+int(comps[1])])
+				comps = comps[2+int(comps[1]):]
+				switch {
+				case flags&0x02 != 0:
+					part = "."
+				case flags&0x04 != 0:
+					part = ".."
+				case flags&0x08 != 0:
+					part = ""
+				}
+				if joinNext && len(link) > 0 {
+					link[len(link)-1] += part
+				} else {
+					link = append(link, part)
+				}
+				joinNext = flags&0x01 != 0
+			}
+		}
+		su = su[entryLen:]
+	}
+	if name.Len() > 0 {
+		r.name = name.String()
+		r.rockRidge = true
+	}
+	if isLink && len(link) > 0 {
+		r.symlink = strings.Join(link, "/")
+		if r.symlink == "" {
+			r.symlink = "/"
+		}
+	}
+}
+
+// list returns the entries of the directory dir, other than . and ..
+func (i *isoImage) list(dir *isoRecord) ([]*isoRecord, error) {
+	buf := make([]byte, dir.size)
+	if _, err := i.f.ReadAt(buf, dir.extent*isoSectorSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+	res := []*isoRecord{}
+	for sector := 0; sector < len(buf); sector += isoSectorSize {
+		end := sector + isoSectorSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+		for pos := sector; pos < end; {
+			rec, recLen := parseIsoRecord(buf[pos:end], dir.joliet)
+			if recLen == 0 {
+				break
+			}
+			pos += recLen
+			if rec.name != "." && rec.name != ".." {
+				res = append(res, rec)
+			}
+		}
+	}
+	return res, nil
+}
+
+// find returns the entry at p, which is relative to the root of the
+// image, or nil if the image does not have it.
+func (i *isoImage) find(p string) (*isoRecord, error) {
+	cur := i.root
+	for _, part := range strings.Split(strings.Trim(p, "/"), "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		if !cur.isDir {
+			return nil, nil
+		}
+		entries, err := i.list(cur)
+		if err != nil {
+			return nil, err
+		}
+		var next *isoRecord
+		for _, entry := range entries {
+			if entry.name == part {
+				next = entry
+				break
+			}
+			if next == nil && strings.EqualFold(entry.name, part) {
+				next = entry
+			}
+		}
+		if next == nil {
+			return nil, nil
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// isoLink is a symlink waiting to be made once everything else has
+// been extracted, so that nothing is written through it.
+type isoLink struct {
+	path, target string
+}
+
+// checkLinkTarget refuses a symlink at linkPath in the tree being
+// extracted to dest if its target is absolute or leads outside of
+// dest, so that an image cannot make the file server hand out files
+// from anywhere else.
+func checkLinkTarget(kind, dest, linkPath, target string) error {
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("%s: %s links to the absolute path %s", kind, linkPath, target)
+	}
+	if !pathUnder(dest, filepath.Join(filepath.Dir(linkPath), target)) {
+		return fmt.Errorf("%s: %s links to %s, which is outside of the tree", kind, linkPath, target)
+	}
+	return nil
+}
+
+// checkMadeLinks makes sure that each of links still leads somewhere
+// under dest now that they have all been made, since a target can go
+// through another link before going up with "..".  Links that lead
+// nowhere are left alone, unless they go up with "..", in which case
+// they are removed, since where they lead depends on the links they
+// go through.
+func checkMadeLinks(kind, dest string, links []*isoLink) error {
+	realDest, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		resolved, err := filepath.EvalSymlinks(link.path)
+		if err == nil {
+			if !pathUnder(realDest, resolved) {
+				return fmt.Errorf("%s: %s links to %s, which leads outside of the tree", kind, link.path, link.target)
+			}
+			continue
+		}
+		for _, part := range strings.Split(filepath.ToSlash(link.target), "/") {
+			if part == ".." {
+				logger.Printf("%s: Removing %s, it links to %s, which leads nowhere\n", kind, link.path, link.target)
+				if err := os.Remove(link.path); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// extract writes everything in the image into dest.  Symlinks that
+// lead outside of dest are refused.
+func (i *isoImage) extract(ctx context.Context, dest string) error {
+	root := i.root
+	if i.joliet != nil {
+		entries, err := i.list(i.root)
+		if err != nil {
+			return err
+		}
+		rockRidge := false
+		for _, entry := range entries {
+			if entry.rockRidge {
+				rockRidge = true
+				break
+			}
+		}
+		if !rockRidge {
+			root = i.joliet
+		}
+	}
+	links := []*isoLink{}
+	if err := i.extractDir(ctx, root, dest, map[int64]bool{}, &links); err != nil {
+		return err
+	}
+	for _, link := range links {
+		if err := checkLinkTarget("iso", dest, link.path, link.target); err != nil {
+			return err
+		}
+	}
+	for _, link := range links {
+		if err := os.RemoveAll(link.path); err != nil {
+			return err
+		}
+		if err := os.Symlink(link.target, link.path); err != nil {
+			return err
+		}
+	}
+	return checkMadeLinks("iso", dest, links)
+}
+
+func (i *isoImage) extractDir(ctx context.Context, dir *isoRecord, dest string, seen map[int64]bool, links *[]*isoLink) error {
+	if seen[dir.extent] {
+		return fmt.Errorf("iso: %s loops back on itself", dest)
+	}
+	seen[dir.extent] = true
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	entries, err := i.list(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.name == "" || entry.name == "." || entry.name == ".." || strings.ContainsAny(entry.name, "/\x00") {
+			return fmt.Errorf("iso: %s has an entry with the bad name %q", dest, entry.name)
+		}
+		entryPath := filepath.Join(dest, entry.name)
+		switch {
+		case entry.symlink != "":
+			*links = append(*links, &isoLink{path: entryPath, target: entry.symlink})
+		case entry.isDir:
+			if err := i.extractDir(ctx, entry, entryPath, seen, links); err != nil {
+				return err
+			}
+		case entry.multiExtent:
+			return fmt.Errorf("iso: %s is split across extents, which is not supported", entryPath)
+		default:
+			if err := i.extractFile(entry, entryPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (i *isoImage) extractFile(rec *isoRecord, dest string) error {
+	mode := rec.mode
+	if mode == 0 {
+		mode = 0644
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, io.NewSectionReader(i.f, rec.extent*isoSectorSize, rec.size)); err != nil {
+		out.Close()
+		return fmt.Errorf("iso: Failed to extract %s: %v", dest, err)
+	}
+	return out.Close()
+}
+
+// extractIso explodes isoPath into installDir.  Tarballs and zip
+// archives are always extracted natively.  Unless --explode-native is
+// off, ISOs are too, and explodeScript is only used for ISOs that
+// cannot be.
+func (b *BootEnv) extractIso(ctx context.Context, isoPath, installDir string) error {
+	kind, err := imageKind(isoPath)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case imageTar:
+		return extractTar(ctx, isoPath, installDir)
+	case imageZip:
+		return extractZip(ctx, isoPath, installDir)
+	}
+	if explodeNative {
+		err := extractIsoNative(ctx, isoPath, installDir)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if checkExplodeTool() != nil {
+			return err
+		}
+		logger.Printf("Explode ISO: Unable to extract %s natively, falling back to %s: %v\n", isoPath, explodeScript, err)
+	} else if err := checkExplodeTool(); err != nil {
+		return err
+	}
+	_, err = exec.CommandContext(ctx, explodeScript, b.OS.Name, isoPath, installDir).Output()
+	return err
+}
+
+func extractIsoNative(ctx context.Context, isoPath, installDir string) error {
+	img, err := openIsoImage(isoPath)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	return img.extract(ctx, installDir)
+}
+
+// IsoPathCheck is a path the boot environment expects to find in its
+// ISO.
+type IsoPathCheck struct {
+	Path  string // The path, relative to the install tree.
+	Kind  string // What the boot environment uses it for: kernel or initrd.
+	Found bool   // Whether the ISO has it.
+	IsDir bool   `json:",omitempty"` // Whether it is a directory instead of a file.
+}
+
+// IsoCheck reports whether the ISO of a boot environment has the
+// kernel and initrds the boot environment expects.
+type IsoCheck struct {
+	BootEnv string
+	IsoFile string
+	Paths   []*IsoPathCheck
+	Missing int // How many of Paths are missing or are not files.
+}
+
+// CheckIso opens the ISO of the boot environment and checks that its
+// Kernel and Initrds are in it, without exploding it.  The ISO must
+// already be in the isos directory.
+func (b *BootEnv) CheckIso() (*IsoCheck, error) {
+	if b.OS == nil {
+		return nil, b.missingOS()
+	}
+	if b.OS.IsoFile == "" {
+		return nil, &ValidationError{Kind: "bootenv", Name: b.Name, Field: "OS.IsoFile", Message: "OS.IsoFile is required to check an ISO"}
+	}
+	isoPath := filepath.Join(fileRoot, "isos", b.OS.IsoFile)
+	img, err := openIsoImage(isoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	res := &IsoCheck{
+		BootEnv: b.Name,
+		IsoFile: b.OS.IsoFile,
+		Paths:   []*IsoPathCheck{},
+	}
+	if b.Kernel != "" {
+		res.Paths = append(res.Paths, &IsoPathCheck{Path: b.Kernel, Kind: "kernel"})
+	}
+	for _, initrd := range b.Initrds {
+		res.Paths = append(res.Paths, &IsoPathCheck{Path: initrd, Kind: "initrd"})
+	}
+	for _, check := range res.Paths {
+		rec, err := img.find(check.Path)
+		if err != nil {
+			return nil, fmt.Errorf("iso: Failed to read %s: %v", isoPath, err)
+		}
+		if rec != nil {
+			check.Found = true
+			check.IsDir = rec.isDir
+		}
+		if !check.Found || check.IsDir {
+			res.Missing++
+		}
+	}
+	return res, nil
+}
+
+func checkBootEnvIso(c *gin.Context) {
+	bootEnv := &BootEnv{}
+	if err := c.Bind(bootEnv); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+		return
+	}
+	res, err := bootEnv.CheckIso()
+	if err != nil {
+		if os.IsNotExist(err) {
+			respondWithError(c, http.StatusNotFound, fmt.Errorf("iso: %s has not been downloaded", bootEnv.OS.IsoFile))
+			return
+		}
+		respondWithError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
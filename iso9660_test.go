@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The sectors of the images built by writeTestIso.
+const (
+	testIsoRoot = 18
+	testIsoSub  = 19
+	testIsoData = 20
+)
+
+// testIsoRecord returns a directory record for name, with the Rock
+// Ridge entries in su.
+func testIsoRecord(name []byte, extent, size uint32, dir bool, su []byte) []byte {
+	n := 33 + len(name)
+	if len(name)%2 == 0 {
+		n++
+	}
+	res := make([]byte, n+len(su))
+	res[0] = byte(len(res))
+	binary.LittleEndian.PutUint32(res[2:], extent)
+	binary.LittleEndian.PutUint32(res[10:], size)
+	if dir {
+		res[25] = 2
+	}
+	res[32] = byte(len(name))
+	copy(res[33:], name)
+	copy(res[n:], su)
+	return res
+}
+
+// testRockRidgeName returns an NM entry for name.
+func testRockRidgeName(name string) []byte {
+	return append([]byte{'N', 'M', byte(5 + len(name)), 1, 0}, name...)
+}
+
+// testRockRidgeMode returns a PX entry for mode.
+func testRockRidgeMode(mode uint32) []byte {
+	res := make([]byte, 36)
+	copy(res, "PX")
+	res[2] = 36
+	res[3] = 1
+	binary.LittleEndian.PutUint32(res[4:], mode)
+	return res
+}
+
+// testRockRidgeLink returns the PX and SL entries of a symlink to
+// target.
+func testRockRidgeLink(target string) []byte {
+	sl := []byte{'S', 'L', 0, 1, 0}
+	parts := strings.Split(target, "/")
+	for i, part := range parts {
+		switch {
+		case part == "" && i == 0:
+			sl = append(sl, 0x08, 0)
+		case part == "..":
+			sl = append(sl, 0x04, 0)
+		case part == ".":
+			sl = append(sl, 0x02, 0)
+		default:
+			sl = append(sl, 0, byte(len(part)))
+			sl = append(sl, part...)
+		}
+	}
+	sl[2] = byte(len(sl))
+	return append(testRockRidgeMode(0120777), sl...)
+}
+
+// writeTestIso writes an image to dir with a readme.txt and a sub
+// directory at the root, and the extra entries in root and sub, and
+// returns its path.
+func writeTestIso(t *testing.T, dir string, root, sub [][]byte) string {
+	img := make([]byte, isoSectorSize*(testIsoData+1))
+	pvd := img[16*isoSectorSize:]
+	pvd[0] = 1
+	copy(pvd[1:], "CD001")
+	copy(pvd[156:], testIsoRecord([]byte{0}, testIsoRoot, isoSectorSize, true, nil))
+	term := img[17*isoSectorSize:]
+	term[0] = 255
+	copy(term[1:], "CD001")
+	root = append([][]byte{
+		testIsoRecord([]byte{0}, testIsoRoot, isoSectorSize, true, nil),
+		testIsoRecord([]byte{1}, testIsoRoot, isoSectorSize, true, nil),
+		testIsoRecord([]byte("README.TXT;1"), testIsoData, 5, false,
+			append(testRockRidgeName("readme.txt"), testRockRidgeMode(0100644)...)),
+		testIsoRecord([]byte("SUB"), testIsoSub, isoSectorSize, true, testRockRidgeName("sub")),
+	}, root...)
+	sub = append([][]byte{
+		testIsoRecord([]byte{0}, testIsoSub, isoSectorSize, true, nil),
+		testIsoRecord([]byte{1}, testIsoRoot, isoSectorSize, true, nil),
+	}, sub...)
+	for sector, records := range map[int][][]byte{testIsoRoot: root, testIsoSub: sub} {
+		pos := sector * isoSectorSize
+		for _, rec := range records {
+			copy(img[pos:], rec)
+			pos += len(rec)
+		}
+	}
+	copy(img[testIsoData*isoSectorSize:], "hello")
+	isoPath := filepath.Join(dir, "test.iso")
+	if err := ioutil.WriteFile(isoPath, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return isoPath
+}
+
+func testIsoDir(t *testing.T) string {
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+	dir, err := ioutil.TempDir("", "iso9660-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestExtractIso(t *testing.T) {
+	dir := testIsoDir(t)
+	defer os.RemoveAll(dir)
+	isoPath := writeTestIso(t, dir, nil, [][]byte{
+		testIsoRecord([]byte("LINK;1"), 0, 0, false,
+			append(testRockRidgeName("link"), testRockRidgeLink("../readme.txt")...)),
+	})
+	dest := filepath.Join(dir, "tree")
+	if err := extractIsoNative(context.Background(), isoPath, dest); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(dest, "sub", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("sub/link has %q, wanted %q", buf, "hello")
+	}
+}
+
+func TestExtractIsoBadName(t *testing.T) {
+	dir := testIsoDir(t)
+	defer os.RemoveAll(dir)
+	isoPath := writeTestIso(t, dir, [][]byte{
+		testIsoRecord([]byte("ESCAPE;1"), testIsoData, 5, false,
+			append(testRockRidgeName("../escape"), testRockRidgeMode(0100644)...)),
+	}, nil)
+	dest := filepath.Join(dir, "tree")
+	err := extractIsoNative(context.Background(), isoPath, dest)
+	if err == nil || !strings.Contains(err.Error(), "bad name") {
+		t.Fatalf("extracting an entry named ../escape returned %v, wanted a bad name error", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape")); err == nil {
+		t.Error("../escape was written outside of the tree")
+	}
+}
+
+func TestExtractIsoEscapingLinks(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		root [][]byte
+		sub  [][]byte
+	}{
+		{
+			name: "absolute",
+			sub: [][]byte{testIsoRecord([]byte("LINK;1"), 0, 0, false,
+				append(testRockRidgeName("link"), testRockRidgeLink("/etc/passwd")...))},
+		},
+		{
+			name: "up",
+			sub: [][]byte{testIsoRecord([]byte("LINK;1"), 0, 0, false,
+				append(testRockRidgeName("link"), testRockRidgeLink("../../outside")...))},
+		},
+		{
+			// sub/up leads to the top of the tree, which is fine, but
+			// going up from there through it is not.
+			name: "through another link",
+			root: [][]byte{testIsoRecord([]byte("LINK;1"), 0, 0, false,
+				append(testRockRidgeName("link"), testRockRidgeLink("sub/up/..")...))},
+			sub: [][]byte{testIsoRecord([]byte("UP;1"), 0, 0, false,
+				append(testRockRidgeName("up"), testRockRidgeLink("..")...))},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := testIsoDir(t)
+			defer os.RemoveAll(dir)
+			isoPath := writeTestIso(t, dir, tc.root, tc.sub)
+			err := extractIsoNative(context.Background(), isoPath, filepath.Join(dir, "tree"))
+			if err == nil || !strings.Contains(err.Error(), " links to ") {
+				t.Fatalf("extract returned %v, wanted the link to be refused", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// keyringPath returns the keyring in --keyring-dir that name refers
+// to.  Boot environments can only name keyrings the administrator put
+// there, so they cannot choose which keys to trust.
+func keyringPath(name string) (string, error) {
+	if keyringDir == "" {
+		return "", fmt.Errorf("signature checks are disabled, set --keyring-dir to enable them")
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("%q must be the name of a keyring in %s", name, keyringDir)
+	}
+	res := filepath.Join(keyringDir, name)
+	if _, err := os.Stat(res); err != nil {
+		return "", fmt.Errorf("no keyring named %s in %s", name, keyringDir)
+	}
+	return res, nil
+}
+
+// verifySignature checks that sigPath is a valid detached signature
+// of dataPath made by a key in keyring.  gpgv also accepts signed
+// messages that carry their own data, and then never looks at
+// dataPath, so its status output has to show a good signature without
+// any data of its own before the signature is trusted.
+func verifySignature(ctx context.Context, keyring, sigPath, dataPath string) error {
+	status := &bytes.Buffer{}
+	out := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, gpgvPath, "--status-fd", "1", "--keyring", keyring, sigPath, dataPath)
+	cmd.Stdout = status
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(out.String()))
+	}
+	valid := false
+	for _, line := range strings.Split(status.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "[GNUPG:]" {
+			continue
+		}
+		switch fields[1] {
+		case "VALIDSIG":
+			valid = true
+		case "PLAINTEXT", "PLAINTEXT_LENGTH":
+			return fmt.Errorf("%s is not a detached signature", filepath.Base(sigPath))
+		case "BADSIG", "ERRSIG", "EXPSIG", "EXPKEYSIG", "REVKEYSIG":
+			return fmt.Errorf("gpgv reported %s: %s", fields[1], strings.TrimSpace(out.String()))
+		}
+	}
+	if !valid {
+		return fmt.Errorf("gpgv did not report a valid signature: %s", strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// signedIsoSha256 downloads the checksums file of the OS, checks its
+// signature if it has one, and returns the SHA256 it lists for the
+// ISO.
+func (o *OsInfo) signedIsoSha256(ctx context.Context) (string, error) {
+	tmpDir, err := ioutil.TempDir("", "iso-checksums")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+	sumsPath := filepath.Join(tmpDir, "checksums")
+	if err := downloadFile(ctx, o.IsoChecksumsUrl, sumsPath); err != nil {
+		return "", err
+	}
+	if o.IsoSignatureUrl != "" {
+		keyring, err := keyringPath(o.IsoKeyring)
+		if err != nil {
+			return "", fmt.Errorf("iso: Cannot check the signature of %s: %v", o.IsoChecksumsUrl, err)
+		}
+		sigPath := filepath.Join(tmpDir, "checksums.sig")
+		if err := downloadFile(ctx, o.IsoSignatureUrl, sigPath); err != nil {
+			return "", err
+		}
+		if err := verifySignature(ctx, keyring, sigPath, sumsPath); err != nil {
+			return "", fmt.Errorf("iso: Bad signature on %s: %v", o.IsoChecksumsUrl, err)
+		}
+	}
+	sums, err := os.Open(sumsPath)
+	if err != nil {
+		return "", err
+	}
+	defer sums.Close()
+	sha, err := parseChecksums(sums, filepath.Base(o.IsoFile))
+	if err != nil {
+		return "", fmt.Errorf("iso: %s: %v", o.IsoChecksumsUrl, err)
+	}
+	return sha, nil
+}
+
+// resolveIsoSha256 fills in the IsoSha256 of the OS from its checksums
+// file, if it has one, so that the ISO is checked against the
+// published, and possibly signed, checksum.  An IsoSha256 that is
+// already set must agree with it.
+func (o *OsInfo) resolveIsoSha256(ctx context.Context) error {
+	if o.IsoChecksumsUrl == "" {
+		return nil
+	}
+	sha, err := o.signedIsoSha256(ctx)
+	if err != nil {
+		return err
+	}
+	if o.IsoSha256 != "" && !strings.EqualFold(o.IsoSha256, sha) {
+		return fmt.Errorf("iso: IsoSha256 %s does not match %s from %s", o.IsoSha256, sha, o.IsoChecksumsUrl)
+	}
+	o.IsoSha256 = sha
+	return nil
+}
+
+// checkSignature checks filePath against the detached signature at the
+// ValidationURL of f, if its ValidationMethod is gpg.
+func (f *FileData) checkSignature(ctx context.Context, filePath string) error {
+	if f.ValidationMethod != "gpg" || f.ValidationURL == "" {
+		return nil
+	}
+	keyring, err := keyringPath(f.Keyring)
+	if err != nil {
+		return fmt.Errorf("file: Cannot check the signature of %s: %v", f.Name, err)
+	}
+	tmpDir, err := ioutil.TempDir("", "file-signature")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	sigPath := filepath.Join(tmpDir, "file.sig")
+	if err := downloadFile(ctx, f.ValidationURL, sigPath); err != nil {
+		return err
+	}
+	if err := verifySignature(ctx, keyring, sigPath, filePath); err != nil {
+		return &SignatureMismatchError{File: f.Name, Message: err.Error()}
+	}
+	return nil
+}
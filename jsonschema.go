@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonSchema is a parsed JSON schema that rendered templates can be
+// checked against.  Only the keywords that describe the shape of a
+// document are supported: type, enum, properties, required,
+// additionalProperties, items, minimum, maximum, minLength,
+// maxLength, pattern, minItems, and maxItems, along with annotations
+// that do not affect validation, like title and description.  Schemas
+// with any other keyword, like $ref or oneOf, are refused, since
+// ignoring it would let through documents the schema is meant to
+// refuse.
+type jsonSchema struct {
+	types                []string
+	enum                 []interface{}
+	properties           map[string]*jsonSchema
+	required             []string
+	additionalProperties *jsonSchema
+	noAdditional         bool
+	items                *jsonSchema
+	minimum, maximum     *float64
+	minLength, maxLength *int
+	minItems, maxItems   *int
+	pattern              *regexp.Regexp
+}
+
+var jsonSchemaTypes = map[string]bool{
+	"object":  true,
+	"array":   true,
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"null":    true,
+}
+
+// jsonSchemaKeywords are the keywords a schema can use.  The ones that
+// are false are annotations, which are allowed but not checked.
+var jsonSchemaKeywords = map[string]bool{
+	"type":                 true,
+	"enum":                 true,
+	"properties":           true,
+	"required":             true,
+	"additionalProperties": true,
+	"items":                true,
+	"minimum":              true,
+	"maximum":              true,
+	"minLength":            true,
+	"maxLength":            true,
+	"pattern":              true,
+	"minItems":             true,
+	"maxItems":             true,
+	"$schema":              false,
+	"$id":                  false,
+	"id":                   false,
+	"$comment":             false,
+	"title":                false,
+	"description":          false,
+	"default":              false,
+	"examples":             false,
+	"format":               false,
+}
+
+// parseJSONSchema parses the JSON schema in contents.
+func parseJSONSchema(contents []byte) (*jsonSchema, error) {
+	var raw interface{}
+	if err := json.Unmarshal(contents, &raw); err != nil {
+		return nil, fmt.Errorf("schema: %v", err)
+	}
+	return compileJSONSchema("$", raw)
+}
+
+func compileJSONSchema(at string, raw interface{}) (*jsonSchema, error) {
+	def, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("schema: %s is not an object", at)
+	}
+	keywords := make([]string, 0, len(def))
+	for keyword := range def {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+	for _, keyword := range keywords {
+		if _, ok := jsonSchemaKeywords[keyword]; !ok {
+			return nil, fmt.Errorf("schema: %s.%s is not supported", at, keyword)
+		}
+	}
+	res := &jsonSchema{}
+	switch types := def["type"].(type) {
+	case nil:
+	case string:
+		res.types = []string{types}
+	case []interface{}:
+		for _, t := range types {
+			name, ok := t.(string)
+			if !ok {
+				return nil, fmt.Errorf("schema: %s.type must only list strings", at)
+			}
+			res.types = append(res.types, name)
+		}
+	default:
+		return nil, fmt.Errorf("schema: %s.type must be a string or a list of strings", at)
+	}
+	for _, t := range res.types {
+		if !jsonSchemaTypes[t] {
+			return nil, fmt.Errorf("schema: %s.type: unknown type %s", at, t)
+		}
+	}
+	if enum, ok := def["enum"]; ok {
+		if res.enum, ok = enum.([]interface{}); !ok {
+			return nil, fmt.Errorf("schema: %s.enum must be a list", at)
+		}
+	}
+	if props, ok := def["properties"]; ok {
+		propDefs, ok := props.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("schema: %s.properties must be an object", at)
+		}
+		res.properties = map[string]*jsonSchema{}
+		for name, propDef := range propDefs {
+			prop, err := compileJSONSchema(at+".properties."+name, propDef)
+			if err != nil {
+				return nil, err
+			}
+			res.properties[name] = prop
+		}
+	}
+	if required, ok := def["required"]; ok {
+		names, ok := required.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("schema: %s.required must be a list", at)
+		}
+		for _, n := range names {
+			name, ok := n.(string)
+			if !ok {
+				return nil, fmt.Errorf("schema: %s.required must only list strings", at)
+			}
+			res.required = append(res.required, name)
+		}
+	}
+	switch additional := def["additionalProperties"].(type) {
+	case nil:
+	case bool:
+		res.noAdditional = !additional
+	default:
+		schema, err := compileJSONSchema(at+".additionalProperties", additional)
+		if err != nil {
+			return nil, err
+		}
+		res.additionalProperties = schema
+	}
+	if items, ok := def["items"]; ok {
+		schema, err := compileJSONSchema(at+".items", items)
+		if err != nil {
+			return nil, err
+		}
+		res.items = schema
+	}
+	numbers := []struct {
+		name string
+		dest **float64
+	}{
+		{"minimum", &res.minimum},
+		{"maximum", &res.maximum},
+	}
+	for _, n := range numbers {
+		val, ok := def[n.name]
+		if !ok {
+			continue
+		}
+		num, ok := val.(float64)
+		if !ok {
+			return nil, fmt.Errorf("schema: %s.%s must be a number", at, n.name)
+		}
+		*n.dest = &num
+	}
+	counts := []struct {
+		name string
+		dest **int
+	}{
+		{"minLength", &res.minLength},
+		{"maxLength", &res.maxLength},
+		{"minItems", &res.minItems},
+		{"maxItems", &res.maxItems},
+	}
+	for _, n := range counts {
+		val, ok := def[n.name]
+		if !ok {
+			continue
+		}
+		num, ok := val.(float64)
+		if !ok || num < 0 || num != math.Trunc(num) {
+			return nil, fmt.Errorf("schema: %s.%s must be a whole number", at, n.name)
+		}
+		count := int(num)
+		*n.dest = &count
+	}
+	if pattern, ok := def["pattern"]; ok {
+		expr, ok := pattern.(string)
+		if !ok {
+			return nil, fmt.Errorf("schema: %s.pattern must be a string", at)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("schema: %s.pattern: %v", at, err)
+		}
+		res.pattern = re
+	}
+	return res, nil
+}
+
+// jsonType returns the JSON schema type of val, which was decoded by
+// encoding/json.
+func jsonType(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", val)
+}
+
+// validate checks contents against the schema.  The error names where
+// in contents the first violation is, like $.storage.files[0].path.
+func (s *jsonSchema) validate(contents []byte) error {
+	var val interface{}
+	if err := json.Unmarshal(contents, &val); err != nil {
+		return fmt.Errorf("json: %v", err)
+	}
+	return s.check("$", val)
+}
+
+func (s *jsonSchema) check(at string, val interface{}) error {
+	valType := jsonType(val)
+	if len(s.types) > 0 {
+		ok := false
+		for _, t := range s.types {
+			if t == valType || (t == "number" && valType == "integer") {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("schema: %s is %s, not %s", at, valType, strings.Join(s.types, " or "))
+		}
+	}
+	if s.enum != nil {
+		ok := false
+		for _, allowed := range s.enum {
+			if reflect.DeepEqual(allowed, val) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("schema: %s is not one of the allowed values", at)
+		}
+	}
+	switch v := val.(type) {
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			return fmt.Errorf("schema: %s is less than %v", at, *s.minimum)
+		}
+		if s.maximum != nil && v > *s.maximum {
+			return fmt.Errorf("schema: %s is greater than %v", at, *s.maximum)
+		}
+	case string:
+		length := len([]rune(v))
+		if s.minLength != nil && length < *s.minLength {
+			return fmt.Errorf("schema: %s is shorter than %d characters", at, *s.minLength)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			return fmt.Errorf("schema: %s is longer than %d characters", at, *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fmt.Errorf("schema: %s does not match %s", at, s.pattern)
+		}
+	case []interface{}:
+		if s.minItems != nil && len(v) < *s.minItems {
+			return fmt.Errorf("schema: %s has fewer than %d items", at, *s.minItems)
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			return fmt.Errorf("schema: %s has more than %d items", at, *s.maxItems)
+		}
+		if s.items != nil {
+			for i, item := range v {
+				if err := s.items.check(at+"["+strconv.Itoa(i)+"]", item); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("schema: %s is missing %s", at, name)
+			}
+		}
+		// Check the properties in order, so that the same document
+		// always reports the same violation.
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.properties[name]
+			if !ok {
+				if s.noAdditional {
+					return fmt.Errorf("schema: %s.%s is not allowed", at, name)
+				}
+				prop = s.additionalProperties
+			}
+			if prop == nil {
+				continue
+			}
+			if err := prop.check(at+"."+name, v[name]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
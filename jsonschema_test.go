@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJSONSchemaKeywords(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		schema   string
+		document string
+		err      string // A substring of the error, or "" if the document conforms.
+	}{
+		{"type", `{"type": "string"}`, `"a"`, ""},
+		{"type mismatch", `{"type": "string"}`, `1`, "is integer, not string"},
+		{"type list", `{"type": ["string", "null"]}`, `null`, ""},
+		{"integer is a number", `{"type": "number"}`, `1`, ""},
+		{"number is not an integer", `{"type": "integer"}`, `1.5`, "is number, not integer"},
+		{"enum", `{"enum": ["a", 1]}`, `1`, ""},
+		{"enum mismatch", `{"enum": ["a", 1]}`, `"b"`, "not one of the allowed values"},
+		{"properties", `{"properties": {"a": {"type": "string"}}}`, `{"a": 1}`, "$.a is integer"},
+		{"required", `{"required": ["a"]}`, `{"b": 1}`, "$ is missing a"},
+		{"additionalProperties false", `{"properties": {"a": {}}, "additionalProperties": false}`, `{"a": 1, "b": 2}`, "$.b is not allowed"},
+		{"additionalProperties schema", `{"additionalProperties": {"type": "string"}}`, `{"b": 2}`, "$.b is integer"},
+		{"items", `{"items": {"type": "string"}}`, `["a", 1]`, "$[1] is integer"},
+		{"minimum", `{"minimum": 2}`, `1`, "less than 2"},
+		{"maximum", `{"maximum": 2}`, `3`, "greater than 2"},
+		{"minLength", `{"minLength": 2}`, `"a"`, "shorter than 2"},
+		{"maxLength counts characters", `{"maxLength": 2}`, `"éé"`, ""},
+		{"maxLength", `{"maxLength": 2}`, `"abc"`, "longer than 2"},
+		{"pattern", `{"pattern": "^a+$"}`, `"ab"`, "does not match"},
+		{"minItems", `{"minItems": 2}`, `[1]`, "fewer than 2"},
+		{"maxItems", `{"maxItems": 1}`, `[1, 2]`, "more than 1"},
+		{"annotations", `{"$schema": "http://json-schema.org/draft-07/schema#", "title": "t", "description": "d", "format": "uri"}`, `"x"`, ""},
+		{"nested", `{"properties": {"a": {"items": {"required": ["b"]}}}}`, `{"a": [{"b": 1}, {}]}`, "$.a[1] is missing b"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			schema, err := parseJSONSchema([]byte(tc.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = schema.validate([]byte(tc.document))
+			switch {
+			case tc.err == "" && err != nil:
+				t.Errorf("%s was refused: %v", tc.document, err)
+			case tc.err != "" && err == nil:
+				t.Errorf("%s was accepted, wanted %q", tc.document, tc.err)
+			case tc.err != "" && !strings.Contains(err.Error(), tc.err):
+				t.Errorf("%s was refused with %v, wanted %q", tc.document, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestJSONSchemaUnsupportedKeywords(t *testing.T) {
+	for _, schema := range []string{
+		`{"oneOf": [{"type": "string"}]}`,
+		`{"allOf": [{"type": "string"}]}`,
+		`{"anyOf": [{"type": "string"}]}`,
+		`{"$ref": "#/definitions/a"}`,
+		`{"const": 1}`,
+		`{"properties": {"a": {"not": {}}}}`,
+		`{"items": {"uniqueItems": true}}`,
+	} {
+		if _, err := parseJSONSchema([]byte(schema)); err == nil || !strings.Contains(err.Error(), "is not supported") {
+			t.Errorf("%s was parsed with %v, wanted it to be refused", schema, err)
+		}
+	}
+}
+
+func TestJSONSchemaBadSchemas(t *testing.T) {
+	for _, schema := range []string{
+		`[]`,
+		`{"type": "thing"}`,
+		`{"type": 1}`,
+		`{"enum": "a"}`,
+		`{"required": "a"}`,
+		`{"minLength": -1}`,
+		`{"maxItems": 1.5}`,
+		`{"minimum": "1"}`,
+		`{"pattern": "("}`,
+	} {
+		if _, err := parseJSONSchema([]byte(schema)); err == nil {
+			t.Errorf("%s was parsed, wanted it to be refused", schema)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LintWarning describes a risky construct found in a template or
+// boot environment.
+type LintWarning struct {
+	Severity string // How bad the problem is, either "error" or "warning".
+	Location string // Where the problem is, as name:line:col when known.
+	Message  string // What the problem is.
+}
+
+// riskyTemplateFuncs are the functions that templates can call that
+// we want to warn about, along with the reason why.
+var riskyTemplateFuncs = map[string]string{
+	"call": "can invoke any function reachable from the render data",
+}
+
+// walkTemplate calls fn on every node in the parse tree rooted at node.
+func walkTemplate(node parse.Node, fn func(parse.Node)) {
+	if node == nil {
+		return
+	}
+	fn(node)
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			walkTemplate(child, fn)
+		}
+	case *parse.ActionNode:
+		walkTemplate(n.Pipe, fn)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, decl := range n.Decl {
+			walkTemplate(decl, fn)
+		}
+		for _, cmd := range n.Cmds {
+			walkTemplate(cmd, fn)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			walkTemplate(arg, fn)
+		}
+	case *parse.ChainNode:
+		walkTemplate(n.Node, fn)
+	case *parse.IfNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.RangeNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.WithNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.TemplateNode:
+		walkTemplate(n.Pipe, fn)
+	}
+}
+
+func walkBranch(n *parse.BranchNode, fn func(parse.Node)) {
+	walkTemplate(n.Pipe, fn)
+	walkTemplate(n.List, fn)
+	walkTemplate(n.ElseList, fn)
+}
+
+// paramRef is a reference to a machine parameter in a template.
+type paramRef struct {
+	key  string     // The param, as a dotted path for nested params.
+	node parse.Node // The node that refers to the param.
+	via  string     // The helper used to refer to it, or "" for .Machine.Params.
+	// optional refs do not fail rendering when the machine does not
+	// have the param.
+	optional bool
+}
+
+// findParamRefs returns all of the references to machine parameters
+// under node via .Param, .ParamPath, .ParamExists, .ParamDefault, or
+// .Machine.Params, in the order they appear.
+func findParamRefs(node parse.Node) []*paramRef {
+	res := []*paramRef{}
+	walkTemplate(node, func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.CommandNode:
+			if len(n.Args) < 2 {
+				return
+			}
+			via := lastIdent(n.Args[0])
+			switch via {
+			case "Param", "ParamPath", "ParamExists", "ParamDefault":
+			default:
+				return
+			}
+			if key, ok := n.Args[1].(*parse.StringNode); ok {
+				res = append(res, &paramRef{
+					key:      key.Text,
+					node:     n,
+					via:      via,
+					optional: via == "ParamExists" || via == "ParamDefault",
+				})
+			}
+		case *parse.FieldNode:
+			for i := 0; i+2 < len(n.Ident); i++ {
+				if n.Ident[i] == "Machine" && n.Ident[i+1] == "Params" {
+					res = append(res, &paramRef{
+						key:  strings.Join(n.Ident[i+2:], "."),
+						node: n,
+					})
+					break
+				}
+			}
+		}
+	})
+	return res
+}
+
+// paramRefs returns the machine parameters that a template refers to,
+// keyed by param.  A reference inside of an {{if .ParamExists "key"}}
+// block for the same param (or one of its parents) is optional.  If a
+// param is referred to more than once, the first required reference
+// wins.
+func paramRefs(tree *parse.Tree) map[string]*paramRef {
+	guarded := map[parse.Node]bool{}
+	walkTemplate(tree.Root, func(node parse.Node) {
+		ifNode, ok := node.(*parse.IfNode)
+		if !ok {
+			return
+		}
+		exists := []string{}
+		for _, ref := range findParamRefs(ifNode.Pipe) {
+			if ref.via == "ParamExists" {
+				exists = append(exists, ref.key)
+			}
+		}
+		for _, ref := range findParamRefs(ifNode.List) {
+			for _, key := range exists {
+				if ref.key == key || strings.HasPrefix(ref.key, key+".") {
+					guarded[ref.node] = true
+				}
+			}
+		}
+	})
+	res := map[string]*paramRef{}
+	for _, ref := range findParamRefs(tree.Root) {
+		ref.optional = ref.optional || guarded[ref.node]
+		if old, ok := res[ref.key]; ok && (!old.optional || ref.optional) {
+			continue
+		}
+		res[ref.key] = ref
+	}
+	return res
+}
+
+// lastIdent returns the name of the method or field a node refers to,
+// if any.
+func lastIdent(node parse.Node) string {
+	var idents []string
+	switch n := node.(type) {
+	case *parse.FieldNode:
+		idents = n.Ident
+	case *parse.VariableNode:
+		idents = n.Ident
+	case *parse.ChainNode:
+		idents = n.Field
+	}
+	if len(idents) == 0 {
+		return ""
+	}
+	return idents[len(idents)-1]
+}
+
+type templateLinter struct {
+	warnings []*LintWarning
+	// The params that are known to be present when rendering.  nil
+	// if we do not know, in which case we do not check param usage.
+	required map[string]bool
+}
+
+func (l *templateLinter) add(severity, location, message string) {
+	l.warnings = append(l.warnings, &LintWarning{
+		Severity: severity,
+		Location: location,
+		Message:  message,
+	})
+}
+
+func (l *templateLinter) lint(tmpl *template.Template) {
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		tree := t.Tree
+		if l.required != nil {
+			refs := paramRefs(tree)
+			params := make([]string, 0, len(refs))
+			for param := range refs {
+				params = append(params, param)
+			}
+			sort.Strings(params)
+			for _, param := range params {
+				topLevel := strings.SplitN(param, ".", 2)[0]
+				if refs[param].optional || l.required[topLevel] {
+					continue
+				}
+				location, _ := tree.ErrorContext(refs[param].node)
+				l.add("warning", location,
+					"param "+param+" is not in RequiredParams, rendering will fail for machines that do not have it")
+			}
+		}
+		walkTemplate(tree.Root, func(node parse.Node) {
+			ident, ok := node.(*parse.IdentifierNode)
+			if !ok {
+				return
+			}
+			if reason, risky := riskyTemplateFuncs[ident.Ident]; risky {
+				location, _ := tree.ErrorContext(node)
+				l.add("warning", location, "function "+ident.Ident+" "+reason)
+			} else if fn, ok := templateFuncs[ident.Ident]; ok && fn.dangerous {
+				location, _ := tree.ErrorContext(node)
+				l.add("warning", location, "function "+ident.Ident+" reaches outside of the provisioner")
+			}
+		})
+	}
+}
+
+// Lint checks the template for risky constructs.
+func (t *Template) Lint() []*LintWarning {
+	l := &templateLinter{}
+	// Compile the template on its own rather than sharing it by
+	// Sha256, so that locations refer to it by UUID.
+	tmpl, err := newTemplate(t.UUID, t.Contents)
+	if err != nil {
+		l.add("error", t.UUID, err.Error())
+		return l.warnings
+	}
+	l.lint(tmpl)
+	return l.warnings
+}
+
+// Lint checks the boot environment and all of the templates it
+// refers to for risky constructs.
+func (b *BootEnv) Lint() []*LintWarning {
+	l := &templateLinter{required: map[string]bool{}}
+	for _, param := range b.RequiredParams {
+		l.required[param] = true
+	}
+	if b.BootParams != "" {
+		tmpl, err := newTemplate(b.Name+".BootParams", b.BootParams)
+		if err != nil {
+			l.add("error", b.Name+".BootParams", err.Error())
+		} else {
+			l.lint(tmpl)
+		}
+	}
+	b.mergeTemplates()
+	for _, ti := range b.templates {
+		location := b.Name + "." + ti.Name
+		if strings.HasPrefix(ti.Path, "/") || strings.Contains(ti.Path, "..") {
+			l.add("warning", location, "path "+ti.Path+" may escape the file root")
+		}
+		pathTmpl, err := newTemplate(location+".Path", ti.Path)
+		if err != nil {
+			l.add("error", location, err.Error())
+		} else {
+			l.lint(pathTmpl)
+		}
+		tmpl := &Template{UUID: ti.UUID}
+		if err := backend.load(tmpl); err != nil {
+			l.add("error", location, err.Error())
+			continue
+		}
+		parsed, err := newTemplate(tmpl.UUID, tmpl.Contents)
+		if err != nil {
+			l.add("error", location, err.Error())
+			continue
+		}
+		l.lint(parsed)
+	}
+	return l.warnings
+}
+
+// ParamRef describes a machine parameter that the templates of a
+// boot environment refer to.
+type ParamRef struct {
+	Name      string   // The param, as a dotted path for nested params.
+	Required  bool     // Whether rendering fails for machines that do not have the param.
+	Templates []string // The templates that refer to the param.
+}
+
+// ReferencedParams parses all of the templates in the boot
+// environment, including the boot parameters template, and returns
+// the machine parameters they refer to, sorted by name.  Nothing is
+// rendered.
+func (b *BootEnv) ReferencedParams() ([]*ParamRef, error) {
+	if err := b.parseTemplates(); err != nil {
+		return nil, err
+	}
+	params := map[string]*ParamRef{}
+	collect := func(name string, tmpl *template.Template) {
+		if tmpl == nil {
+			return
+		}
+		for _, t := range tmpl.Templates() {
+			if t.Tree == nil {
+				continue
+			}
+			for key, ref := range paramRefs(t.Tree) {
+				param, ok := params[key]
+				if !ok {
+					param = &ParamRef{Name: key}
+					params[key] = param
+				}
+				param.Required = param.Required || !ref.optional
+				if n := len(param.Templates); n == 0 || param.Templates[n-1] != name {
+					param.Templates = append(param.Templates, name)
+				}
+			}
+		}
+	}
+	collect("BootParams", b.bootParamsTmpl)
+	for _, ti := range b.templates {
+		collect(ti.Name, ti.pathTmpl)
+		collect(ti.Name, ti.contents.parsedTmpl)
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := make([]*ParamRef, len(names))
+	for i, name := range names {
+		res[i] = params[name]
+	}
+	return res, nil
+}
+
+func bootEnvReferencedParams(c *gin.Context) {
+	bootEnv := &BootEnv{Name: c.Param(`name`)}
+	if err := backend.load(bootEnv); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	res, err := bootEnv.ReferencedParams()
+	if err != nil {
+		respondWithError(c, http.StatusConflict, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+func lintTemplate(c *gin.Context) {
+	tmpl := &Template{}
+	if err := c.Bind(tmpl); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+		return
+	}
+	c.JSON(http.StatusOK, tmpl.Lint())
+}
+
+func lintBootEnv(c *gin.Context) {
+	bootEnv := &BootEnv{}
+	if err := c.Bind(bootEnv); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+		return
+	}
+	c.JSON(http.StatusOK, bootEnv.Lint())
+}
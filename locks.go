@@ -0,0 +1,157 @@
+package main
+
+import "sync"
+
+// keyedMutex hands out a lock per key, so that work on the same key
+// is serialized while work on different keys can run in parallel.
+type keyedMutex struct {
+	sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: map[string]*keyedLock{}}
+}
+
+// lock blocks until the lock for key is held, and returns the
+// function that releases it.
+func (k *keyedMutex) lock(key string) func() {
+	k.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.Unlock()
+	}
+}
+
+// keyedSemaphore hands out a semaphore per key, so that work on the
+// same key can be bounded no matter how many callers start it, while
+// work on different keys is bounded separately.
+type keyedSemaphore struct {
+	sync.Mutex
+	size func() int
+	sems map[string]*keyedSem
+}
+
+type keyedSem struct {
+	slots chan struct{}
+	refs  int
+}
+
+func newKeyedSemaphore(size func() int) *keyedSemaphore {
+	return &keyedSemaphore{size: size, sems: map[string]*keyedSem{}}
+}
+
+// hold returns the semaphore for key, which callers acquire by
+// sending to it and release by receiving from it, and the function
+// to call once the caller is done with it.
+func (k *keyedSemaphore) hold(key string) (chan struct{}, func()) {
+	k.Lock()
+	defer k.Unlock()
+	s, ok := k.sems[key]
+	if !ok {
+		size := k.size()
+		if size < 1 {
+			size = 1
+		}
+		s = &keyedSem{slots: make(chan struct{}, size)}
+		k.sems[key] = s
+	}
+	s.refs++
+	return s.slots, func() {
+		k.Lock()
+		s.refs--
+		if s.refs == 0 {
+			delete(k.sems, key)
+		}
+		k.Unlock()
+	}
+}
+
+// flightGroup makes sure that only one call for a given key is in
+// flight at a time.  Callers that arrive while a call is running
+// wait for it and share its result instead of repeating the work.
+type flightGroup struct {
+	sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	sync.WaitGroup
+	err error
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: map[string]*flightCall{}}
+}
+
+func (g *flightGroup) do(key string, fn func() error) error {
+	g.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.Unlock()
+		call.Wait()
+		return call.err
+	}
+	call := &flightCall{}
+	call.Add(1)
+	g.calls[key] = call
+	g.Unlock()
+
+	call.err = fn()
+	call.Done()
+
+	g.Lock()
+	delete(g.calls, key)
+	g.Unlock()
+	return call.err
+}
+
+// machineRenderLocks serializes template renders for the same machine.
+var machineRenderLocks = newKeyedMutex()
+
+// renderSlots bounds how many machines are rendered at once for each
+// boot environment, to --render-concurrency.
+var renderSlots = newKeyedSemaphore(func() int { return renderConcurrency })
+
+// installTreeFlights single-flights ISO explodes and file downloads
+// into the install trees.
+var installTreeFlights = newFlightGroup()
+
+// bootEnvSaveSlots bounds how many boot environments can be doing the
+// heavy work of being saved at once, so that a burst of changes such
+// as a bulk import queues up instead of exhausting the disk, memory,
+// and explode worker.  Nil if there is no limit.
+var bootEnvSaveSlots chan struct{}
+
+// acquireBootEnvSave blocks until there is room for another boot
+// environment to be saved, and returns the function that makes room
+// again.
+func acquireBootEnvSave(name string) func() {
+	if bootEnvSaveSlots == nil {
+		return func() {}
+	}
+	select {
+	case bootEnvSaveSlots <- struct{}{}:
+	default:
+		logger.Printf("bootenv: %d saves already running, %s is waiting for its turn\n", cap(bootEnvSaveSlots), name)
+		bootEnvSaveSlots <- struct{}{}
+	}
+	return func() { <-bootEnvSaveSlots }
+}
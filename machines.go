@@ -1,11 +1,21 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
 	"path"
+	"reflect"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
 )
 
 // Machine represents a single bare-metal system that the provisioner
@@ -14,8 +24,100 @@ type Machine struct {
 	Name    string                 // The FQDN of the machine.
 	Uuid    string                 // the UUID of the machine
 	Address string                 // The IPv4 address that the machine PXE boots with.
+	Macs    []string               // The MAC addresses of the machine's NICs, for DHCP helpers to find it by.
 	BootEnv string                 // The boot environment that the machine should boot into.
 	Params  map[string]interface{} // Any additional parameters that may be needed for template expansion.
+	// The boot environment the machine should be switched to once it
+	// reports that its install has finished.  If empty, the NextBootEnv
+	// of the machine's current boot environment is used.
+	NextBootEnv string
+	Arch        string // The CPU architecture of the machine.  Can be x86_64 or arm64, defaults to x86_64.
+	Firmware    string // The firmware the machine boots with.  Can be bios or uefi, defaults to bios.
+	// The version of the schema the machine was saved with.
+	SchemaVersion int
+	// The secret the machine uses to authenticate itself when it
+	// reports back to the provisioner.  Generated when the machine is
+	// first saved if not supplied.
+	Token string
+	// The last install failure the machine reported, if any.  Cleared
+	// when the machine reports that its install is complete.
+	InstallFailure *InstallFailure
+	// The last time the machine failed to render when its boot
+	// environment was saved with an OnRenderFailure of "record" or
+	// "fallback", if it has not rendered successfully since.
+	RenderFailure *RenderFailure `json:",omitempty"`
+	// Machines in maintenance are being worked on by hand, so their
+	// files are not rendered again until maintenance is cleared.
+	Maintenance bool
+	// The Rebar tenant the machine belongs to, if any.  Picks the
+	// per-tenant URLs from --tenant-urls for its templates.
+	TenantId int
+	// Extra initrds to load after those of the boot environment, as
+	// paths relative to the file root, for things like a config or SSH
+	// key the machine needs early in boot.
+	Initrds []string `json:",omitempty"`
+}
+
+// InstallFailure is what a machine reports when its install fails.
+type InstallFailure struct {
+	Phase   string    // The phase of the install that failed, if the machine knows.
+	Message string    // What went wrong, if the machine knows.
+	Time    time.Time // When the failure was reported.
+}
+
+const (
+	archX86_64   = "x86_64"
+	archArm64    = "arm64"
+	firmwareBios = "bios"
+	firmwareUefi = "uefi"
+)
+
+// archAliases maps the other names architectures commonly go by to
+// the names the provisioner uses.
+var archAliases = map[string]string{
+	archX86_64: archX86_64,
+	"amd64":    archX86_64,
+	"x86-64":   archX86_64,
+	archArm64:  archArm64,
+	"aarch64":  archArm64,
+}
+
+// normalizeArchFirmware validates the Arch and Firmware of the
+// machine, and rewrites them into the canonical form.
+func (n *Machine) normalizeArchFirmware() error {
+	if n.Arch != "" {
+		arch, ok := archAliases[strings.ToLower(n.Arch)]
+		if !ok {
+			return fmt.Errorf("machine: Unknown arch %s for %s", n.Arch, n.Name)
+		}
+		n.Arch = arch
+	}
+	if n.Firmware != "" {
+		firmware := strings.ToLower(n.Firmware)
+		if firmware != firmwareBios && firmware != firmwareUefi {
+			return fmt.Errorf("machine: Unknown firmware %s for %s", n.Firmware, n.Name)
+		}
+		n.Firmware = firmware
+	}
+	return nil
+}
+
+// MachineArch returns the architecture of the machine, or the
+// default if it has not been set.
+func (n *Machine) MachineArch() string {
+	if n.Arch == "" {
+		return archX86_64
+	}
+	return n.Arch
+}
+
+// MachineFirmware returns the firmware of the machine, or the default
+// if it has not been set.
+func (n *Machine) MachineFirmware() string {
+	if n.Firmware == "" {
+		return firmwareBios
+	}
+	return n.Firmware
 }
 
 // HexAddress returns Address in raw hexadecimal format, suitable for
@@ -41,8 +143,31 @@ func (n *Machine) UUID() string {
 	return n.Uuid
 }
 
+// paramAt returns the machine parameter at keyPath, which is a
+// dot-separated list of keys for nested parameters.
+func (n *Machine) paramAt(keyPath string) (interface{}, bool) {
+	return paramAt(n.Params, keyPath)
+}
+
+// paramAt returns the param in params at keyPath, which is a
+// dot-separated list of keys into nested params.
+func paramAt(params map[string]interface{}, keyPath string) (interface{}, bool) {
+	var res interface{} = params
+	for _, key := range strings.Split(keyPath, ".") {
+		params, ok := res.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		res, ok = params[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return res, true
+}
+
 func (n *Machine) Url() string {
-	return provisionerURL + "/" + n.key()
+	return fileServerURL() + "/" + n.key()
 }
 
 func (n *Machine) prefix() string {
@@ -57,13 +182,31 @@ func (n *Machine) key() string {
 	return n.Path()
 }
 
+func (n *Machine) schemaVersion() int {
+	return n.SchemaVersion
+}
+
+func (n *Machine) setSchemaVersion(version int) {
+	n.SchemaVersion = version
+}
+
 func (n *Machine) newIsh() keySaver {
 	res := &Machine{Name: n.Name, Uuid: n.Uuid}
 	return keySaver(res)
 }
 
+// redacted returns a copy of the machine without its Token, which only
+// the machine itself should know.
+func (n *Machine) redacted() interface{} {
+	res := &Machine{}
+	*res = *n
+	res.Token = ""
+	return res
+}
+
 func (n *Machine) onChange(oldThing interface{}) error {
-	if old, ok := oldThing.(*Machine); ok && old != nil {
+	old, _ := oldThing.(*Machine)
+	if old != nil {
 		if old.Uuid != "" {
 			if old.Uuid != n.Uuid {
 				return fmt.Errorf("machine: Cannot change machine UUID %s", old.Uuid)
@@ -71,11 +214,9 @@ func (n *Machine) onChange(oldThing interface{}) error {
 		} else if old.Name != n.Name {
 			return fmt.Errorf("machine: Cannot change name of machine %s", old.Name)
 		}
-		oldBootEnv := &BootEnv{Name: old.BootEnv}
-		if err := backend.load(oldBootEnv); err != nil {
-			return err
+		if n.onlyRenderFailureChanged(old) {
+			return nil
 		}
-		oldBootEnv.DeleteRenderedTemplates(old)
 	}
 	addr := net.ParseIP(n.Address)
 	if addr != nil {
@@ -84,31 +225,368 @@ func (n *Machine) onChange(oldThing interface{}) error {
 	if addr == nil {
 		return fmt.Errorf("machine: %s  is not a valid IPv4 address", n.Address)
 	}
+	if err := n.normalizeArchFirmware(); err != nil {
+		return err
+	}
+	for i, mac := range n.Macs {
+		normalized, err := normalizeMac(mac)
+		if err != nil {
+			return fmt.Errorf("machine: %s is not a valid MAC address for %s", mac, n.Name)
+		}
+		n.Macs[i] = normalized
+	}
+	for _, initrd := range n.Initrds {
+		if initrd == "" || path.IsAbs(initrd) || !pathUnder(fileRoot, path.Join(fileRoot, initrd)) {
+			return fmt.Errorf("machine: Initrd %q for %s must be a path inside the file root", initrd, n.Name)
+		}
+	}
+	if n.Token == "" {
+		if old != nil && old.Token != "" {
+			n.Token = old.Token
+		} else {
+			n.Token = uuid.NewV4().String()
+		}
+	}
+	// Machines in maintenance are not rendered, but their BootEnv must
+	// still exist for them to come out of it.
 	bootEnv := &BootEnv{Name: n.BootEnv}
 	if err := backend.load(bootEnv); err != nil {
 		return err
 	}
+	if n.Maintenance {
+		if old != nil && old.BootEnv != n.BootEnv {
+			return fmt.Errorf("machine: %s is in maintenance, clear Maintenance before changing its BootEnv", n.Name)
+		}
+		logger.Printf("machine: Not rendering %s, it is in maintenance\n", n.Name)
+		machineParamIndex.update(old, n)
+		machineBootEnvIndex.update(old, n)
+		return nil
+	}
+	if old != nil && old.Maintenance {
+		logger.Printf("machine: %s is out of maintenance, rendering it again\n", n.Name)
+	}
+	// Hold the render lock across removing the old files and
+	// rendering the new ones, so that nothing else can render the
+	// machine in between.
+	unlock := machineRenderLocks.lock(n.key())
+	defer unlock()
+	if old != nil {
+		if old.key() != n.key() {
+			unlockOld := machineRenderLocks.lock(old.key())
+			defer unlockOld()
+		}
+		oldBootEnv := &BootEnv{Name: old.BootEnv}
+		if err := backend.load(oldBootEnv); err != nil {
+			return err
+		}
+		oldBootEnv.DeleteRenderedTemplates(old, false)
+	}
 	if err := bootEnv.RenderTemplates(n); err != nil {
 		return err
 	}
+	n.RenderFailure = nil
+	machineParamIndex.update(old, n)
+	machineBootEnvIndex.update(old, n)
 	return nil
 }
 
+// onlyRenderFailureChanged returns whether the RenderFailure of the
+// machine is all that differs from old, in which case there is nothing
+// to render again.
+func (n *Machine) onlyRenderFailureChanged(old *Machine) bool {
+	if reflect.DeepEqual(n.RenderFailure, old.RenderFailure) {
+		return false
+	}
+	a, b := *n, *old
+	a.RenderFailure, b.RenderFailure = nil, nil
+	return reflect.DeepEqual(&a, &b)
+}
+
 func (n *Machine) onDelete() error {
 	bootEnv := &BootEnv{Name: n.BootEnv}
 	if err := backend.load(bootEnv); err != nil {
 		return err
 	}
-	bootEnv.DeleteRenderedTemplates(n)
+	unlock := machineRenderLocks.lock(n.key())
+	defer unlock()
+	bootEnv.DeleteRenderedTemplates(n, false)
+	if machineDir, err := stagingDir(n); err == nil {
+		os.RemoveAll(machineDir)
+	}
+	machineParamIndex.update(n, nil)
+	machineBootEnvIndex.update(n, nil)
 	return nil
 }
 
+// render renders the templates of the machine's boot environment for
+// it again, and clears any RenderFailure it has.  It waits for any
+// other render of the machine to finish first.
+func (n *Machine) render() error {
+	bootEnv := &BootEnv{Name: n.BootEnv}
+	if err := backend.load(bootEnv); err != nil {
+		return err
+	}
+	unlock := machineRenderLocks.lock(n.key())
+	defer unlock()
+	if err := bootEnv.RenderTemplates(n); err != nil {
+		return err
+	}
+	return setRenderFailure(n, nil)
+}
+
+func machineRender(c *gin.Context) {
+	machine := popMachine(c.Param(`name`))
+	if err := backend.load(machine); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	if err := machine.render(); err != nil {
+		respondWithError(c, http.StatusConflict, err)
+		return
+	}
+	c.JSON(http.StatusOK, publicForm(machine))
+}
+
+// EffectiveParam is a param as templates rendered for a machine see
+// it.
+type EffectiveParam struct {
+	Name string
+	// Where the value comes from: machine if the machine has the
+	// param, or missing if only its boot environment declares it.
+	// Templates only ever see the params of the machine itself.
+	Source   string
+	Value    interface{} `json:",omitempty"` // The value templates see, if any.
+	Required bool        `json:",omitempty"` // Whether the boot environment requires the param.
+	// The value the boot environment suggests for the param.  It is
+	// not used when rendering.
+	Default interface{} `json:",omitempty"`
+}
+
+const (
+	paramFromMachine = "machine"
+	paramMissing     = "missing"
+)
+
+// EffectiveParams returns the params that templates rendered for the
+// machine see, as .Param and friends look them up, along with the
+// params its boot environment declares that it does not have, sorted
+// by name.
+func (n *Machine) EffectiveParams() ([]*EffectiveParam, error) {
+	params := map[string]*EffectiveParam{}
+	for name, val := range n.Params {
+		params[name] = &EffectiveParam{Name: name, Source: paramFromMachine, Value: val}
+	}
+	if n.BootEnv != "" {
+		bootEnv := &BootEnv{Name: n.BootEnv}
+		if err := backend.load(bootEnv); err != nil {
+			return nil, fmt.Errorf("machine: %s uses missing bootenv %s", n.Name, n.BootEnv)
+		}
+		for _, schema := range bootEnv.ParamSchema() {
+			param, ok := params[schema.Name]
+			if !ok {
+				param = &EffectiveParam{Name: schema.Name, Source: paramMissing}
+				params[schema.Name] = param
+			}
+			param.Required = schema.Required
+			param.Default = schema.Default
+		}
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := make([]*EffectiveParam, len(names))
+	for i, name := range names {
+		res[i] = params[name]
+	}
+	return res, nil
+}
+
+func machineParams(c *gin.Context) {
+	machine := popMachine(c.Param(`name`))
+	if err := backend.load(machine); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	res, err := machine.EffectiveParams()
+	if err != nil {
+		respondWithError(c, http.StatusConflict, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+func machineTemplate(c *gin.Context) {
+	machine := popMachine(c.Param(`name`))
+	if err := backend.load(machine); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	bootEnv := &BootEnv{Name: machine.BootEnv}
+	if err := backend.load(bootEnv); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	res, found, err := bootEnv.RenderTemplate(machine, c.Param(`template`))
+	if !found {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	if err != nil {
+		respondWithError(c, http.StatusConflict, err)
+		return
+	}
+	etag := etagFor(contentSha256(string(res)))
+	c.Writer.Header().Set("ETag", etag)
+	if etagMatches(c.Request.Header.Get("If-None-Match"), etag) {
+		c.Data(http.StatusNotModified, "text/plain; charset=utf-8", nil)
+		return
+	}
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", res)
+}
+
+// machineRenderedFiles lists the files that deleting the machine, or
+// moving it off its boot environment, would delete, without deleting
+// anything.  ?bootenv= works them out for another boot environment.
+func machineRenderedFiles(c *gin.Context) {
+	machine := popMachine(c.Param(`name`))
+	if err := backend.load(machine); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	bootEnv := &BootEnv{Name: machine.BootEnv}
+	if name := c.Query(`bootenv`); name != "" {
+		bootEnv.Name = name
+	}
+	if err := backend.load(bootEnv); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	res, err := bootEnv.DeleteRenderedTemplates(machine, true)
+	if err != nil {
+		respondWithError(c, http.StatusConflict, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// MachineCloneRequest names the new machine to clone a machine into.
+// Everything else is copied from the machine being cloned.
+type MachineCloneRequest struct {
+	Name    string   // The name of the new machine.  Required.
+	Uuid    string   // The UUID of the new machine, if any.
+	Address string   // The IPv4 address the new machine PXE boots with.  Required.
+	Macs    []string // The MAC addresses of the new machine, if any.
+}
+
+// InitrdPaths expands the extra initrds of the machine into full paths
+// appropriate for proto.
+func (n *Machine) InitrdPaths(proto string) ([]string, error) {
+	res := make([]string, len(n.Initrds))
+	for i, initrd := range n.Initrds {
+		switch proto {
+		case "disk":
+			res[i] = path.Join(fileRoot, initrd)
+		case "tftp":
+			res[i] = path.Clean(initrd)
+		case "http":
+			res[i] = fileServerURL() + "/" + path.Clean(initrd)
+		default:
+			return nil, fmt.Errorf("machine: Unknown protocol %v", proto)
+		}
+	}
+	return res, nil
+}
+
+// Clone returns a new machine with the params, boot environments,
+// arch, firmware, and tenant of the machine, and the identity in req.
+// Nothing is saved.  It fails if a machine with the new name, UUID, or
+// any of the new MACs already exists.
+func (n *Machine) Clone(req *MachineCloneRequest) (*Machine, error) {
+	if req.Name == "" {
+		return nil, &ValidationError{Kind: "machine", Name: n.Name, Field: "Name", Message: "Name is required to clone a machine"}
+	}
+	if req.Address == "" {
+		return nil, &ValidationError{Kind: "machine", Name: n.Name, Field: "Address", Message: "Address is required to clone a machine"}
+	}
+	// Deep copy the params, so that the machines do not share nested
+	// params in memory.
+	params := map[string]interface{}{}
+	buf, err := json.Marshal(n.Params)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &params); err != nil {
+		return nil, err
+	}
+	res := &Machine{
+		Name:        req.Name,
+		Uuid:        req.Uuid,
+		Address:     req.Address,
+		Macs:        req.Macs,
+		BootEnv:     n.BootEnv,
+		Params:      params,
+		NextBootEnv: n.NextBootEnv,
+		Arch:        n.Arch,
+		Firmware:    n.Firmware,
+		TenantId:    n.TenantId,
+	}
+	machines, err := (&Machine{}).List()
+	if err != nil {
+		return nil, err
+	}
+	macs := map[string]bool{}
+	for _, mac := range req.Macs {
+		normalized, err := normalizeMac(mac)
+		if err != nil {
+			return nil, &ValidationError{Kind: "machine", Name: req.Name, Field: "Macs", Message: err.Error()}
+		}
+		macs[normalized] = true
+	}
+	for _, machine := range machines {
+		if machine.Name == res.Name || machine.key() == res.key() {
+			return nil, fmt.Errorf("machine: %s already exists", res.Name)
+		}
+		for _, mac := range machine.Macs {
+			if macs[mac] {
+				return nil, fmt.Errorf("machine: %s already has MAC %s", machine.Name, mac)
+			}
+		}
+	}
+	return res, nil
+}
+
+func machineClone(c *gin.Context) {
+	machine := popMachine(c.Param(`name`))
+	if err := backend.load(machine); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	req := &MachineCloneRequest{}
+	if err := c.Bind(req); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+		return
+	}
+	clone, err := machine.Clone(req)
+	if err != nil {
+		respondWithError(c, http.StatusConflict, err)
+		return
+	}
+	logger.Printf("backend: Cloning %v into %v\n", machine.key(), clone.key())
+	if err := backend.save(clone, nil); err != nil {
+		respondWithError(c, http.StatusConflict, err)
+		return
+	}
+	c.JSON(http.StatusCreated, publicForm(clone))
+}
+
 func (b *Machine) List() ([]*Machine, error) {
 	things := backend.list(b)
 	res := make([]*Machine, len(things))
 	for i, blob := range things {
 		machine := &Machine{}
-		if err := json.Unmarshal(blob, machine); err != nil {
+		if err := decodeThing(blob, machine); err != nil {
 			return nil, err
 		}
 		res[i] = machine
@@ -119,3 +597,155 @@ func (b *Machine) List() ([]*Machine, error) {
 func (b *Machine) RebuildRebarData() error {
 	return nil
 }
+
+// nextBootEnv figures out which boot environment the machine should
+// transition to after its install is finished.
+func (n *Machine) nextBootEnv() (string, error) {
+	if n.NextBootEnv != "" {
+		return n.NextBootEnv, nil
+	}
+	bootEnv := &BootEnv{Name: n.BootEnv}
+	if err := backend.load(bootEnv); err != nil {
+		return "", err
+	}
+	if bootEnv.NextBootEnv != "" {
+		return bootEnv.NextBootEnv, nil
+	}
+	return defaultLocalBootEnv, nil
+}
+
+func machineInstallComplete(c *gin.Context) {
+	oldMachine := popMachine(c.Param(`name`))
+	if err := backend.load(oldMachine); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	if !machineAuthorized(c, oldMachine) {
+		respondWithError(c, http.StatusUnauthorized, errors.New("machine: Missing or invalid machine token"))
+		return
+	}
+	nextEnv, err := oldMachine.nextBootEnv()
+	if err != nil {
+		respondWithError(c, http.StatusConflict, err)
+		return
+	}
+	newMachine := &Machine{}
+	*newMachine = *oldMachine
+	newMachine.BootEnv = nextEnv
+	newMachine.InstallFailure = nil
+	logger.Printf("machine: %s finished installing, switching from %s to %s\n",
+		oldMachine.Name,
+		oldMachine.BootEnv,
+		nextEnv)
+	if err := backend.save(newMachine, oldMachine); err != nil {
+		respondWithError(c, http.StatusConflict, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, publicForm(newMachine))
+}
+
+// machineAuthorized checks to see if the request carries the token of
+// machine as a bearer token.
+func machineAuthorized(c *gin.Context, machine *Machine) bool {
+	auth := c.Request.Header.Get("Authorization")
+	if machine.Token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(machine.Token)) == 1
+}
+
+func machineInstallFailed(c *gin.Context) {
+	oldMachine := popMachine(c.Param(`name`))
+	if err := backend.load(oldMachine); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	if !machineAuthorized(c, oldMachine) {
+		respondWithError(c, http.StatusUnauthorized, errors.New("machine: Missing or invalid machine token"))
+		return
+	}
+	failure := &InstallFailure{}
+	if c.Request.ContentLength != 0 {
+		if err := c.Bind(failure); err != nil {
+			respondWithError(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+	failure.Time = time.Now()
+	newMachine := &Machine{}
+	*newMachine = *oldMachine
+	newMachine.InstallFailure = failure
+	logger.Printf("machine: %s failed to install %s in phase %q: %s\n",
+		oldMachine.Name,
+		oldMachine.BootEnv,
+		failure.Phase,
+		failure.Message)
+	if err := backend.save(newMachine, oldMachine); err != nil {
+		respondWithError(c, http.StatusConflict, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, publicForm(newMachine))
+}
+
+// machineSettableParam checks to see if machines are allowed to set
+// the param name on themselves.
+func machineSettableParam(name string) bool {
+	for _, allowed := range strings.Split(machineSettableParams, ",") {
+		if strings.TrimSpace(allowed) == name && name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// machineSetParams lets a machine store facts it learns while it
+// installs, like its assigned IP or its disks, as params on itself.
+// Only the params in --machine-settable-params can be set, so a
+// machine cannot change anything else about itself.  The machine is
+// only saved, and rendered again, if a param actually changed.
+func machineSetParams(c *gin.Context) {
+	oldMachine := popMachine(c.Param(`name`))
+	if err := backend.load(oldMachine); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	if !machineAuthorized(c, oldMachine) {
+		respondWithError(c, http.StatusUnauthorized, errors.New("machine: Missing or invalid machine token"))
+		return
+	}
+	params := map[string]interface{}{}
+	if err := c.Bind(&params); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+		return
+	}
+	for name := range params {
+		if !machineSettableParam(name) {
+			respondWithError(c, http.StatusForbidden, fmt.Errorf("machine: %s is not allowed to set param %s", oldMachine.Name, name))
+			return
+		}
+	}
+	newMachine := &Machine{}
+	*newMachine = *oldMachine
+	newMachine.Params = make(map[string]interface{}, len(oldMachine.Params)+len(params))
+	for name, val := range oldMachine.Params {
+		newMachine.Params[name] = val
+	}
+	changed := false
+	for name, val := range params {
+		if old, ok := oldMachine.Params[name]; !ok || !reflect.DeepEqual(old, val) {
+			newMachine.Params[name] = val
+			changed = true
+		}
+	}
+	if !changed {
+		c.JSON(http.StatusOK, publicForm(oldMachine))
+		return
+	}
+	logger.Printf("machine: %s set its params %v\n", oldMachine.Name, params)
+	if err := backend.save(newMachine, oldMachine); err != nil {
+		respondWithError(c, http.StatusConflict, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, publicForm(newMachine))
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/digitalrebar/rebar-api/client"
 	"github.com/gin-gonic/gin"
@@ -17,8 +18,47 @@ import (
 )
 
 var machineKey, fileRoot, provisionerURL, commandURL string
+var fileURL, tftpServerHost string
+var tenantURLFile string
+var machineSettableParams string
+var allowAbsoluteRenderPaths bool
 var backEndType string
+var defaultLocalBootEnv string
+var discoveryBootEnv, biosBootFile, uefiBootFile string
+var templateSandbox bool
+var templateDenyFuncs string
+var templateFetchHosts string
+var isoDownloadAttempts int
+var isoRetryDelay time.Duration
+var fileDownloadAttempts int
+var keepIsos bool
+var canaryDir, canaryName string
+var keyringDir, gpgvPath string
+var templateSource, templateSourceMap, templateSyncDir, gitPath string
+var templateSyncInterval time.Duration
+var rebarOSAllow, rebarOSDeny string
+var fileRetryDelay time.Duration
+var fileRefreshInterval time.Duration
+var renderConcurrency int
+var fileDownloadConcurrency int
+var renderStaging bool
+var renderValidateFirst bool
+var renderHookDir string
+var renderHookTimeout time.Duration
+var renderMaxSize int64
+var templateTimeout time.Duration
+var templateCacheTTL time.Duration
+var downloadTimeout, explodeTimeout, renderTimeout, bootEnvTimeout time.Duration
+var downloadConnectTimeout, downloadReadTimeout time.Duration
+var explodeNative bool
+var bootEnvSaveAttempts int
+var bootEnvSaveConcurrency int
+var bootEnvSaveRetryDelay time.Duration
+var dirMode = fileMode(0755)
+var explodeOwner fileOwner
+var explodeUmask optionalFileMode
 var apiPort int64
+var filePort int64
 var backend storageBackend
 var api *gin.Engine
 var logger *log.Logger
@@ -38,6 +78,10 @@ func init() {
 		"api-port",
 		8092,
 		"Port the HTTP API should listen on")
+	flag.Int64Var(&filePort,
+		"file-port",
+		0,
+		"Port to serve the file root over plain HTTP on.  Leave at 0 to rely on an external web server")
 	flag.StringVar(&fileRoot,
 		"file-root",
 		"/tftpboot",
@@ -50,6 +94,207 @@ func init() {
 		"command",
 		"https://localhost:3000",
 		"Public URL for the Command and Control server machines should communicate with")
+	flag.BoolVar(&allowAbsoluteRenderPaths,
+		"allow-absolute-render-paths",
+		false,
+		"Allow template paths to expand to absolute paths outside of the file root")
+	flag.StringVar(&machineSettableParams,
+		"machine-settable-params",
+		"",
+		"Comma-separated list of the params machines may set on themselves with their token")
+	flag.StringVar(&tenantURLFile,
+		"tenant-urls",
+		"",
+		"JSON file mapping TenantIds to the provisioner and command URLs their machines should use")
+	flag.StringVar(&fileURL,
+		"file-url",
+		"",
+		"Public base URL files under the file root are served over HTTP from, if not the provisioner")
+	flag.StringVar(&tftpServerHost,
+		"tftp-server",
+		"",
+		"Host files under the file root are served over TFTP from, if not the provisioner's host")
+	flag.StringVar(&defaultLocalBootEnv,
+		"default-local-bootenv",
+		"local",
+		"Boot environment machines switch to after installing if neither they nor their boot environment specify one")
+	flag.StringVar(&discoveryBootEnv,
+		"discovery-bootenv",
+		"sledgehammer",
+		"Boot environment DHCP helpers should boot machines with unknown MACs into")
+	flag.StringVar(&biosBootFile,
+		"bios-boot-file",
+		"discovery/lpxelinux.0",
+		"TFTP path of the boot loader for machines booting with BIOS firmware")
+	flag.StringVar(&uefiBootFile,
+		"uefi-boot-file",
+		"discovery/elilo.efi",
+		"TFTP path of the boot loader for machines booting with UEFI firmware")
+	flag.BoolVar(&templateSandbox,
+		"template-sandbox",
+		false,
+		"Forbid templates from calling helper functions that reach outside of the provisioner")
+	flag.StringVar(&templateDenyFuncs,
+		"template-deny-funcs",
+		"",
+		"Comma-separated list of template helper functions templates may not call")
+	flag.StringVar(&templateFetchHosts,
+		"template-fetch-hosts",
+		"",
+		"Comma-separated list of hosts the fetch template helper may get URLs from.  fetch is forbidden if empty")
+	flag.IntVar(&isoDownloadAttempts,
+		"iso-download-attempts",
+		3,
+		"How many times to try downloading an ISO from its IsoUrl before giving up")
+	flag.DurationVar(&isoRetryDelay,
+		"iso-retry-delay",
+		10*time.Second,
+		"How long to wait before retrying a failed ISO download.  Doubles after each attempt")
+	flag.StringVar(&keyringDir,
+		"keyring-dir",
+		"",
+		"Directory holding the GPG keyrings boot environments may check ISO checksum signatures with.  Leave empty to disable signature checks")
+	flag.StringVar(&gpgvPath,
+		"gpgv",
+		"gpgv",
+		"The gpgv command to check signatures with")
+	flag.StringVar(&templateSource,
+		"template-source",
+		"",
+		"Git repository or HTTP base URL to sync templates from.  Leave empty to disable syncing")
+	flag.StringVar(&templateSourceMap,
+		"template-source-map",
+		"",
+		"JSON file mapping paths in --template-source to the UUIDs of the templates they are synced into")
+	flag.DurationVar(&templateSyncInterval,
+		"template-sync-interval",
+		0,
+		"How often to sync templates from --template-source.  0 to only sync when asked to")
+	flag.StringVar(&templateSyncDir,
+		"template-sync-dir",
+		"/var/cache/provisioner-mgmt/template-source",
+		"Where to keep the checkout of a git --template-source")
+	flag.StringVar(&gitPath,
+		"git",
+		"git",
+		"The git command to sync templates with")
+	flag.BoolVar(&keepIsos,
+		"keep-isos",
+		true,
+		"Keep ISOs after exploding them, unless the boot environment says otherwise")
+	flag.StringVar(&canaryDir,
+		"canary-dir",
+		"",
+		"Directory to keep the canaries that mark ISOs as exploded in, relative to the file root if not absolute.  Leave empty to keep them in the install trees")
+	flag.StringVar(&canaryName,
+		"canary-name",
+		defaultCanaryName,
+		"Template for the names of the canaries that mark ISOs as exploded, rendered against the bootenv's OS")
+	flag.IntVar(&fileDownloadAttempts,
+		"file-download-attempts",
+		3,
+		"How many times to try downloading each of a boot environment's files before giving up, unless the file says otherwise")
+	flag.DurationVar(&fileRetryDelay,
+		"file-retry-delay",
+		10*time.Second,
+		"How long to wait before retrying a failed file download, unless the file says otherwise.  Doubles after each attempt")
+	flag.DurationVar(&fileRefreshInterval,
+		"file-refresh-interval",
+		0,
+		"How often to check boot environment files for changes upstream and download the ones that changed.  0 disables the checks")
+	flag.IntVar(&fileDownloadConcurrency,
+		"file-download-concurrency",
+		4,
+		"How many of a boot environment's files to download at once")
+	flag.IntVar(&renderConcurrency,
+		"render-concurrency",
+		8,
+		"How many machines to render templates for at once when a boot environment changes")
+	flag.BoolVar(&renderStaging,
+		"render-staging",
+		false,
+		"Write all of a machine's rendered templates to a staging directory before moving them into place")
+	flag.BoolVar(&renderValidateFirst,
+		"render-validate-first",
+		false,
+		"When a boot environment changes, render every affected machine in memory first, and only write files if all of them succeed")
+	flag.Int64Var(&renderMaxSize,
+		"render-max-size",
+		16<<20,
+		"Largest a single rendered template can be, in bytes.  0 means no limit")
+	flag.DurationVar(&templateTimeout,
+		"template-timeout",
+		30*time.Second,
+		"How long rendering a single template can take.  0 means no limit")
+	flag.DurationVar(&templateCacheTTL,
+		"template-cache-ttl",
+		time.Minute,
+		"How long to keep loaded templates in memory before loading them from the backend again.  0 disables the cache")
+	flag.StringVar(&renderHookDir,
+		"render-hook-dir",
+		"",
+		"Directory holding the commands templates may name as their Hook.  Leave empty to disable render hooks")
+	flag.DurationVar(&renderHookTimeout,
+		"render-hook-timeout",
+		time.Minute,
+		"How long a render hook can take")
+	flag.DurationVar(&downloadTimeout,
+		"download-timeout",
+		30*time.Minute,
+		"How long a single ISO or file download can take")
+	flag.DurationVar(&downloadConnectTimeout,
+		"download-connect-timeout",
+		30*time.Second,
+		"How long connecting to a server to download from can take")
+	flag.DurationVar(&downloadReadTimeout,
+		"download-read-timeout",
+		2*time.Minute,
+		"How long a download can go without receiving anything before it is abandoned")
+	flag.BoolVar(&explodeNative,
+		"explode-native",
+		true,
+		"Extract ISOs without /explode_iso.sh, which is then only used for ISOs that cannot be extracted natively")
+	flag.DurationVar(&explodeTimeout,
+		"explode-timeout",
+		30*time.Minute,
+		"How long exploding an ISO can take")
+	flag.DurationVar(&renderTimeout,
+		"render-timeout",
+		5*time.Minute,
+		"How long rendering the machines using a boot environment can take when it changes")
+	flag.DurationVar(&bootEnvTimeout,
+		"bootenv-timeout",
+		3*time.Hour,
+		"How long all of the work done when a boot environment changes can take")
+	flag.IntVar(&bootEnvSaveAttempts,
+		"bootenv-save-attempts",
+		3,
+		"How many times to try saving a boot environment that fails for a reason that may go away, such as a timeout")
+	flag.DurationVar(&bootEnvSaveRetryDelay,
+		"bootenv-save-retry-delay",
+		5*time.Second,
+		"How long to wait before trying to save a boot environment again.  Doubles after each attempt")
+	flag.IntVar(&bootEnvSaveConcurrency,
+		"bootenv-save-concurrency",
+		4,
+		"How many boot environments can be exploding ISOs, downloading files, and rendering at once.  The rest wait their turn.  0 for no limit")
+	flag.Var(&dirMode,
+		"dir-mode",
+		"Mode, in octal, to create directories under the file root with")
+	flag.Var(&explodeOwner,
+		"explode-owner",
+		"Owner to give exploded ISO trees, as user or user:group.  Leave empty to keep the owner the extractor gives them")
+	flag.Var(&explodeUmask,
+		"explode-umask",
+		"Umask to apply to exploded ISO trees, in octal, like 0022.  Leave empty to keep the modes the extractor gives them")
+	flag.StringVar(&rebarOSAllow,
+		"rebar-os-allow",
+		"",
+		"Comma-separated list of the only OS names to offer to Rebar.  Leave empty to offer all of them")
+	flag.StringVar(&rebarOSDeny,
+		"rebar-os-deny",
+		"",
+		"Comma-separated list of OS names never to offer to Rebar")
 	flag.StringVar(&cacert,
 		"cacert",
 		"/etc/prov-base-cert.pem",
@@ -109,35 +354,80 @@ func main() {
 		logger.Fatalf("Unknown storage backend type %v\n", backEndType)
 	}
 	api := gin.Default()
+	api.Use(errorEnvelope)
 	if err != nil {
 		logger.Fatal(err)
 	}
+	if tenantURLFile != "" {
+		if err := loadTenantURLs(tenantURLFile); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if bootEnvSaveConcurrency > 0 {
+		bootEnvSaveSlots = make(chan struct{}, bootEnvSaveConcurrency)
+	}
+	httpClient = newHTTPClient(downloadConnectTimeout, downloadReadTimeout)
+	logHealth()
+	if fileRefreshInterval > 0 {
+		go refreshFilesEvery(fileRefreshInterval)
+	}
+	if templateSource != "" && templateSourceMap != "" && templateSyncInterval > 0 {
+		go syncTemplatesEvery(templateSyncInterval)
+	}
+	if filePort > 0 {
+		go func() {
+			logger.Fatal(serveFiles(filePort))
+		}()
+	}
 	// bootenv methods
-	api.GET("/bootenvs",
-		func(c *gin.Context) {
-			listThings(c, &BootEnv{})
-		})
+	api.GET("/bootenvs", listBootEnvs)
 	api.POST("/bootenvs",
 		func(c *gin.Context) {
+			if validateOnly(c) {
+				validateBootEnv(c)
+				return
+			}
 			createThing(c, &BootEnv{})
 		})
 	api.GET("/bootenvs/:name",
 		func(c *gin.Context) {
 			getThing(c, &BootEnv{Name: c.Param(`name`)})
 		})
+	api.PUT("/bootenvs/:name",
+		func(c *gin.Context) {
+			if validateOnly(c) {
+				validateBootEnv(c)
+				return
+			}
+			ensureThing(c, &BootEnv{Name: c.Param(`name`)}, &BootEnv{})
+		})
 	api.PATCH("/bootenvs/:name",
 		func(c *gin.Context) {
+			if validateOnly(c) {
+				validateBootEnvPatch(c)
+				return
+			}
 			updateThing(c, &BootEnv{Name: c.Param(`name`)}, &BootEnv{})
 		})
 	api.DELETE("/bootenvs/:name",
 		func(c *gin.Context) {
 			deleteThing(c, &BootEnv{Name: c.Param(`name`)})
 		})
-	// machine methods
-	api.GET("/machines",
+	api.GET("/bootenvs/:name/params",
 		func(c *gin.Context) {
-			listThings(c, &Machine{})
+			bootEnv := &BootEnv{Name: c.Param(`name`)}
+			if err := backend.load(bootEnv); err != nil {
+				c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+				return
+			}
+			c.JSON(http.StatusOK, bootEnv.ParamSchema())
 		})
+	api.GET("/bootenvs/:name/urls", bootEnvURLs)
+	api.GET("/bootenvs/:name/referenced-params", bootEnvReferencedParams)
+	api.POST("/bootenvs/:name/refresh-files", bootEnvRefreshFiles)
+	api.POST("/bootenvs/:name/promote-iso", bootEnvPromoteIso)
+	// machine methods
+	api.GET("/machines", listMachines)
 	api.POST("/machines",
 		func(c *gin.Context) {
 			createThing(c, &Machine{})
@@ -153,6 +443,84 @@ func main() {
 		func(c *gin.Context) {
 			deleteThing(c, popMachine(c.Param(`name`)))
 		})
+	api.POST("/machines/:name/install-complete", machineInstallComplete)
+	api.POST("/machines/:name/install-failed", machineInstallFailed)
+	api.POST("/machines/:name/set-params", machineSetParams)
+	api.POST("/machines/:name/render", machineRender)
+	api.GET("/machines/:name/params", machineParams)
+	api.GET("/machines/:name/verify", verifyMachine)
+	api.GET("/machines/:name/templates/:template", machineTemplate)
+	api.GET("/machines/:name/rendered-files", machineRenderedFiles)
+	api.GET("/machines/:name/rendered.tar", machineRenderedTar)
+	api.GET("/machines/:name/preflight", machinePreflight)
+	api.GET("/machines/:name/next", machineNextAction)
+	api.POST("/machines/:name/clone", machineClone)
+
+	// family methods
+	api.GET("/families",
+		func(c *gin.Context) {
+			listThings(c, &OsFamily{})
+		})
+	api.POST("/families",
+		func(c *gin.Context) {
+			createThing(c, &OsFamily{})
+		})
+	api.GET("/families/:name",
+		func(c *gin.Context) {
+			getThing(c, &OsFamily{Name: c.Param(`name`)})
+		})
+	api.PATCH("/families/:name",
+		func(c *gin.Context) {
+			updateThing(c, &OsFamily{Name: c.Param(`name`)}, &OsFamily{})
+		})
+	api.DELETE("/families/:name",
+		func(c *gin.Context) {
+			deleteThing(c, &OsFamily{Name: c.Param(`name`)})
+		})
+
+	// global template methods
+	api.GET("/global-templates",
+		func(c *gin.Context) {
+			listThings(c, &GlobalTemplate{})
+		})
+	api.POST("/global-templates",
+		func(c *gin.Context) {
+			createThing(c, &GlobalTemplate{})
+		})
+	api.GET("/global-templates/:name",
+		func(c *gin.Context) {
+			getThing(c, &GlobalTemplate{Name: c.Param(`name`)})
+		})
+	api.PATCH("/global-templates/:name",
+		func(c *gin.Context) {
+			updateThing(c, &GlobalTemplate{Name: c.Param(`name`)}, &GlobalTemplate{})
+		})
+	api.DELETE("/global-templates/:name",
+		func(c *gin.Context) {
+			deleteThing(c, &GlobalTemplate{Name: c.Param(`name`)})
+		})
+
+	// global param methods
+	api.GET("/global-params",
+		func(c *gin.Context) {
+			listThings(c, &GlobalParam{})
+		})
+	api.POST("/global-params",
+		func(c *gin.Context) {
+			createThing(c, &GlobalParam{})
+		})
+	api.GET("/global-params/:name",
+		func(c *gin.Context) {
+			getThing(c, &GlobalParam{Name: c.Param(`name`)})
+		})
+	api.PATCH("/global-params/:name",
+		func(c *gin.Context) {
+			updateThing(c, &GlobalParam{Name: c.Param(`name`)}, &GlobalParam{})
+		})
+	api.DELETE("/global-params/:name",
+		func(c *gin.Context) {
+			deleteThing(c, &GlobalParam{Name: c.Param(`name`)})
+		})
 
 	// template methods
 	api.GET("/templates",
@@ -177,6 +545,25 @@ func main() {
 			deleteThing(c, &Template{UUID: c.Param(`uuid`)})
 		})
 
+	api.GET("/verify", verifyBootEnvs)
+	api.GET("/verify/templates", verifyTemplateRefs)
+	api.POST("/rebuild-rebar-data", rebuildRebarData)
+	api.GET("/diff/bootenvs", diffBootEnvs)
+	api.GET("/bootenv-machines", listBootEnvMachines)
+	api.GET("/render-failures", listRenderFailures)
+	api.GET("/install-trees", listInstallTrees)
+	api.GET("/template-sync", getTemplateSync)
+	api.POST("/template-sync", postTemplateSync)
+	api.POST("/bulk/assign-bootenv", bulkAssignBootEnv)
+
+	// lint methods
+	api.POST("/lint/templates", lintTemplate)
+	api.POST("/lint/bootenvs", lintBootEnv)
+	api.POST("/lint/isos", checkBootEnvIso)
+	// boot file resolution for DHCP helpers
+	api.GET("/boot-files", resolveBootFile)
+	api.GET("/health", getHealth)
+
 	caCert, err := ioutil.ReadFile(cacert)
 	if err != nil {
 		log.Fatal(err)
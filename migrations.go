@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// versioned things are stamped with the version of the schema they
+// were saved with, so that they can be upgraded when they are loaded
+// by a newer provisioner.
+type versioned interface {
+	keySaver
+	schemaVersion() int
+	setSchemaVersion(int)
+}
+
+// migration upgrades a thing from one schema version to the next.
+type migration func(keySaver) error
+
+// migrations holds the upgrade steps for each kind of thing, keyed by
+// prefix.  migrations[prefix][i] upgrades a thing from version i to
+// version i+1, so the current schema version of a kind of thing is
+// the number of steps it has.  Things that were saved before schema
+// versions were added are version 0.
+//
+// Never change or remove a step once it has shipped.  Add a new one
+// to the end instead.
+var migrations = map[string][]migration{
+	"bootenvs": {migrateBootEnvType},
+	"machines": {migrateMachineArchFirmware},
+}
+
+// currentSchemaVersion returns the schema version things with prefix
+// are saved with.
+func currentSchemaVersion(prefix string) int {
+	return len(migrations[prefix])
+}
+
+// migrate upgrades thing to the current schema version for its kind.
+func migrate(thing keySaver) error {
+	v, ok := thing.(versioned)
+	if !ok {
+		return nil
+	}
+	steps := migrations[thing.prefix()]
+	from := v.schemaVersion()
+	if from > len(steps) {
+		return fmt.Errorf("migrate: %s has schema version %d, but the newest version we know about is %d",
+			thing.key(),
+			from,
+			len(steps))
+	}
+	for i := from; i < len(steps); i++ {
+		if err := steps[i](thing); err != nil {
+			return fmt.Errorf("migrate: Failed to upgrade %s from schema version %d: %v", thing.key(), i, err)
+		}
+	}
+	v.setSchemaVersion(len(steps))
+	return nil
+}
+
+// stampSchemaVersion marks thing as having the current schema
+// version for its kind before it is saved.
+func stampSchemaVersion(thing keySaver) {
+	if v, ok := thing.(versioned); ok {
+		v.setSchemaVersion(currentSchemaVersion(thing.prefix()))
+	}
+}
+
+// decodeThing unmarshals buf into thing, upgrades it to the current
+// schema version, and expands it if it was saved compacted.
+func decodeThing(buf []byte, thing keySaver) error {
+	if err := json.Unmarshal(buf, thing); err != nil {
+		return err
+	}
+	if err := migrate(thing); err != nil {
+		return err
+	}
+	if c, ok := thing.(compacted); ok {
+		return c.expand()
+	}
+	return nil
+}
+
+// migrateBootEnvType fills in Type for boot environments saved before
+// it existed.  Only the ones that follow the old convention for local
+// boot environments, with no kernel, initrds, or ISO to install from,
+// become local ones.  Everything else is an install boot environment,
+// which is what an empty Type already meant.
+func migrateBootEnvType(thing keySaver) error {
+	b := thing.(*BootEnv)
+	if b.Type != "" {
+		return nil
+	}
+	if b.Kernel == "" && len(b.Initrds) == 0 && (b.OS == nil || b.OS.IsoFile == "") {
+		logger.Printf("migrate: %s has no kernel, initrds, or ISO, treating it as a local bootenv\n", b.Name)
+		b.Type = bootEnvLocal
+		return nil
+	}
+	if b.Kernel == "" {
+		logger.Printf("migrate: %s has no kernel but has initrds or an ISO, leaving it as an install bootenv\n", b.Name)
+	}
+	b.Type = bootEnvInstall
+	return nil
+}
+
+// migrateMachineArchFirmware fills in Arch and Firmware for machines
+// saved before they existed from the arch and firmware params people
+// used to set by hand, if any.  Machines without them get the defaults.
+func migrateMachineArchFirmware(thing keySaver) error {
+	n := thing.(*Machine)
+	if arch, ok := n.Params["arch"].(string); ok && n.Arch == "" {
+		if canonical, ok := archAliases[strings.ToLower(arch)]; ok {
+			n.Arch = canonical
+		}
+	}
+	if firmware, ok := n.Params["firmware"].(string); ok && n.Firmware == "" {
+		firmware = strings.ToLower(firmware)
+		if firmware == firmwareBios || firmware == firmwareUefi {
+			n.Firmware = firmware
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The things NextAction can tell a machine's bootloader to do.
+const (
+	// actionBootLocal boots the machine from its local disk.
+	actionBootLocal = "boot-local"
+	// actionBoot boots the kernel and initrds of the machine's boot
+	// environment with its boot params.
+	actionBoot = "boot"
+	// actionChain hands off to the rendered iPXE script of the
+	// machine's boot environment.
+	actionChain = "chain"
+)
+
+// NextAction is what a machine's bootloader should do next, worked out
+// from the machine and its boot environment, so that bootloaders can
+// ask once instead of each template deciding for itself.
+type NextAction struct {
+	Machine    string
+	BootEnv    string
+	Action     string   // One of "boot-local", "boot", or "chain".
+	Reason     string   // Why the machine should do that.
+	Kernel     string   `json:",omitempty"` // The URL of the kernel to boot, for "boot".
+	Initrds    []string `json:",omitempty"` // The URLs of the initrds to load, for "boot".
+	BootParams string   `json:",omitempty"` // The kernel command line, for "boot".
+	ChainURL   string   `json:",omitempty"` // The URL of the script to chain to, for "chain".
+}
+
+// chainTemplate returns the name of the template machines chain to
+// when the boot environment has no Kernel.
+func (b *BootEnv) chainTemplate() string {
+	if b.ChainTemplate == "" {
+		return "ipxe"
+	}
+	return b.ChainTemplate
+}
+
+// NextAction works out what machine should do the next time it boots
+// into the boot environment.  Machines missing RequiredParams are
+// handled the way rendering handles them: an error, the chain
+// template skipped if it uses them, or the FallbackBootEnv instead.
+func (b *BootEnv) NextAction(machine *Machine) (*NextAction, error) {
+	res := &NextAction{Machine: machine.Name, BootEnv: b.Name}
+	if machine.Maintenance {
+		res.Action = actionBootLocal
+		res.Reason = "the machine is in maintenance"
+		return res, nil
+	}
+	if b.Type == bootEnvLocal {
+		res.Action = actionBootLocal
+		res.Reason = "the bootenv boots from the local disk"
+		return res, nil
+	}
+	if err := b.parseTemplates(); err != nil {
+		return nil, err
+	}
+	skip := map[string]bool{}
+	if missingParams := b.missingParams(machine); len(missingParams) > 0 {
+		switch b.OnMissingParams {
+		case missingParamsSkip:
+			skip = b.templatesUsing(missingParams)
+		case missingParamsFallback:
+			fallback, err := b.missingParamsFallback(machine, missingParams)
+			if err != nil {
+				return nil, err
+			}
+			res, err := fallback.NextAction(machine)
+			if err != nil {
+				return nil, err
+			}
+			res.Reason = fmt.Sprintf("the machine is missing params %s for %s, so %s",
+				strings.Join(missingParams, ", "),
+				b.Name,
+				res.Reason)
+			return res, nil
+		default:
+			return nil, b.missingParamsError(machine, missingParams)
+		}
+	}
+	vars := newRenderData(machine, b)
+	if b.Kernel != "" {
+		kernel, err := vars.KernelURL("http")
+		if err != nil {
+			return nil, err
+		}
+		initrds, err := vars.InitrdURLs("http")
+		if err != nil {
+			return nil, err
+		}
+		params, err := vars.BootParams()
+		if err != nil {
+			return nil, &TemplateRenderError{Template: "BootParams", Machine: machine.Name, Message: err.Error()}
+		}
+		res.Action = actionBoot
+		res.Reason = "the bootenv boots a kernel"
+		res.Kernel = kernel
+		res.Initrds = initrds
+		res.BootParams = params
+		return res, nil
+	}
+	if err := b.RenderPaths(machine); err != nil {
+		return nil, err
+	}
+	chain := b.chainTemplate()
+	for _, tmpl := range b.templates {
+		if tmpl.Name != chain || tmpl.finalPath == "" || skip[tmpl.Name] || !tmpl.appliesTo(machine) {
+			continue
+		}
+		if !pathUnder(fileRoot, tmpl.finalPath) {
+			break
+		}
+		res.Action = actionChain
+		res.Reason = fmt.Sprintf("the bootenv has the %s script", chain)
+		res.ChainURL = fileServerURL() + "/" + tarName(tmpl.finalPath)
+		return res, nil
+	}
+	return nil, fmt.Errorf("bootenv: %s has no kernel or %s script for %s to boot", b.Name, chain, machine.Name)
+}
+
+// ipxeScript returns the action as an iPXE script.
+func (a *NextAction) ipxeScript() string {
+	lines := []string{"#!ipxe", "# " + a.Reason}
+	switch a.Action {
+	case actionBootLocal:
+		lines = append(lines, "sanboot --no-describe --drive 0x80 || exit")
+	case actionBoot:
+		kernel := "kernel " + a.Kernel
+		if a.BootParams != "" {
+			kernel += " " + a.BootParams
+		}
+		lines = append(lines, kernel)
+		for _, initrd := range a.Initrds {
+			lines = append(lines, "initrd "+initrd)
+		}
+		lines = append(lines, "boot")
+	case actionChain:
+		lines = append(lines, "chain "+a.ChainURL)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func machineNextAction(c *gin.Context) {
+	machine := popMachine(c.Param(`name`))
+	if err := backend.load(machine); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	bootEnv := &BootEnv{Name: machine.BootEnv}
+	if err := backend.load(bootEnv); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	res, err := bootEnv.NextAction(machine)
+	if err != nil {
+		respondWithError(c, http.StatusConflict, err)
+		return
+	}
+	if c.Query(`format`) == "ipxe" {
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(res.ipxeScript()))
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// paramIndex finds machines by the value of one of their params
+// without loading every machine.  Each param path is indexed the first
+// time it is searched for, and kept up to date as machines are saved
+// and deleted after that.
+type paramIndex struct {
+	sync.Mutex
+	// paths[keyPath][value][machine key] is the machine with value at
+	// keyPath, where value is the JSON encoding of the param.
+	paths map[string]map[string]map[string]*Machine
+}
+
+var machineParamIndex = &paramIndex{paths: map[string]map[string]map[string]*Machine{}}
+
+// paramIndexValue returns how the param at keyPath of machine is
+// indexed, if it has it.
+func paramIndexValue(machine *Machine, keyPath string) (string, bool) {
+	val, ok := machine.paramAt(keyPath)
+	if !ok {
+		return "", false
+	}
+	buf, err := json.Marshal(val)
+	if err != nil {
+		return "", false
+	}
+	return string(buf), true
+}
+
+func (i *paramIndex) add(keyPath string, machine *Machine) {
+	val, ok := paramIndexValue(machine, keyPath)
+	if !ok {
+		return
+	}
+	values := i.paths[keyPath]
+	if values[val] == nil {
+		values[val] = map[string]*Machine{}
+	}
+	m := *machine
+	values[val][machine.key()] = &m
+}
+
+func (i *paramIndex) drop(keyPath string, machine *Machine) {
+	val, ok := paramIndexValue(machine, keyPath)
+	if !ok {
+		return
+	}
+	values := i.paths[keyPath]
+	delete(values[val], machine.key())
+	if len(values[val]) == 0 {
+		delete(values, val)
+	}
+}
+
+// update replaces old with machine in all of the indexed paths.
+// Either of them can be nil.
+func (i *paramIndex) update(old, machine *Machine) {
+	i.Lock()
+	defer i.Unlock()
+	for keyPath := range i.paths {
+		if old != nil {
+			i.drop(keyPath, old)
+		}
+		if machine != nil {
+			i.add(keyPath, machine)
+		}
+	}
+}
+
+// search returns the machines whose param at keyPath is value, sorted
+// by name.  value matches string params as-is, and any param by its
+// JSON encoding, so 7, true, and {"a":1} can be searched for too.
+func (i *paramIndex) search(keyPath, value string) ([]*Machine, error) {
+	i.Lock()
+	defer i.Unlock()
+	values, ok := i.paths[keyPath]
+	if !ok {
+		machines, err := (&Machine{}).List()
+		if err != nil {
+			return nil, err
+		}
+		values = map[string]map[string]*Machine{}
+		i.paths[keyPath] = values
+		for _, machine := range machines {
+			i.add(keyPath, machine)
+		}
+	}
+	asString, _ := json.Marshal(value)
+	res := []*Machine{}
+	for _, val := range []string{string(asString), value} {
+		for _, machine := range values[val] {
+			res = append(res, machine)
+		}
+	}
+	sort.Sort(machinesByName(res))
+	return res, nil
+}
+
+type machinesByName []*Machine
+
+func (m machinesByName) Len() int           { return len(m) }
+func (m machinesByName) Less(i, j int) bool { return m[i].Name < m[j].Name }
+func (m machinesByName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+func listMachines(c *gin.Context) {
+	keyPath := c.Query("param")
+	if keyPath == "" {
+		listThings(c, &Machine{})
+		return
+	}
+	machines, err := machineParamIndex.search(keyPath, c.Query("value"))
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	res := make([]interface{}, len(machines))
+	for i, machine := range machines {
+		res[i] = publicForm(machine)
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// urlCheckTimeout bounds how long we wait for a server to tell us
+// whether a URL a boot environment downloads from is there.
+const urlCheckTimeout = 30 * time.Second
+
+// BootEnvValidation reports whether a boot environment could be saved
+// as it is, without saving it.
+type BootEnvValidation struct {
+	BootEnv  string
+	Valid    bool           // Whether there are no problems with a Severity of "error".
+	Problems []*LintWarning // What is wrong with the boot environment, or risky about it.
+}
+
+func (v *BootEnvValidation) add(severity, location, message string) {
+	v.Problems = append(v.Problems, &LintWarning{
+		Severity: severity,
+		Location: location,
+		Message:  message,
+	})
+}
+
+// checkURL asks the server at url whether it is there, without
+// downloading it.  Servers that do not allow HEAD are asked with a GET
+// that is hung up on as soon as it answers.
+func checkURL(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, urlCheckTimeout)
+	defer cancel()
+	var resp *http.Response
+	for _, method := range []string{"HEAD", "GET"} {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			return &DownloadError{URL: url, Message: err.Error()}
+		}
+		resp, err = httpClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return &DownloadError{URL: url, Message: err.Error()}
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed &&
+			resp.StatusCode != http.StatusNotImplemented {
+			break
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &DownloadError{
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			Message:    "Server returned " + resp.Status,
+		}
+	}
+	return nil
+}
+
+// CheckDefinition runs the checks saving the boot environment would,
+// along with Lint, and checks that everything it downloads can be
+// reached.  Nothing is downloaded, exploded, rendered, or saved.
+func (b *BootEnv) CheckDefinition(ctx context.Context) *BootEnvValidation {
+	res := &BootEnvValidation{BootEnv: b.Name, Problems: []*LintWarning{}}
+	if err := b.Validate(); err != nil {
+		res.add("error", b.Name, err.Error())
+	}
+	res.Problems = append(res.Problems, b.Lint()...)
+	if b.OS != nil {
+		urls := []struct{ location, url string }{
+			{b.Name + ".OS.IsoUrl", b.OS.IsoUrl},
+			{b.Name + ".OS.IsoChecksumsUrl", b.OS.IsoChecksumsUrl},
+			{b.Name + ".OS.IsoSignatureUrl", b.OS.IsoSignatureUrl},
+		}
+		for _, f := range b.OS.Files {
+			urls = append(urls,
+				struct{ location, url string }{b.Name + ".OS.Files." + f.Name + ".URL", f.URL},
+				struct{ location, url string }{b.Name + ".OS.Files." + f.Name + ".ValidationURL", f.ValidationURL})
+		}
+		for _, u := range urls {
+			if u.url == "" {
+				continue
+			}
+			if err := checkURL(ctx, u.url); err != nil {
+				res.add("error", u.location, err.Error())
+			}
+		}
+		// A dead mirror is only a problem if all of them are dead.
+		for _, f := range b.OS.Files {
+			for i, mirror := range f.Mirrors {
+				if err := checkURL(ctx, mirror); err != nil {
+					res.add("warning", fmt.Sprintf("%s.OS.Files.%s.Mirrors[%d]", b.Name, f.Name, i), err.Error())
+				}
+			}
+		}
+		if b.OS.IsoUrl != "" && b.OS.IsoSha256 == "" && b.OS.IsoChecksumsUrl == "" {
+			res.add("warning", b.Name+".OS", "the ISO will not be checked, it has no IsoSha256 or IsoChecksumsUrl")
+		}
+	}
+	res.Valid = true
+	for _, problem := range res.Problems {
+		if problem.Severity == "error" {
+			res.Valid = false
+			break
+		}
+	}
+	return res
+}
+
+// validateOnly reports whether a create or update request only wants
+// the boot environment checked, as with ?validate=true.
+func validateOnly(c *gin.Context) bool {
+	return c.Query(`validate`) == "true"
+}
+
+func respondWithValidation(c *gin.Context, bootEnv *BootEnv) {
+	ctx, cancel := context.WithTimeout(context.Background(), bootEnvTimeout)
+	defer cancel()
+	res := bootEnv.CheckDefinition(ctx)
+	status := http.StatusOK
+	if !res.Valid {
+		status = http.StatusUnprocessableEntity
+	}
+	c.JSON(status, res)
+}
+
+// validateBootEnv checks the boot environment in the body of a create
+// request without saving it.
+func validateBootEnv(c *gin.Context) {
+	bootEnv := &BootEnv{}
+	if err := c.Bind(bootEnv); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+		return
+	}
+	respondWithValidation(c, bootEnv)
+}
+
+// validateBootEnvPatch checks what the boot environment would be with
+// the patch in the body of an update request applied, without saving
+// it.
+func validateBootEnvPatch(c *gin.Context) {
+	oldBootEnv := &BootEnv{Name: c.Param(`name`)}
+	bootEnv := &BootEnv{}
+	if !patchThing(c, oldBootEnv, bootEnv) {
+		return
+	}
+	if bootEnv.Name != oldBootEnv.Name {
+		respondWithError(c, http.StatusUnprocessableEntity,
+			&ValidationError{Kind: "bootenv", Name: oldBootEnv.Name, Field: "Name", Message: "Cannot change name of bootenv"})
+		return
+	}
+	respondWithValidation(c, bootEnv)
+}
+
+// MachinePreflight reports whether a machine is ready to boot into its
+// boot environment.
+type MachinePreflight struct {
+	Machine string
+	BootEnv string
+	Ready   bool           // Whether all of the Checks are OK.
+	Checks  []*HealthCheck // The checks that were run, in order.
+}
+
+func (p *MachinePreflight) check(name string, err error) bool {
+	check := &HealthCheck{Name: name, OK: err == nil}
+	if err != nil {
+		check.Message = err.Error()
+		p.Ready = false
+	}
+	p.Checks = append(p.Checks, check)
+	return err == nil
+}
+
+// checkPresent makes sure that the file at the partial path name in
+// the install tree of the boot environment is there.
+func (b *BootEnv) checkPresent(name string) error {
+	filePath, err := b.PathFor("disk", name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		return fmt.Errorf("bootenv: %s for %s is not there: %v", name, b.Name, err)
+	}
+	return nil
+}
+
+// Preflight runs every check that has to pass for machine to boot
+// into the boot environment, without touching anything on disk.
+func (b *BootEnv) Preflight(machine *Machine) *MachinePreflight {
+	res := &MachinePreflight{
+		Machine: machine.Name,
+		BootEnv: b.Name,
+		Ready:   true,
+		Checks:  []*HealthCheck{},
+	}
+	res.check("bootenv", b.Validate())
+	if b.OS != nil && b.OS.IsoFile != "" {
+		var err error
+		if canaryPath, canaryErr := b.findCanary(); canaryErr != nil {
+			err = canaryErr
+		} else if canaryPath == "" {
+			err = fmt.Errorf("iso: %s has not been exploded for %s", b.OS.IsoFile, b.Name)
+		}
+		res.check("iso", err)
+	}
+	if b.Kernel != "" {
+		res.check("kernel", b.checkPresent(b.Kernel))
+	}
+	for _, initrd := range b.Initrds {
+		res.check("initrd "+initrd, b.checkPresent(initrd))
+	}
+	if extra, err := machine.InitrdPaths("disk"); err == nil {
+		for i, filePath := range extra {
+			var err error
+			if _, statErr := os.Stat(filePath); statErr != nil {
+				err = fmt.Errorf("machine: Initrd %s for %s is not there: %v", machine.Initrds[i], machine.Name, statErr)
+			}
+			res.check("initrd "+machine.Initrds[i], err)
+		}
+	}
+	var missingParams []string
+	for _, param := range b.RequiredParams {
+		if _, ok := machine.Params[param]; !ok {
+			missingParams = append(missingParams, param)
+		}
+	}
+	var err error
+	if len(missingParams) > 0 && b.OnMissingParams != missingParamsSkip && b.OnMissingParams != missingParamsFallback {
+		err = b.missingParamsError(machine, missingParams)
+	}
+	res.check("params", err)
+	_, err = b.renderFiles(machine)
+	res.check("render", err)
+	return res
+}
+
+func machinePreflight(c *gin.Context) {
+	machine := popMachine(c.Param(`name`))
+	if err := backend.load(machine); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	bootEnv := &BootEnv{Name: machine.BootEnv}
+	var res *MachinePreflight
+	if err := backend.load(bootEnv); err != nil {
+		res = &MachinePreflight{Machine: machine.Name, BootEnv: machine.BootEnv, Ready: true, Checks: []*HealthCheck{}}
+		res.check("bootenv", fmt.Errorf("bootenv: %s does not exist", machine.BootEnv))
+	} else {
+		res = bootEnv.Preflight(machine)
+	}
+	status := http.StatusOK
+	if !res.Ready {
+		status = http.StatusConflict
+	}
+	c.JSON(status, res)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cacheValidators are what the server told us about the version of a
+// file we last downloaded, so that we can ask it whether the file has
+// changed without downloading it again.
+type cacheValidators struct {
+	// The URL the file was downloaded from, for partial downloads,
+	// which can only be resumed from the same URL.
+	URL          string `json:",omitempty"`
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+}
+
+// validatorsPath returns where the cache validators for the file at
+// filePath are kept.
+func validatorsPath(filePath string) string {
+	return filepath.Join(filepath.Dir(filePath), "."+filepath.Base(filePath)+".validators")
+}
+
+func loadValidators(filePath string) *cacheValidators {
+	buf, err := ioutil.ReadFile(validatorsPath(filePath))
+	if err != nil {
+		return nil
+	}
+	res := &cacheValidators{}
+	if err := json.Unmarshal(buf, res); err != nil {
+		return nil
+	}
+	return res
+}
+
+func saveValidators(filePath string, v *cacheValidators) error {
+	if v.ETag == "" && v.LastModified == "" {
+		os.Remove(validatorsPath(filePath))
+		return nil
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(validatorsPath(filePath), buf, 0644)
+}
+
+// downloadIfChanged fetches url into dest unless the server says it
+// has not changed since the version described by prev.  It returns
+// whether anything was downloaded, along with the cache validators
+// for what was.
+func downloadIfChanged(ctx context.Context, url, dest string, prev *cacheValidators) (bool, *cacheValidators, error) {
+	ctx, cancel := context.WithTimeout(ctx, downloadTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return false, nil, err
+	}
+	if prev != nil {
+		if prev.ETag != "" {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+		if prev.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.LastModified)
+		}
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, nil, &DownloadError{URL: url, Message: err.Error()}
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return false, prev, nil
+	case http.StatusOK:
+	default:
+		return false, nil, &DownloadError{
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			Message:    "Server returned " + resp.Status,
+		}
+	}
+	out, err := os.Create(dest)
+	if err != nil {
+		return false, nil, err
+	}
+	body := newStallTimer(resp.Body, cancel)
+	defer body.stop()
+	if _, err := io.Copy(out, body); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return false, nil, body.copyErr(ctx, url, dest, err)
+	}
+	out.Sync()
+	if err := out.Close(); err != nil {
+		os.Remove(dest)
+		return false, nil, err
+	}
+	return true, &cacheValidators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// refreshFile downloads f again if it has changed upstream.  Files
+// with a ValidationURL are only downloaded again if their published
+// checksum no longer matches the file we have.  Either way, the
+// server is asked whether the file has changed since we last
+// downloaded it, and the new version only replaces the old one once
+// it has been downloaded and checked.  It returns whether the file
+// changed.
+func (b *BootEnv) refreshFile(ctx context.Context, f *FileData) (bool, error) {
+	filePath, err := b.PathFor("disk", f.diskName())
+	if err != nil {
+		return false, err
+	}
+	expected, err := f.expectedSha256()
+	if err != nil {
+		return false, err
+	}
+	if expected != "" {
+		if actual, err := sha256File(filePath); err == nil && actual == expected {
+			return false, nil
+		}
+	}
+	var prev *cacheValidators
+	if _, err := os.Stat(filePath); err == nil {
+		prev = loadValidators(filePath)
+	}
+	mode, err := dirModeFor(f.DirMode)
+	if err != nil {
+		return false, err
+	}
+	if err := makeDirs(filepath.Dir(filePath), mode); err != nil {
+		return false, fmt.Errorf("file: Unable to create dir for %s: %v", filePath, err)
+	}
+	tmpPath := filePath + ".refresh"
+	changed, validators, err := downloadIfChanged(ctx, f.URL, tmpPath, prev)
+	if err != nil || !changed {
+		return false, err
+	}
+	if expected != "" {
+		actual, err := sha256File(tmpPath)
+		if err != nil {
+			os.Remove(tmpPath)
+			return false, err
+		}
+		if actual != expected {
+			os.Remove(tmpPath)
+			return false, &ChecksumMismatchError{Path: filePath, Expected: expected, Actual: actual}
+		}
+	}
+	if err := f.checkSignature(ctx, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("file: Unable to move %s into place: %v", filePath, err)
+	}
+	return true, saveValidators(filePath, validators)
+}
+
+// RefreshFiles checks all of the files of the boot environment for
+// changes upstream, and downloads the ones that have changed.  If any
+// of the files that changed are templates, the machines using the
+// boot environment are rendered again.
+func (b *BootEnv) RefreshFiles(ctx context.Context) ([]*FileResult, error) {
+	// The files are refreshed at the same time.
+	mux := &sync.Mutex{}
+	templateChanged := false
+	results, err := b.eachFile(func(f *FileData, res *FileResult) error {
+		attempts, delay, err := f.retryPolicy()
+		if err != nil {
+			return err
+		}
+		changed := false
+		res.Attempts, err = retryDownload(ctx, f.URL, attempts, delay, func() error {
+			var err error
+			changed, err = b.refreshFile(ctx, f)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if changed {
+			logger.Printf("bootenv: %s changed upstream, downloaded it again for %s\n", f.Name, b.Name)
+			res.Status = fileDownloaded
+			mux.Lock()
+			templateChanged = templateChanged || f.Template
+			mux.Unlock()
+		} else {
+			res.Status = fileSkipped
+		}
+		return nil
+	})
+	if err != nil || !templateChanged {
+		return results, err
+	}
+	machines, err := (&Machine{}).List()
+	if err != nil {
+		return results, err
+	}
+	toRender := []*Machine{}
+	for _, machine := range machines {
+		if machine.BootEnv == b.Name {
+			toRender = append(toRender, machine)
+		}
+	}
+	return results, b.renderMachines(ctx, toRender)
+}
+
+// refreshAllFiles refreshes the files of every boot environment.
+func refreshAllFiles() {
+	bootEnvs, err := (&BootEnv{}).List()
+	if err != nil {
+		logger.Printf("bootenv: Unable to list bootenvs to refresh their files: %v\n", err)
+		return
+	}
+	for _, bootEnv := range bootEnvs {
+		if bootEnv.OS == nil || len(bootEnv.OS.Files) == 0 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), bootEnvTimeout)
+		if _, err := bootEnv.RefreshFiles(ctx); err != nil {
+			logger.Printf("bootenv: Failed to refresh files for %s: %v\n", bootEnv.Name, err)
+		}
+		cancel()
+	}
+}
+
+// refreshFilesEvery refreshes the files of every boot environment
+// every interval, forever.
+func refreshFilesEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		refreshAllFiles()
+	}
+}
+
+func bootEnvRefreshFiles(c *gin.Context) {
+	bootEnv := &BootEnv{Name: c.Param(`name`)}
+	if err := backend.load(bootEnv); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), bootEnvTimeout)
+	defer cancel()
+	res, err := bootEnv.RefreshFiles(ctx)
+	if err != nil {
+		respondWithError(c, http.StatusConflict, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
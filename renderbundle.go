@@ -0,0 +1,74 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tarName returns the name a rendered file at filePath gets in a tar
+// of a machine's rendered files: its path relative to the file root,
+// or its absolute path without the leading slash if it is outside it.
+func tarName(filePath string) string {
+	if rel, err := filepath.Rel(fileRoot, filePath); err == nil && pathUnder(fileRoot, filePath) {
+		return filepath.ToSlash(rel)
+	}
+	return strings.TrimPrefix(filepath.ToSlash(filePath), "/")
+}
+
+// RenderTar renders all of the templates of the boot environment for
+// machine in memory, and returns them as a tar.  Nothing on disk is
+// touched.
+func (b *BootEnv) RenderTar(machine *Machine) ([]byte, error) {
+	files, err := b.renderFiles(machine)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	now := time.Now()
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:    tarName(f.path),
+			Mode:    0644,
+			Size:    int64(len(f.contents)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(f.contents); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func machineRenderedTar(c *gin.Context) {
+	machine := popMachine(c.Param(`name`))
+	if err := backend.load(machine); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	bootEnv := &BootEnv{Name: machine.BootEnv}
+	if err := backend.load(bootEnv); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	res, err := bootEnv.RenderTar(machine)
+	if err != nil {
+		respondWithError(c, http.StatusConflict, err)
+		return
+	}
+	c.Writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", machine.Name+".tar"))
+	c.Data(http.StatusOK, "application/x-tar", res)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The ways a boot environment can handle machines that fail to render
+// when it is saved.
+const (
+	// renderFailureError fails the save.  This is the default.
+	renderFailureError = "error"
+	// renderFailureRecord records the failure and saves the boot
+	// environment anyway.
+	renderFailureRecord = "record"
+	// renderFailureFallback records the failure and renders the
+	// FallbackBootEnv for the machine instead.
+	renderFailureFallback = "fallback"
+)
+
+// RenderFailure is a machine that failed to render when its boot
+// environment was saved with an OnRenderFailure of "record" or
+// "fallback".
+type RenderFailure struct {
+	Machine  string
+	BootEnv  string
+	Message  string    // Why the machine failed to render.
+	Fallback string    `json:",omitempty"` // The boot environment rendered for the machine instead, if any.
+	Time     time.Time // When the machine failed to render.
+}
+
+// setRenderFailure saves the machine with failure as its
+// RenderFailure, which can be nil to clear it.  The machine is loaded
+// again first, so that nothing else saved since is lost, and it is
+// not rendered again, since nothing else about it changes.
+func setRenderFailure(machine *Machine, failure *RenderFailure) error {
+	old := machine.newIsh().(*Machine)
+	if err := backend.load(old); err != nil {
+		return err
+	}
+	if old.RenderFailure == nil && failure == nil {
+		return nil
+	}
+	newMachine := &Machine{}
+	*newMachine = *old
+	newMachine.RenderFailure = failure
+	return backend.save(newMachine, old)
+}
+
+type renderFailuresByMachine []*RenderFailure
+
+func (r renderFailuresByMachine) Len() int           { return len(r) }
+func (r renderFailuresByMachine) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r renderFailuresByMachine) Less(i, j int) bool { return r[i].Machine < r[j].Machine }
+
+// listFailedRenders returns the render failures recorded on machines
+// for bootEnv, or all of them if it is "", sorted by machine.
+func listFailedRenders(bootEnv string) ([]*RenderFailure, error) {
+	machines, err := (&Machine{}).List()
+	if err != nil {
+		return nil, err
+	}
+	res := []*RenderFailure{}
+	for _, machine := range machines {
+		failure := machine.RenderFailure
+		if failure != nil && (bootEnv == "" || failure.BootEnv == bootEnv) {
+			res = append(res, failure)
+		}
+	}
+	sort.Sort(renderFailuresByMachine(res))
+	return res, nil
+}
+
+// tolerateRenderFailure handles machine failing to render with err
+// according to OnRenderFailure.  It returns the failure it recorded on
+// the machine, or the error the render should fail with if it did not
+// record one.
+func (b *BootEnv) tolerateRenderFailure(machine *Machine, err error) (*RenderFailure, error) {
+	if b.OnRenderFailure != renderFailureRecord && b.OnRenderFailure != renderFailureFallback {
+		return nil, err
+	}
+	failure := &RenderFailure{
+		Machine: machine.Name,
+		BootEnv: b.Name,
+		Message: err.Error(),
+		Time:    time.Now(),
+	}
+	if b.OnRenderFailure == renderFailureFallback {
+		name := b.FallbackBootEnv
+		if name == "" {
+			name = discoveryBootEnv
+		}
+		fallback := &BootEnv{Name: name}
+		if name == b.Name || backend.load(fallback) != nil {
+			return nil, err
+		}
+		if fallbackErr := fallback.RenderTemplates(machine); fallbackErr != nil {
+			return nil, err
+		}
+		failure.Fallback = name
+	}
+	if saveErr := setRenderFailure(machine, failure); saveErr != nil {
+		return nil, fmt.Errorf("%v, and it could not be recorded: %v", err, saveErr)
+	}
+	logger.Printf("bootenv: %s failed to render for %s, recorded it and carrying on: %v\n", machine.Name, b.Name, err)
+	return failure, nil
+}
+
+func listRenderFailures(c *gin.Context) {
+	res, err := listFailedRenders(c.Query(`bootenv`))
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// savedBootEnv is a boot environment as it is returned once it has
+// been saved, along with the machines that failed to render for it.
+type savedBootEnv struct {
+	*BootEnv
+	RenderFailures []*RenderFailure `json:",omitempty"`
+}
+
+// redacted adds the render failures recorded when the boot
+// environment was saved to it.
+func (b *BootEnv) redacted() interface{} {
+	if len(b.renderFailures) == 0 {
+		return b
+	}
+	return &savedBootEnv{BootEnv: b, RenderFailures: b.renderFailures}
+}
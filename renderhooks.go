@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// renderHookPath returns the command in --render-hook-dir that hook
+// names.  Hooks are off unless --render-hook-dir is set, and can only
+// name commands directly inside it, so a boot environment can never run
+// anything the administrator did not put there.
+func renderHookPath(hook string) (string, error) {
+	if renderHookDir == "" {
+		return "", fmt.Errorf("render hooks are disabled, set --render-hook-dir to enable them")
+	}
+	if hook == "." || hook == ".." || strings.ContainsAny(hook, `/\`) {
+		return "", fmt.Errorf("%s must be the name of a command in %s", hook, renderHookDir)
+	}
+	res := filepath.Join(renderHookDir, hook)
+	fi, err := os.Stat(res)
+	if err != nil {
+		return "", fmt.Errorf("no hook named %s in %s", hook, renderHookDir)
+	}
+	if !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+		return "", fmt.Errorf("%s is not an executable file", res)
+	}
+	return res, nil
+}
+
+// runRenderHook runs the hook of f once f has been written for
+// machine.  The hook gets the path it was written to and the machine it
+// was rendered for in its environment, and fails the render if it
+// exits with an error.
+func runRenderHook(b *BootEnv, machine *Machine, f *renderedFile) error {
+	hookPath, err := renderHookPath(f.hook)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), renderHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, hookPath)
+	cmd.Dir = renderHookDir
+	cmd.Env = append(os.Environ(),
+		"RENDERED_PATH="+f.path,
+		"RENDERED_TEMPLATE="+f.name,
+		"MACHINE_NAME="+machine.Name,
+		"MACHINE_UUID="+machine.Uuid,
+		"BOOTENV="+b.Name)
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = ctx.Err()
+		}
+		return fmt.Errorf("hook %s failed: %v: %s", f.hook, err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// TemplateBody holds the contents of templates by their SHA256, so
+// that templates with identical contents only store them once.
+type TemplateBody struct {
+	Sha256    string   // The SHA256 of Contents.
+	Contents  string   // The raw template.
+	Templates []string // The UUIDs of the templates that have these contents.
+	// Contents, gzipped, as the body is stored in the backend.  Bodies
+	// saved before they were compressed only have Contents.
+	Gzipped []byte `json:",omitempty"`
+}
+
+func (b *TemplateBody) prefix() string {
+	return "template-bodies"
+}
+
+func (b *TemplateBody) key() string {
+	return path.Join(b.prefix(), b.Sha256)
+}
+
+func (b *TemplateBody) newIsh() keySaver {
+	res := &TemplateBody{Sha256: b.Sha256}
+	return keySaver(res)
+}
+
+// compact stores the contents of the body gzipped, since templates
+// with large embedded scripts compress well.
+func (b *TemplateBody) compact() interface{} {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write([]byte(b.Contents)); err != nil {
+		return b
+	}
+	if err := zw.Close(); err != nil {
+		return b
+	}
+	return &TemplateBody{Sha256: b.Sha256, Templates: b.Templates, Gzipped: buf.Bytes()}
+}
+
+// expand decompresses the contents of a loaded body.
+func (b *TemplateBody) expand() error {
+	if len(b.Gzipped) == 0 {
+		return nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b.Gzipped))
+	if err != nil {
+		return fmt.Errorf("template: Body %s is corrupt: %v", b.Sha256, err)
+	}
+	defer zr.Close()
+	contents, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return fmt.Errorf("template: Body %s is corrupt: %v", b.Sha256, err)
+	}
+	b.Contents = string(contents)
+	b.Gzipped = nil
+	return nil
+}
+
+func (b *TemplateBody) onChange(oldThing interface{}) error {
+	if b.Sha256 != contentSha256(b.Contents) {
+		return fmt.Errorf("template: Body %s does not match its contents", b.Sha256)
+	}
+	return nil
+}
+
+func (b *TemplateBody) onDelete() error {
+	compiledTemplates.forget(b.Sha256)
+	return nil
+}
+
+func (b *TemplateBody) RebuildRebarData() error {
+	return nil
+}
+
+// contentSha256 returns the hex SHA256 of contents.
+func contentSha256(contents string) string {
+	sum := sha256.Sum256([]byte(contents))
+	return hex.EncodeToString(sum[:])
+}
+
+// templateBodyMux serializes updates to the list of templates that
+// use each body.
+var templateBodyMux = &sync.Mutex{}
+
+// storeTemplateBody makes sure that the body of the template is
+// stored, so that the template can be saved without its contents.  The
+// template is not recorded as using the body until it has been saved,
+// by useTemplateBody.  A new body stored for a template that then fails
+// to save is used by nothing until a template with the same contents
+// is saved.
+func storeTemplateBody(t *Template) error {
+	templateBodyMux.Lock()
+	defer templateBodyMux.Unlock()
+	body := &TemplateBody{Sha256: t.Sha256}
+	if err := backend.load(body); err == nil {
+		return nil
+	}
+	body.Contents = t.Contents
+	body.Templates = []string{}
+	return backend.save(body, nil)
+}
+
+// useTemplateBody makes sure that the body of the template is stored,
+// and that the body knows the template uses it.
+func useTemplateBody(t *Template) error {
+	templateBodyMux.Lock()
+	defer templateBodyMux.Unlock()
+	body := &TemplateBody{Sha256: t.Sha256}
+	var oldBody interface{}
+	if err := backend.load(body); err == nil {
+		for _, uuid := range body.Templates {
+			if uuid == t.UUID {
+				return nil
+			}
+		}
+		old := *body
+		oldBody = &old
+	} else {
+		body.Contents = t.Contents
+	}
+	body.Templates = append(body.Templates, t.UUID)
+	sort.Strings(body.Templates)
+	return backend.save(body, oldBody)
+}
+
+// releaseTemplateBody records that the template with uuid no longer
+// uses the body with sha, and removes the body once nothing uses it.
+func releaseTemplateBody(sha, uuid string) error {
+	if sha == "" {
+		return nil
+	}
+	templateBodyMux.Lock()
+	defer templateBodyMux.Unlock()
+	body := &TemplateBody{Sha256: sha}
+	if err := backend.load(body); err != nil {
+		return nil
+	}
+	old := *body
+	body.Templates = []string{}
+	for _, user := range old.Templates {
+		if user != uuid {
+			body.Templates = append(body.Templates, user)
+		}
+	}
+	if len(body.Templates) == len(old.Templates) {
+		return nil
+	}
+	if len(body.Templates) == 0 {
+		return backend.remove(body)
+	}
+	return backend.save(body, &old)
+}
+
+// templateCache holds compiled templates by the SHA256 of their
+// contents, so that templates with identical contents are only
+// compiled once.
+type templateCache struct {
+	sync.Mutex
+	tmpls map[string]*template.Template
+}
+
+var compiledTemplates = &templateCache{tmpls: map[string]*template.Template{}}
+
+// get returns the compiled template for contents, compiling it if
+// we have not already.
+func (c *templateCache) get(sha, contents string) (*template.Template, error) {
+	c.Lock()
+	tmpl, ok := c.tmpls[sha]
+	c.Unlock()
+	if ok {
+		return tmpl, nil
+	}
+	tmpl, err := newTemplate(sha, contents)
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	c.tmpls[sha] = tmpl
+	c.Unlock()
+	return tmpl, nil
+}
+
+func (c *templateCache) forget(sha string) {
+	c.Lock()
+	delete(c.tmpls, sha)
+	c.Unlock()
+}
+
+// templateLoadCache holds loaded templates by UUID, so that rendering
+// many machines does not load the same templates from the backend
+// over and over.  Templates are forgotten when they are saved or
+// deleted here, and after --template-cache-ttl in case another
+// provisioner sharing the backend changed them, or a load raced with
+// a save.
+type templateLoadCache struct {
+	sync.Mutex
+	tmpls map[string]*cachedTemplate
+}
+
+type cachedTemplate struct {
+	tmpl   Template
+	loaded time.Time
+}
+
+var loadedTemplates = &templateLoadCache{tmpls: map[string]*cachedTemplate{}}
+
+// loadTemplate returns the template with uuid, from the cache if it
+// is there.
+func loadTemplate(uuid string) (*Template, error) {
+	c := loadedTemplates
+	if templateCacheTTL > 0 {
+		c.Lock()
+		cached, ok := c.tmpls[uuid]
+		c.Unlock()
+		if ok && time.Since(cached.loaded) < templateCacheTTL {
+			res := cached.tmpl
+			return &res, nil
+		}
+	}
+	res := &Template{UUID: uuid}
+	if err := backend.load(res); err != nil {
+		return nil, err
+	}
+	if templateCacheTTL > 0 {
+		c.Lock()
+		c.tmpls[uuid] = &cachedTemplate{tmpl: *res, loaded: time.Now()}
+		c.Unlock()
+	}
+	return res, nil
+}
+
+func (c *templateLoadCache) forget(uuid string) {
+	c.Lock()
+	delete(c.tmpls, uuid)
+	c.Unlock()
+}
@@ -6,16 +6,23 @@ import (
 	"io/ioutil"
 	"net/http"
 	"path"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 // Template represents a template that will be associated with a boot environment.
 type Template struct {
-	UUID       string // UUID is a unique identifier for this template.
-	Contents   string // Contents is the raw template.
-	parsedTmpl *template.Template
+	UUID     string // UUID is a unique identifier for this template.
+	Contents string // Contents is the raw template.
+	Sha256   string // Sha256 is the SHA256 of Contents, which are only stored once per Sha256.
+	// The Sha256 of the contents last synced from --template-source,
+	// if the template is synced from there.  If it does not match
+	// Sha256, the template has been changed by hand since.
+	SyncedSha256 string `json:",omitempty"`
+	parsedTmpl   *template.Template
 }
 
 func (t *Template) prefix() string {
@@ -31,13 +38,38 @@ func (t *Template) newIsh() keySaver {
 	return keySaver(res)
 }
 
+// compact leaves the contents out of the saved template, since they
+// are saved in its TemplateBody.
+func (t *Template) compact() interface{} {
+	return &Template{UUID: t.UUID, Sha256: t.Sha256, SyncedSha256: t.SyncedSha256}
+}
+
+// expand fills in the contents of a loaded template from its
+// TemplateBody.  Templates saved before bodies existed still have
+// their contents, and just need their Sha256 filled in.
+func (t *Template) expand() error {
+	if t.Contents != "" || t.Sha256 == "" {
+		t.Sha256 = contentSha256(t.Contents)
+		return nil
+	}
+	body := &TemplateBody{Sha256: t.Sha256}
+	if err := backend.load(body); err != nil {
+		return fmt.Errorf("template: Missing contents for %s: %v", t.UUID, err)
+	}
+	t.Contents = body.Contents
+	return nil
+}
+
 // Parse checks to make sure the template contents are valid according to text/template.
+// Templates are compiled once per Sha256, so templates with the same
+// contents share the compiled template.
 func (t *Template) Parse() (err error) {
-	parsedTmpl, err := template.New(t.UUID).Parse(t.Contents)
+	t.Sha256 = contentSha256(t.Contents)
+	parsedTmpl, err := compiledTemplates.get(t.Sha256, t.Contents)
 	if err != nil {
 		return err
 	}
-	t.parsedTmpl = parsedTmpl.Option("missingkey=error")
+	t.parsedTmpl = parsedTmpl
 	return nil
 }
 
@@ -57,7 +89,7 @@ func createTemplate(c *gin.Context) {
 	}
 	newThing.Contents = string(buf)
 	if err := backend.save(newThing, oldThing); err != nil {
-		c.JSON(http.StatusInternalServerError, NewError(err.Error()))
+		respondWithError(c, http.StatusInternalServerError, err)
 	}
 	c.JSON(finalStatus, newThing)
 }
@@ -66,10 +98,6 @@ func (t *Template) onChange(oldThing interface{}) error {
 	if t.Contents == "" || t.UUID == "" {
 		return fmt.Errorf("template: Illegal template %+v", t)
 	}
-	if err := t.Parse(); err != nil {
-		return fmt.Errorf("template: %s does not compile: %v", t.UUID, err)
-	}
-
 	if old, ok := oldThing.(*Template); ok && old != nil && old.UUID != t.UUID {
 		return fmt.Errorf("template: Cannot change UUID of %s", t.UUID)
 		machine := &Machine{}
@@ -93,6 +121,26 @@ func (t *Template) onChange(oldThing interface{}) error {
 			}
 		}
 	}
+	if err := t.Parse(); err != nil {
+		return &TemplateParseError{Template: t.UUID, Message: err.Error()}
+	}
+	return storeTemplateBody(t)
+}
+
+// afterSave records that the template uses its body, now that it has
+// been saved, and lets go of the body it used before.  If its contents
+// changed, the global templates that use it are rendered again.
+func (t *Template) afterSave(oldThing interface{}) error {
+	loadedTemplates.forget(t.UUID)
+	if err := useTemplateBody(t); err != nil {
+		return err
+	}
+	if old, ok := oldThing.(*Template); ok && old != nil && old.Sha256 != t.Sha256 {
+		if err := releaseTemplateBody(old.Sha256, t.UUID); err != nil {
+			return err
+		}
+		return renderGlobalTemplatesUsing(t)
+	}
 	return nil
 }
 
@@ -105,23 +153,159 @@ func (t *Template) onDelete() error {
 				if tmpl.UUID == t.UUID {
 					return fmt.Errorf("template: %s is in use by bootenv %s (template %s", t.UUID, bootEnv.Name, tmpl.Name)
 				}
+				if tmpl.SchemaUUID == t.UUID {
+					return fmt.Errorf("template: %s is in use by bootenv %s (schema of template %s)", t.UUID, bootEnv.Name, tmpl.Name)
+				}
 			}
 		}
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	family := &OsFamily{}
+	families, err := family.List()
+	if err == nil {
+		for _, family := range families {
+			for _, tmpl := range family.Templates {
+				if tmpl.UUID == t.UUID {
+					return fmt.Errorf("template: %s is in use by family %s (template %s)", t.UUID, family.Name, tmpl.Name)
+				}
+				if tmpl.SchemaUUID == t.UUID {
+					return fmt.Errorf("template: %s is in use by family %s (schema of template %s)", t.UUID, family.Name, tmpl.Name)
+				}
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	globalTemplate, err := globalTemplateUsing(t.UUID)
+	if err != nil {
+		return err
+	}
+	if globalTemplate != "" {
+		return fmt.Errorf("template: %s is in use by global template %s", t.UUID, globalTemplate)
+	}
+	loadedTemplates.forget(t.UUID)
+	return releaseTemplateBody(t.Sha256, t.UUID)
+}
+
+// maxAbandonedRenders is how many renders that timed out can still be
+// running before new renders are refused.
+const maxAbandonedRenders = 32
+
+// abandonedRenders counts the renders that timed out but are still
+// running.  text/template cannot be interrupted, so a render that
+// times out is left to stop on its own, which it does the next time it
+// writes anything.  One that loops without writing keeps running, and
+// this stops those from piling up.
+var abandonedRenders = struct {
+	sync.Mutex
+	count int
+}{}
+
+func abandonedRenderCount() int {
+	abandonedRenders.Lock()
+	defer abandonedRenders.Unlock()
+	return abandonedRenders.count
+}
+
+func addAbandonedRenders(n int) {
+	abandonedRenders.Lock()
+	abandonedRenders.count += n
+	abandonedRenders.Unlock()
 }
 
 // Render executes the template with params writing the results to dest
 func (t *Template) Render(dest io.Writer, params interface{}) error {
 	if t.parsedTmpl == nil {
 		if err := t.Parse(); err != nil {
-			return fmt.Errorf("template: %s does not compile: %v", t.UUID, err)
+			return &TemplateParseError{Template: t.UUID, Message: err.Error()}
 		}
 	}
-	if err := t.parsedTmpl.Execute(dest, params); err != nil {
-		return fmt.Errorf("template: cannot execute %s: %v", t.UUID, err)
+	if n := abandonedRenderCount(); n >= maxAbandonedRenders {
+		return fmt.Errorf("template: Not rendering %s, %d renders that timed out are still running", t.UUID, n)
 	}
-	return nil
+	w := &limitedWriter{dest: dest, limit: renderMaxSize}
+	if templateTimeout > 0 {
+		w.deadline = time.Now().Add(templateTimeout)
+	}
+	done := make(chan error, 1)
+	go func() {
+		err := t.parsedTmpl.Execute(w, params)
+		if w.finish() {
+			addAbandonedRenders(-1)
+		}
+		done <- err
+	}()
+	var timeout <-chan time.Time
+	if templateTimeout > 0 {
+		timer := time.NewTimer(templateTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("template: cannot execute %s: %v", t.UUID, err)
+		}
+		return nil
+	case <-timeout:
+		// Execute cannot be interrupted, so stop it from writing
+		// anything more and leave it to stop on its own.
+		if w.abort() {
+			addAbandonedRenders(1)
+		}
+		return fmt.Errorf("template: %s took longer than %v to render", t.UUID, templateTimeout)
+	}
+}
+
+// limitedWriter passes writes through to dest until limit bytes have
+// been written, its deadline passes, or it is aborted.  A limit of 0
+// means no limit, and a zero deadline means no deadline.
+type limitedWriter struct {
+	sync.Mutex
+	dest     io.Writer
+	limit    int64
+	written  int64
+	deadline time.Time
+	aborted  bool
+	finished bool
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.aborted {
+		return 0, fmt.Errorf("render aborted")
+	}
+	if !w.deadline.IsZero() && time.Now().After(w.deadline) {
+		return 0, fmt.Errorf("render took too long")
+	}
+	if w.limit > 0 && w.written+int64(len(p)) > w.limit {
+		return 0, fmt.Errorf("rendered output is larger than %d bytes", w.limit)
+	}
+	n, err := w.dest.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// abort stops anything more from being written, and returns whether
+// the render was still running.
+func (w *limitedWriter) abort() bool {
+	w.Lock()
+	defer w.Unlock()
+	w.aborted = true
+	return !w.finished
+}
+
+// finish marks the render as having stopped, and returns whether it
+// had been aborted while it was still running.
+func (w *limitedWriter) finish() bool {
+	w.Lock()
+	defer w.Unlock()
+	w.finished = true
+	return w.aborted
 }
 
 func (t *Template) RebuildRebarData() error {
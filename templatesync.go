@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The things that can happen to a template when it is synced.
+const (
+	syncCreated   = "created"
+	syncUpdated   = "updated"
+	syncUnchanged = "unchanged"
+	syncConflict  = "conflict"
+	syncFailed    = "failed"
+)
+
+// TemplateSyncResult is what happened to one template when the
+// templates were synced from --template-source.
+type TemplateSyncResult struct {
+	Path    string // The path of the template in the source.
+	UUID    string // The UUID the template is saved under.
+	Status  string // One of "created", "updated", "unchanged", "conflict", or "failed".
+	Message string `json:",omitempty"` // Why the template could not be synced, if it could not.
+}
+
+// TemplateSync is the result of syncing the templates from
+// --template-source.
+type TemplateSync struct {
+	Source    string
+	Time      time.Time
+	Templates []*TemplateSyncResult
+	Error     string `json:",omitempty"` // Why the sync failed as a whole, if it did.
+}
+
+// templateSyncMux makes sure only one sync runs at a time, and guards
+// lastTemplateSync.
+var templateSyncMux = &sync.Mutex{}
+var lastTemplateSync *TemplateSync
+
+// gitSource checks whether source is a git repository rather than an
+// HTTP base URL.
+func gitSource(source string) bool {
+	return strings.HasSuffix(source, ".git") ||
+		strings.HasPrefix(source, "git@") ||
+		strings.HasPrefix(source, "git://") ||
+		strings.HasPrefix(source, "ssh://")
+}
+
+// loadTemplateSourceMap loads the mapping of paths in the source to
+// template UUIDs from --template-source-map.
+func loadTemplateSourceMap() (map[string]string, error) {
+	buf, err := ioutil.ReadFile(templateSourceMap)
+	if err != nil {
+		return nil, fmt.Errorf("template-sync: Unable to read %s: %v", templateSourceMap, err)
+	}
+	res := map[string]string{}
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return nil, fmt.Errorf("template-sync: Unable to parse %s: %v", templateSourceMap, err)
+	}
+	return res, nil
+}
+
+// runGit runs git with args, and returns what it printed as the error
+// if it fails.
+func runGit(ctx context.Context, args ...string) error {
+	out := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, gitPath, args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("template-sync: git %s failed: %v: %s", args[0], err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// updateCheckout clones the git source into --template-sync-dir, or
+// pulls it if it has already been cloned.
+func updateCheckout(ctx context.Context) error {
+	if _, err := os.Stat(filepath.Join(templateSyncDir, ".git")); err == nil {
+		return runGit(ctx, "-C", templateSyncDir, "pull", "--ff-only")
+	}
+	if err := os.MkdirAll(filepath.Dir(templateSyncDir), 0755); err != nil {
+		return err
+	}
+	return runGit(ctx, "clone", "--depth", "1", templateSource, templateSyncDir)
+}
+
+// fetchSourceTemplate returns the contents of the template at
+// sourcePath in the source.
+func fetchSourceTemplate(ctx context.Context, sourcePath string) (string, error) {
+	if gitSource(templateSource) {
+		filePath := filepath.Join(templateSyncDir, filepath.FromSlash(sourcePath))
+		if !pathUnder(templateSyncDir, filePath) {
+			return "", fmt.Errorf("template-sync: %s is outside of the source", sourcePath)
+		}
+		// Symlinks committed to the source must not pull in files
+		// from elsewhere on the host.
+		root, err := filepath.EvalSymlinks(templateSyncDir)
+		if err != nil {
+			return "", err
+		}
+		resolved, err := filepath.EvalSymlinks(filePath)
+		if err != nil {
+			return "", err
+		}
+		if !pathUnder(root, resolved) {
+			return "", fmt.Errorf("template-sync: %s links to somewhere outside of the source", sourcePath)
+		}
+		buf, err := ioutil.ReadFile(resolved)
+		return string(buf), err
+	}
+	url := strings.TrimSuffix(templateSource, "/") + "/" + strings.TrimPrefix(sourcePath, "/")
+	ctx, cancel := context.WithTimeout(ctx, downloadTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", &DownloadError{URL: url, Message: err.Error()}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &DownloadError{
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			Message:    "Server returned " + resp.Status,
+		}
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", &DownloadError{URL: url, Message: err.Error()}
+	}
+	return string(buf), nil
+}
+
+// syncTemplate saves contents as the template with uuid, unless the
+// template has been edited since it was last synced and force is not
+// set.
+func syncTemplate(uuid, contents string, force bool) (string, error) {
+	sha := contentSha256(contents)
+	old := &Template{UUID: uuid}
+	status := syncUpdated
+	if err := backend.load(old); err != nil {
+		old = nil
+		status = syncCreated
+	} else if old.Sha256 == sha {
+		if old.SyncedSha256 != sha {
+			// Already the same, just remember that it was synced.
+			tmpl := &Template{UUID: uuid, Contents: contents, SyncedSha256: sha}
+			if err := backend.save(tmpl, old); err != nil {
+				return syncFailed, err
+			}
+		}
+		return syncUnchanged, nil
+	} else if !force && old.SyncedSha256 != old.Sha256 {
+		return syncConflict, fmt.Errorf("template-sync: %s has been changed since it was last synced, not overwriting it", uuid)
+	}
+	tmpl := &Template{UUID: uuid, Contents: contents, SyncedSha256: sha}
+	if err := backend.save(tmpl, old); err != nil {
+		return syncFailed, err
+	}
+	return status, nil
+}
+
+// renderBootEnvsUsing renders the machines of every boot environment
+// that uses one of the templates with the UUIDs in changed again.
+func renderBootEnvsUsing(ctx context.Context, changed map[string]bool) error {
+	bootEnvs, err := (&BootEnv{}).List()
+	if err != nil {
+		return err
+	}
+	machines, err := (&Machine{}).List()
+	if err != nil {
+		return err
+	}
+	failures := []string{}
+	for _, b := range bootEnvs {
+		b.mergeTemplates()
+		uses := false
+		for _, tmpl := range b.templates {
+			if changed[tmpl.UUID] || changed[tmpl.SchemaUUID] {
+				uses = true
+				break
+			}
+		}
+		if !uses {
+			continue
+		}
+		toRender := []*Machine{}
+		for _, machine := range machines {
+			if machine.BootEnv == b.Name {
+				toRender = append(toRender, machine)
+			}
+		}
+		if err := b.renderMachines(ctx, toRender); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("template-sync: Failed to render some machines again:\n%s", strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+type templateSyncResultsByPath []*TemplateSyncResult
+
+func (r templateSyncResultsByPath) Len() int           { return len(r) }
+func (r templateSyncResultsByPath) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r templateSyncResultsByPath) Less(i, j int) bool { return r[i].Path < r[j].Path }
+
+// SyncTemplates pulls the templates in --template-source-map from
+// --template-source into the backend, and renders the machines of the
+// boot environments using the ones that changed again.  Templates
+// that were edited since they were last synced are reported as
+// conflicts and left alone, unless force is set.
+func SyncTemplates(ctx context.Context, force bool) *TemplateSync {
+	templateSyncMux.Lock()
+	defer templateSyncMux.Unlock()
+	res := &TemplateSync{Source: templateSource, Time: time.Now(), Templates: []*TemplateSyncResult{}}
+	lastTemplateSync = res
+	sourceMap, err := loadTemplateSourceMap()
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if gitSource(templateSource) {
+		if err := updateCheckout(ctx); err != nil {
+			res.Error = err.Error()
+			return res
+		}
+	}
+	changed := map[string]bool{}
+	for sourcePath, uuid := range sourceMap {
+		result := &TemplateSyncResult{Path: sourcePath, UUID: uuid}
+		res.Templates = append(res.Templates, result)
+		contents, err := fetchSourceTemplate(ctx, sourcePath)
+		if err != nil {
+			result.Status = syncFailed
+			result.Message = err.Error()
+			continue
+		}
+		result.Status, err = syncTemplate(uuid, contents, force)
+		if err != nil {
+			result.Message = err.Error()
+			logger.Printf("template-sync: %s: %v\n", sourcePath, err)
+			continue
+		}
+		if result.Status != syncUnchanged {
+			changed[uuid] = true
+		}
+	}
+	sort.Sort(templateSyncResultsByPath(res.Templates))
+	if len(changed) > 0 {
+		if err := renderBootEnvsUsing(ctx, changed); err != nil {
+			res.Error = err.Error()
+		}
+	}
+	return res
+}
+
+// syncTemplatesEvery syncs the templates every interval, forever.
+func syncTemplatesEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), bootEnvTimeout)
+		res := SyncTemplates(ctx, false)
+		cancel()
+		if res.Error != "" {
+			logger.Printf("template-sync: Failed to sync templates from %s: %s\n", templateSource, res.Error)
+		}
+	}
+}
+
+func getTemplateSync(c *gin.Context) {
+	templateSyncMux.Lock()
+	res := lastTemplateSync
+	templateSyncMux.Unlock()
+	if res == nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+func postTemplateSync(c *gin.Context) {
+	if templateSource == "" || templateSourceMap == "" {
+		respondWithError(c, http.StatusNotFound, errors.New("template-sync: No --template-source and --template-source-map to sync from"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), bootEnvTimeout)
+	defer cancel()
+	res := SyncTemplates(ctx, c.Query(`force`) == "true")
+	status := http.StatusOK
+	if res.Error != "" {
+		status = http.StatusConflict
+	}
+	c.JSON(status, res)
+}
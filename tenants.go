@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+)
+
+// TenantURLs are the URLs the machines of a tenant should be given
+// instead of --provisioner and --command, for tenants served from
+// their own front end.  Either can be left empty to use the global
+// one.
+type TenantURLs struct {
+	ProvisionerURL string
+	CommandURL     string
+}
+
+// tenantURLs holds the TenantURLs for each tenant that has them,
+// keyed by TenantId.
+var tenantURLs = map[string]*TenantURLs{}
+
+// loadTenantURLs loads the per-tenant URLs from the JSON file at
+// filePath, which maps TenantIds to TenantURLs.
+func loadTenantURLs(filePath string) error {
+	buf, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("tenant: Unable to read %s: %v", filePath, err)
+	}
+	res := map[string]*TenantURLs{}
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return fmt.Errorf("tenant: Unable to parse %s: %v", filePath, err)
+	}
+	for id, urls := range res {
+		if _, err := strconv.Atoi(id); err != nil {
+			return fmt.Errorf("tenant: %s: %q is not a TenantId", filePath, id)
+		}
+		if urls == nil {
+			delete(res, id)
+		}
+	}
+	tenantURLs = res
+	return nil
+}
+
+// urlsFor returns the TenantURLs for the tenant of machine, or nil if
+// it has none.
+func urlsFor(machine *Machine) *TenantURLs {
+	if machine == nil || machine.TenantId == 0 {
+		return nil
+	}
+	return tenantURLs[strconv.Itoa(machine.TenantId)]
+}
+
+// provisionerURLFor returns the provisioner URL machine should be
+// given.
+func provisionerURLFor(machine *Machine) string {
+	if urls := urlsFor(machine); urls != nil && urls.ProvisionerURL != "" {
+		return urls.ProvisionerURL
+	}
+	return provisionerURL
+}
+
+// commandURLFor returns the command and control URL machine should be
+// given.
+func commandURLFor(machine *Machine) string {
+	if urls := urlsFor(machine); urls != nil && urls.CommandURL != "" {
+		return urls.CommandURL
+	}
+	return commandURL
+}
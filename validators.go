@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// renderValidator checks the rendered output of a template for
+// format-specific errors before it is written out for a machine.
+type renderValidator func(contents []byte) error
+
+// renderValidators holds the validators that TemplateInfo.Validator
+// can refer to.  Add new formats here.
+var renderValidators = map[string]renderValidator{
+	"kickstart": validateKickstart,
+	"preseed":   validatePreseed,
+	"json":      validateJSON,
+}
+
+// kickstartSections are the section headers that kickstart files may
+// contain after the command section.
+var kickstartSections = map[string]bool{
+	"%packages":    true,
+	"%pre":         true,
+	"%pre-install": true,
+	"%post":        true,
+	"%traceback":   true,
+	"%onerror":     true,
+	"%addon":       true,
+	"%anaconda":    true,
+}
+
+// validateKickstart makes sure that a kickstart file has well-formed
+// sections and that the template did not leave unexpanded values
+// behind.  Sections must either all be closed with %end, or (for
+// older anaconda releases) none of them may be.
+func validateKickstart(contents []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	lineNo := 0
+	openSection := ""
+	openLine := 0
+	usesEnd := bytes.Contains(contents, []byte("\n%end"))
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if strings.Contains(line, "<no value>") {
+			return fmt.Errorf("kickstart: line %d contains an unexpanded value", lineNo)
+		}
+		if !strings.HasPrefix(line, "%") {
+			continue
+		}
+		directive := strings.Fields(line)[0]
+		switch {
+		case directive == "%end":
+			if openSection == "" {
+				return fmt.Errorf("kickstart: line %d: %%end without an open section", lineNo)
+			}
+			openSection = ""
+		case directive == "%include" || directive == "%ksappend":
+			continue
+		case kickstartSections[directive]:
+			if usesEnd && openSection != "" {
+				return fmt.Errorf("kickstart: line %d: %s started before %s from line %d was closed with %%end",
+					lineNo, directive, openSection, openLine)
+			}
+			openSection = directive
+			openLine = lineNo
+		default:
+			// Shell scripts in %pre and %post can legitimately
+			// have lines starting with %.
+			if openSection == "%pre" || openSection == "%post" {
+				continue
+			}
+			return fmt.Errorf("kickstart: line %d: unknown directive %s", lineNo, directive)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if usesEnd && openSection != "" {
+		return fmt.Errorf("kickstart: %s from line %d is not closed with %%end", openSection, openLine)
+	}
+	return nil
+}
+
+// preseedTypes are the debconf question types allowed in a preseed file.
+var preseedTypes = map[string]bool{
+	"string":      true,
+	"boolean":     true,
+	"select":      true,
+	"multiselect": true,
+	"note":        true,
+	"password":    true,
+	"text":        true,
+	"title":       true,
+	"error":       true,
+	"seen":        true,
+}
+
+// validatePreseed makes sure that every line of a preseed file has
+// the "owner question type value" format that debconf expects.
+func validatePreseed(contents []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	lineNo := 0
+	startLine := 0
+	logical := ""
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if logical == "" {
+			startLine = lineNo
+		}
+		if strings.HasSuffix(line, "\\") {
+			logical += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		logical += line
+		if err := validatePreseedLine(startLine, logical); err != nil {
+			return err
+		}
+		logical = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if logical != "" {
+		return fmt.Errorf("preseed: line %d: continuation at end of file", startLine)
+	}
+	return nil
+}
+
+func validatePreseedLine(lineNo int, line string) error {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return nil
+	}
+	if strings.Contains(trimmed, "<no value>") {
+		return fmt.Errorf("preseed: line %d contains an unexpanded value", lineNo)
+	}
+	fields := strings.Fields(trimmed)
+	if len(fields) < 3 {
+		return fmt.Errorf("preseed: line %d: expected 'owner question type value', got %q", lineNo, trimmed)
+	}
+	if !preseedTypes[fields[2]] {
+		return fmt.Errorf("preseed: line %d: unknown question type %s", lineNo, fields[2])
+	}
+	if fields[2] == "boolean" {
+		if len(fields) != 4 || (fields[3] != "true" && fields[3] != "false") {
+			return fmt.Errorf("preseed: line %d: boolean %s must be true or false", lineNo, fields[1])
+		}
+	}
+	return nil
+}
+
+// validateJSON makes sure that the rendered template is a single,
+// well-formed JSON value.
+func validateJSON(contents []byte) error {
+	var val interface{}
+	if err := json.Unmarshal(contents, &val); err != nil {
+		return fmt.Errorf("json: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+)
+
+// VerifyResult is the result of checking a single artifact that a
+// boot environment needs against what is on disk.
+type VerifyResult struct {
+	BootEnv  string // The boot environment the artifact belongs to.
+	Machine  string `json:",omitempty"` // The machine the artifact was rendered for, if any.
+	Artifact string // What kind of artifact this is: iso, kernel, initrd, file, or rendered.
+	Path     string // Where the artifact is on disk.
+	Status   string // One of ok, unchecked, missing, removed, empty, mismatch, or error.
+	Message  string // Details about the status, if any.
+}
+
+// checkArtifact makes sure that the file at filePath exists and, if
+// expectedSha256 is not empty, that its contents match it.
+func checkArtifact(res *VerifyResult, expectedSha256 string) *VerifyResult {
+	stat, err := os.Stat(res.Path)
+	if err != nil {
+		res.Status = "missing"
+		res.Message = err.Error()
+		return res
+	}
+	if !stat.Mode().IsRegular() {
+		res.Status = "error"
+		res.Message = "not a regular file"
+		return res
+	}
+	if expectedSha256 == "" {
+		res.Status = "unchecked"
+		res.Message = "no checksum declared"
+		return res
+	}
+	actual, err := sha256File(res.Path)
+	if err != nil {
+		res.Status = "error"
+		res.Message = err.Error()
+		return res
+	}
+	if actual != expectedSha256 {
+		res.Status = "mismatch"
+		res.Message = fmt.Sprintf("actual: %s expected: %s", actual, expectedSha256)
+		return res
+	}
+	res.Status = "ok"
+	return res
+}
+
+// Verify re-checks all of the on-disk artifacts for the boot
+// environment against their declared checksums, and files validated
+// with gpg against their signatures.  It does not change anything on
+// disk.
+func (b *BootEnv) Verify(ctx context.Context) []*VerifyResult {
+	res := []*VerifyResult{}
+	if b.OS == nil {
+		return []*VerifyResult{{
+			BootEnv: b.Name,
+			Status:  "error",
+			Message: b.missingOS().Error(),
+		}}
+	}
+	if b.OS.IsoFile != "" {
+		result := checkArtifact(&VerifyResult{
+			BootEnv:  b.Name,
+			Artifact: "iso",
+			Path:     filepath.Join(fileRoot, "isos", b.OS.IsoFile),
+		}, b.OS.IsoSha256)
+		// ISOs that are not kept are supposed to be gone once they
+		// have been exploded.
+		if result.Status == "missing" && !b.OS.keepIso() {
+			if canaryPath, err := b.findCanary(); err == nil && canaryPath != "" {
+				result.Status = "removed"
+				result.Message = "removed after it was exploded"
+			}
+		}
+		res = append(res, result)
+	}
+	check := func(artifact, name, expectedSha256 string) *VerifyResult {
+		result := &VerifyResult{BootEnv: b.Name, Artifact: artifact}
+		filePath, err := b.PathFor("disk", name)
+		if err != nil {
+			result.Status = "error"
+			result.Message = err.Error()
+			res = append(res, result)
+			return result
+		}
+		result.Path = filePath
+		res = append(res, checkArtifact(result, expectedSha256))
+		return result
+	}
+	if b.Kernel != "" {
+		check("kernel", b.Kernel, "")
+	}
+	for _, initrd := range b.Initrds {
+		check("initrd", initrd, "")
+	}
+	for _, f := range b.OS.Files {
+		expected, err := f.expectedSha256()
+		if err != nil {
+			res = append(res, &VerifyResult{
+				BootEnv:  b.Name,
+				Artifact: "file",
+				Path:     f.diskName(),
+				Status:   "error",
+				Message:  err.Error(),
+			})
+			continue
+		}
+		result := check("file", f.diskName(), expected)
+		if result.Status != "unchecked" || f.ValidationMethod != "gpg" || f.ValidationURL == "" {
+			continue
+		}
+		switch err := f.checkSignature(ctx, result.Path).(type) {
+		case nil:
+			result.Status = "ok"
+			result.Message = ""
+		case *SignatureMismatchError:
+			result.Status = "mismatch"
+			result.Message = err.Message
+		default:
+			result.Status = "error"
+			result.Message = err.Error()
+		}
+	}
+	return res
+}
+
+// VerifyRenders renders the templates of the machine's boot
+// environment for it again in memory, and checks that each of the
+// files on disk exists and matches what it rendered.  This catches
+// rendered files that were removed or changed by hand.  It does not
+// change anything on disk.
+func (n *Machine) VerifyRenders() ([]*VerifyResult, error) {
+	bootEnv := &BootEnv{Name: n.BootEnv}
+	if err := backend.load(bootEnv); err != nil {
+		return nil, fmt.Errorf("machine: %s uses missing bootenv %s", n.Name, n.BootEnv)
+	}
+	// Hold the render lock so that a render in progress is not
+	// reported as drift.
+	unlock := machineRenderLocks.lock(n.key())
+	defer unlock()
+	files, err := bootEnv.renderFiles(n)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*VerifyResult, 0, len(files))
+	for _, f := range files {
+		result := checkArtifact(&VerifyResult{
+			BootEnv:  bootEnv.Name,
+			Machine:  n.Name,
+			Artifact: "rendered",
+			Path:     f.path,
+		}, contentSha256(string(f.contents)))
+		if result.Status == "mismatch" {
+			if stat, err := os.Stat(f.path); err == nil && stat.Size() == 0 && len(f.contents) > 0 {
+				result.Status = "empty"
+				result.Message = ""
+			}
+		}
+		if result.Message != "" {
+			result.Message = fmt.Sprintf("template %s: %s", f.name, result.Message)
+		} else if result.Status != "ok" {
+			result.Message = fmt.Sprintf("template %s", f.name)
+		}
+		res = append(res, result)
+	}
+	return res, nil
+}
+
+func verifyMachine(c *gin.Context) {
+	machine := popMachine(c.Param(`name`))
+	if err := backend.load(machine); err != nil {
+		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
+		return
+	}
+	res, err := machine.VerifyRenders()
+	if err != nil {
+		respondWithError(c, http.StatusConflict, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+func verifyBootEnvs(c *gin.Context) {
+	bootEnv := &BootEnv{}
+	bootEnvs, err := bootEnv.List()
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	res := []*VerifyResult{}
+	for _, bootEnv := range bootEnvs {
+		res = append(res, bootEnv.Verify(context.Background())...)
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// DanglingTemplate is a reference to a template that cannot be
+// loaded, which would make rendering fail.
+type DanglingTemplate struct {
+	Kind     string // What refers to the template: bootenv, family, or global-template.
+	Name     string // The name of the bootenv, family, or global template.
+	Template string `json:",omitempty"` // The Name of the template in it, for bootenvs and families.
+	UUID     string // The UUID of the template.
+	Message  string // Why it cannot be loaded.
+}
+
+// danglingTemplates checks every template that bootenvs, families,
+// and global templates refer to, and returns the ones that cannot be
+// loaded.
+func danglingTemplates() ([]*DanglingTemplate, error) {
+	res := []*DanglingTemplate{}
+	checked := map[string]error{}
+	check := func(kind, name, template, uuid string) {
+		err, ok := checked[uuid]
+		if !ok {
+			err = backend.load(&Template{UUID: uuid})
+			checked[uuid] = err
+		}
+		if err != nil {
+			res = append(res, &DanglingTemplate{
+				Kind:     kind,
+				Name:     name,
+				Template: template,
+				UUID:     uuid,
+				Message:  err.Error(),
+			})
+		}
+	}
+	bootEnvs, err := (&BootEnv{}).List()
+	if err != nil {
+		return nil, err
+	}
+	for _, bootEnv := range bootEnvs {
+		for _, tmpl := range bootEnv.Templates {
+			check("bootenv", bootEnv.Name, tmpl.Name, tmpl.UUID)
+			if tmpl.SchemaUUID != "" {
+				check("bootenv", bootEnv.Name, tmpl.Name+" schema", tmpl.SchemaUUID)
+			}
+		}
+	}
+	families, err := (&OsFamily{}).List()
+	if err != nil {
+		return nil, err
+	}
+	for _, family := range families {
+		for _, tmpl := range family.Templates {
+			check("family", family.Name, tmpl.Name, tmpl.UUID)
+			if tmpl.SchemaUUID != "" {
+				check("family", family.Name, tmpl.Name+" schema", tmpl.SchemaUUID)
+			}
+		}
+	}
+	globalTemplates, err := (&GlobalTemplate{}).List()
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range globalTemplates {
+		check("global-template", g.Name, "", g.UUID)
+	}
+	return res, nil
+}
+
+func verifyTemplateRefs(c *gin.Context) {
+	res, err := danglingTemplates()
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}